@@ -1,190 +1,486 @@
 package chat
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/wizzymore/tcp-go/server"
 )
 
+const DEFAULT_MAX_LINE_LENGTH = 4096
+const DEFAULT_ROOM = "#budgetchat"
+
+type Options struct {
+	// Addr is the address the chat server listens on, defaults to ":8000"
+	Addr string
+	// OperatorPassword enables the /oper command when not empty
+	OperatorPassword string
+	// MaxLineLength is the longest line, in bytes, a client may send before
+	// being disconnected
+	MaxLineLength int
+	// MessageRate is the number of messages per second a session may send,
+	// with bursts of up to MessageBurst messages. Zero disables the limit.
+	MessageRate  float64
+	MessageBurst int
+	// WebSocketAddr enables the WebSocket gateway and its web client on the
+	// given address when not empty
+	WebSocketAddr string
+	// IRCAddr enables the IRC listener on the given address when not empty
+	IRCAddr string
+	// Room is the channel name IRC clients see the room as, defaults to
+	// DEFAULT_ROOM
+	Room string
+	// Hooks are run for every event of the room, see Hook
+	Hooks []Hook
+	// TranscriptDir enables the transcript of the room in the given directory
+	// when not empty, see Transcript
+	TranscriptDir string
+	// TranscriptMaxBytes is the size at which a new transcript file is
+	// started, defaults to DEFAULT_TRANSCRIPT_MAX_BYTES
+	TranscriptMaxBytes int64
+}
+
 type ChatSession struct {
 	client   *server.TCPClient
+	lines    *server.LineConn
+	writer   sessionWriter
 	username string
+	operator bool
+	muted    *restriction
+}
+
+// sessionWriter formats what happens in the room for the protocol a session
+// is connected with
+type sessionWriter interface {
+	// prompt asks for a username
+	prompt() error
+	// welcome is sent once the session joined the room, requested is the
+	// username the client asked for which may differ from the one given
+	welcome(requested string) error
+	// members lists the other users in the room
+	members(usernames []string) error
+	joined(username string) error
+	left(username string) error
+	message(username string, text string) error
+	notice(text string) error
 }
 
 type message struct {
-	client *server.TCPClient
-	value  string
+	client  *server.TCPClient
+	request any
+}
+
+type connected struct {
+	session *ChatSession
+}
+type disconnected struct{}
+type lineReceived struct {
+	text string
+}
+type namesRequested struct{}
+type posted struct {
+	name string
+	text string
 }
 
 type ChatServer struct {
 	server   *server.TCPServer
+	options  Options
 	sessions map[*server.TCPClient]*ChatSession
+	bans     map[string]restriction
+	room     *Room
+	posted   []*MessagePosted
+
+	usernameCounts map[string]int
+	messages       chan message
+
+	wsListener      net.Listener
+	wsServer        *http.Server
+	nextWebSocketId atomic.Uint64
 
-	connected    chan *server.TCPClient
-	disconnected chan *server.TCPClient
-	message      chan message
+	ircServer *server.TCPServer
+
+	transcript *Transcript
 }
 
-func NewChatServer() (s server.Server, err error) {
+func NewChatServer(options ...Options) (s server.Server, err error) {
 	cs := &ChatServer{}
-	cs.server, err = server.NewTCPServer(cs.HandleClient)
+	if len(options) > 0 {
+		cs.options = options[0]
+	}
+	if cs.options.MaxLineLength <= 0 {
+		cs.options.MaxLineLength = DEFAULT_MAX_LINE_LENGTH
+	}
+	if cs.options.Room == "" {
+		cs.options.Room = DEFAULT_ROOM
+	}
+	if cs.options.TranscriptDir != "" {
+		if cs.transcript, err = NewTranscript(cs.options.TranscriptDir, cs.options.TranscriptMaxBytes); err != nil {
+			return cs, err
+		}
+		// Last so only what the room saw gets recorded
+		cs.options.Hooks = append(slices.Clone(cs.options.Hooks), cs.transcript)
+	}
+	cs.server, err = server.NewTCPServer(cs.HandleClient, cs.options.Addr)
+	if err != nil {
+		if cs.transcript != nil {
+			cs.transcript.Close()
+		}
+		return cs, err
+	}
+	if cs.options.WebSocketAddr != "" {
+		if err = cs.startWebSocket(); err != nil {
+			cs.Stop()
+			return cs, err
+		}
+	}
+	if cs.options.IRCAddr != "" {
+		ircServer, err := server.NewTCPServer(cs.HandleIRCClient, cs.options.IRCAddr)
+		if err != nil {
+			// The gateway is not serving its listener yet, closing the http
+			// server leaves it open
+			if cs.wsListener != nil {
+				cs.wsListener.Close()
+			}
+			cs.Stop()
+			return cs, err
+		}
+		cs.ircServer = ircServer
+	}
 	cs.sessions = make(map[*server.TCPClient]*ChatSession)
-	cs.connected = make(chan *server.TCPClient)
-	cs.disconnected = make(chan *server.TCPClient)
-	cs.message = make(chan message)
+	cs.bans = make(map[string]restriction)
+	cs.room = &Room{cs}
+	cs.usernameCounts = make(map[string]int)
+	cs.messages = make(chan message)
 	return cs, err
 }
 
 func (chatServer *ChatServer) Start() {
 	go chatServer.server.Start()
 
+	if chatServer.wsServer != nil {
+		go chatServer.serveWebSocket()
+	}
+
+	if chatServer.ircServer != nil {
+		go chatServer.ircServer.Start()
+	}
+
 	go chatServer.runChatServer()
 }
 
 func (chatServer *ChatServer) Stop() error {
-	return chatServer.server.Stop()
+	var errs []error
+	if chatServer.wsServer != nil {
+		errs = append(errs, chatServer.wsServer.Close())
+	}
+	if chatServer.ircServer != nil {
+		errs = append(errs, chatServer.ircServer.Stop())
+	}
+	errs = append(errs, chatServer.server.Stop())
+	if chatServer.transcript != nil {
+		errs = append(errs, chatServer.transcript.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (chatServer *ChatServer) IRCAddr() net.Addr {
+	if chatServer.ircServer == nil {
+		return nil
+	}
+	return chatServer.ircServer.Listener.Addr()
+}
+
+func (chatServer *ChatServer) Addr() net.Addr {
+	return chatServer.server.Listener.Addr()
 }
 
 func (chatServer *ChatServer) runChatServer() {
 	log := log.With().Str("service", "chat").Logger()
 	log.Info().Msg("Chat server starter")
-	usernameMaps := make(map[string]int)
-	for {
-		select {
-		case client := <-chatServer.connected:
-			log.Debug().Uint("peer", client.Id).Msg("New client connected")
-			session := &ChatSession{
-				client: client,
-			}
-			chatServer.sessions[client] = session
-			session.writeLine("Please enter your username...")
-		case client := <-chatServer.disconnected:
-			log.Debug().Uint("peer", client.Id).Msg("Client disconnected")
-			session := chatServer.sessions[client]
-			delete(chatServer.sessions, client)
-			if !session.IsConnected() {
-				break
-			}
-			uCounter := usernameMaps[session.username]
-			if uCounter <= 1 {
-				delete(usernameMaps, session.username)
-			} else {
-				usernameMaps[session.username] = uCounter - 1
-			}
-			for _, sess := range chatServer.sessions {
-				if sess.IsConnected() {
-					sess.writeLine(fmt.Sprintf("* %s has left the room", session.username))
-				}
+	for message := range chatServer.messages {
+		switch r := message.request.(type) {
+		case connected:
+			chatServer.handleConnected(r.session)
+		case disconnected:
+			chatServer.handleDisconnected(message.client)
+		case namesRequested:
+			session := chatServer.sessions[message.client]
+			if session.IsConnected() {
+				session.writer.members(chatServer.usernames(session))
 			}
-		case message := <-chatServer.message:
-			log.Debug().Str("message", message.value).Msg("Received a new chat message")
+		case lineReceived:
+			log.Debug().Str("message", r.text).Msg("Received a new chat message")
 			session := chatServer.sessions[message.client]
 			if session.username == "" {
-				if message.value == "" || !regexp.MustCompile(`^[a-zA-Z0-9]*$`).MatchString(message.value) {
-					session.client.Close()
-					break
-				}
-				{
-					uCounter, ok := usernameMaps[message.value]
-					if !ok {
-						session.username = message.value
-						usernameMaps[session.username] = 1
-					} else {
-						session.username = fmt.Sprintf("%s%d", message.value, uCounter)
-						usernameMaps[message.value] = uCounter + 1
-					}
-				}
-				usernames := []string{}
-				for _, sess := range chatServer.sessions {
-					if session.client == sess.client || !sess.IsConnected() {
-						continue
-					}
-					usernames = append(usernames, sess.username)
-					sess.writeLine(fmt.Sprintf("* %s has entered the room", session.username))
-				}
-				if len(usernames) > 0 {
-					session.writeLine(fmt.Sprintf("* The room contains: %s", strings.Join(usernames, ", ")))
-				} else {
-					session.writeLine("* The room is currently empty")
-				}
-				log.Info().Uint("peer", session.client.Id).Str("name", session.username).Msg("Client set their name")
-				break
+				chatServer.handleUsername(session, r.text)
+			} else {
+				chatServer.handleMessage(session, r.text)
 			}
+		case posted:
+			chatServer.posted = append(chatServer.posted, &MessagePosted{
+				Name: r.name,
+				Text: r.text,
+			})
+		}
+		chatServer.flushPosted()
+	}
+}
 
-			if message.value == "" {
-				break
-			}
+func (chatServer *ChatServer) handleConnected(session *ChatSession) {
+	client := session.client
+	log.Debug().Str("service", "chat").Uint("peer", client.Id).Msg("New client connected")
+	chatServer.sessions[client] = session
+	if chatServer.isBanned(remoteIP(client)) {
+		log.Info().Str("service", "chat").Uint("peer", client.Id).Msg("Rejected banned address")
+		session.writer.notice("You are banned from this room")
+		client.Close()
+		return
+	}
+	session.writer.prompt()
+}
 
-			for _, sess := range chatServer.sessions {
-				if sess.client == session.client || !sess.IsConnected() {
-					continue
-				}
-				sess.writeLine(fmt.Sprintf("[%s] %s", session.username, message.value))
-			}
-			log.Info().
-				Uint("peer", session.client.Id).
-				Str("name", session.username).
-				Str("text", message.value).
-				Msg("Client sent new text")
+func (chatServer *ChatServer) handleDisconnected(client *server.TCPClient) {
+	log.Debug().Str("service", "chat").Uint("peer", client.Id).Msg("Client disconnected")
+	session := chatServer.sessions[client]
+	delete(chatServer.sessions, client)
+	if !session.IsConnected() {
+		return
+	}
+	uCounter := chatServer.usernameCounts[session.username]
+	if uCounter <= 1 {
+		delete(chatServer.usernameCounts, session.username)
+	} else {
+		chatServer.usernameCounts[session.username] = uCounter - 1
+	}
+	for _, sess := range chatServer.sessions {
+		if sess.IsConnected() {
+			sess.writer.left(session.username)
 		}
 	}
+	chatServer.emit(&UserLeft{
+		Time: time.Now(),
+		Peer: client.Id,
+		Name: session.username,
+	})
+}
+
+func (chatServer *ChatServer) rejectName(session *ChatSession, name string, reason string) {
+	log.Info().
+		Str("service", "chat").
+		Uint("peer", session.client.Id).
+		Str("name", name).
+		Str("reason", reason).
+		Msg("Rejected username")
+	chatServer.emit(&NameRejected{
+		Time:   time.Now(),
+		Peer:   session.client.Id,
+		Addr:   session.client.RemoteAddr().String(),
+		Name:   name,
+		Reason: reason,
+	})
+	session.client.Close()
+}
+
+func (chatServer *ChatServer) handleUsername(session *ChatSession, name string) {
+	if name == "" || !regexp.MustCompile(`^[a-zA-Z0-9]*$`).MatchString(name) {
+		chatServer.rejectName(session, name, "invalid")
+		return
+	}
+
+	username := name
+	if uCounter, ok := chatServer.usernameCounts[name]; ok {
+		username = fmt.Sprintf("%s%d", name, uCounter)
+	}
+	// Bans target the name shown in the room, which may be the deduplicated
+	// one
+	if chatServer.isBanned(name) || chatServer.isBanned(username) {
+		session.writer.notice("You are banned from this room")
+		chatServer.rejectName(session, name, "banned")
+		return
+	}
+	if !chatServer.emit(&UserJoined{
+		Time:      time.Now(),
+		Peer:      session.client.Id,
+		Addr:      session.client.RemoteAddr().String(),
+		Requested: name,
+		Name:      username,
+	}) {
+		chatServer.rejectName(session, name, "rejected by hook")
+		return
+	}
+
+	session.username = username
+	chatServer.usernameCounts[name] += 1
+	for _, sess := range chatServer.sessions {
+		if session.client == sess.client || !sess.IsConnected() {
+			continue
+		}
+		sess.writer.joined(session.username)
+	}
+	session.writer.welcome(name)
+	session.writer.members(chatServer.usernames(session))
+	log.Info().Str("service", "chat").Uint("peer", session.client.Id).Str("name", session.username).Msg("Client set their name")
+}
+
+func (chatServer *ChatServer) handleMessage(session *ChatSession, text string) {
+	if text == "" {
+		return
+	}
+
+	if chatServer.handleCommand(session, text) {
+		return
+	}
+
+	if session.muted != nil {
+		if session.muted.active(time.Now()) {
+			session.writer.notice("You are muted")
+			return
+		}
+		session.muted = nil
+	}
+
+	m := &MessagePosted{
+		Time: time.Now(),
+		Peer: session.client.Id,
+		Name: session.username,
+		Text: text,
+	}
+	if !chatServer.emit(m) {
+		log.Debug().Str("service", "chat").Uint("peer", session.client.Id).Msg("Message dropped by hook")
+		return
+	}
+	chatServer.broadcast(m, session.client)
+	log.Info().
+		Str("service", "chat").
+		Uint("peer", session.client.Id).
+		Str("name", session.username).
+		Str("text", m.Text).
+		Msg("Client sent new text")
+}
+
+// broadcast sends m to everyone in the room except from
+func (chatServer *ChatServer) broadcast(m *MessagePosted, from *server.TCPClient) {
+	for _, sess := range chatServer.sessions {
+		if sess.client == from || !sess.IsConnected() {
+			continue
+		}
+		sess.writer.message(m.Name, m.Text)
+	}
+}
+
+// Post sends a message from name to everyone in the room. It is safe to call
+// from any goroutine but hooks, which must use Room.Post instead.
+func (chatServer *ChatServer) Post(name string, text string) {
+	chatServer.messages <- message{nil, posted{name, text}}
 }
 
 func (cs *ChatServer) HandleClient(c *server.TCPClient) error {
 	defer func() {
-		cs.disconnected <- c
+		cs.messages <- message{c, disconnected{}}
 	}()
 
-	cs.connected <- c
+	session := &ChatSession{client: c, lines: server.NewLineConn(c, server.LineOptions{MaxLineLength: cs.options.MaxLineLength})}
+	session.writer = &lineWriter{session}
+	cs.messages <- message{c, connected{session}}
 
-	reader := bufio.NewReader(c)
-	for {
-		text, err := reader.ReadString('\n')
+	limiter := newRateLimiter(cs.options.MessageRate, cs.options.MessageBurst)
+	// The first line is the username, only the messages after it are limited
+	for joining := true; ; joining = false {
+		text, err := cs.readLine(session)
 		if err != nil {
+			if errors.Is(err, server.ErrLineTooLong) {
+				session.writeLine("* Your message is too long")
+				return err
+			}
 			if errors.Is(err, net.ErrClosed) {
 				break
 			}
 			return err
 		}
 
-		cs.message <- struct {
-			client *server.TCPClient
-			value  string
-		}{
-			client: c,
-			value:  strings.TrimRight(text, "\r\n"),
+		if !joining && !limiter.allow(time.Now()) {
+			c.Logger.Warn().Msg("client is sending messages too fast, dropped message")
+			session.writeLine("* You are sending messages too fast")
+			continue
 		}
+
+		cs.messages <- message{c, lineReceived{text}}
 	}
 
 	return nil
 }
 
+// readLine reads the next line of session, failing with server.ErrLineTooLong
+// when it is longer than MaxLineLength
+func (cs *ChatServer) readLine(session *ChatSession) (string, error) {
+	line, err := session.lines.ReadString()
+	if errors.Is(err, server.ErrLineTooLong) {
+		session.client.Logger.Warn().Int("max", cs.options.MaxLineLength).Msg("client sent a line that is too long")
+	}
+	return line, err
+}
+
+// usernames lists everyone in the room except session, which may be nil
+func (chatServer *ChatServer) usernames(session *ChatSession) []string {
+	usernames := []string{}
+	for _, sess := range chatServer.sessions {
+		if session == sess || !sess.IsConnected() {
+			continue
+		}
+		usernames = append(usernames, sess.username)
+	}
+	return usernames
+}
+
 func (chatSession *ChatSession) IsConnected() bool {
 	return chatSession.username != ""
 }
 
 func (chatSession *ChatSession) writeLine(line string) error {
-	data := []byte(line)
-	if line[len(line)-1] != '\n' {
-		data = append(data, '\n')
-	}
+	return chatSession.lines.SendLine(line)
+}
 
-	n, err := chatSession.client.Write(data)
+// lineWriter speaks the budget chat line protocol
+type lineWriter struct {
+	session *ChatSession
+}
 
-	if err != nil {
-		return err
-	}
+func (w *lineWriter) prompt() error {
+	return w.session.writeLine("Please enter your username...")
+}
 
-	if n != len(data) {
-		return io.ErrUnexpectedEOF
+func (w *lineWriter) welcome(requested string) error {
+	return nil
+}
+
+func (w *lineWriter) members(usernames []string) error {
+	if len(usernames) == 0 {
+		return w.session.writeLine("* The room is currently empty")
 	}
+	return w.session.writeLine(fmt.Sprintf("* The room contains: %s", strings.Join(usernames, ", ")))
+}
 
-	return nil
+func (w *lineWriter) joined(username string) error {
+	return w.session.writeLine(fmt.Sprintf("* %s has entered the room", username))
+}
+
+func (w *lineWriter) left(username string) error {
+	return w.session.writeLine(fmt.Sprintf("* %s has left the room", username))
+}
+
+func (w *lineWriter) message(username string, text string) error {
+	return w.session.writeLine(fmt.Sprintf("[%s] %s", username, text))
+}
+
+func (w *lineWriter) notice(text string) error {
+	return w.session.writeLine("* " + text)
 }
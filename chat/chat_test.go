@@ -0,0 +1,243 @@
+package chat_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/chat"
+)
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func join(t *testing.T, addr net.Addr, name string) *testClient {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err, "Could not connect to chat server")
+	c := &testClient{conn, bufio.NewReader(conn)}
+	c.expect(t, "Please enter your username...")
+	c.send(t, name)
+	c.readLine(t)
+	return c
+}
+
+func (c *testClient) send(t *testing.T, line string) {
+	_, err := c.conn.Write([]byte(line + "\n"))
+	require.NoError(t, err, "Could not write to chat server")
+}
+
+func (c *testClient) readLine(t *testing.T) string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	line, err := c.reader.ReadString('\n')
+	require.NoError(t, err, "Could not read from chat server")
+	return strings.TrimRight(line, "\n")
+}
+
+func (c *testClient) expect(t *testing.T, line string) {
+	assert.Equal(t, line, c.readLine(t))
+}
+
+func TestModeration(t *testing.T) {
+	s, err := chat.NewChatServer(chat.Options{
+		Addr:             "127.0.0.1:0",
+		OperatorPassword: "secret",
+		MaxLineLength:    32,
+		MessageRate:      1,
+		MessageBurst:     5,
+	})
+	require.NoError(t, err, "Could not create chat server")
+	go s.Start()
+	defer s.Stop()
+	addr := s.(*chat.ChatServer).Addr()
+
+	alice := join(t, addr, "alice")
+	defer alice.conn.Close()
+	bob := join(t, addr, "bob")
+	defer bob.conn.Close()
+	alice.expect(t, "* bob has entered the room")
+
+	t.Run("rejects wrong operator password", func(t *testing.T) {
+		bob.send(t, "/oper nope")
+		bob.expect(t, "* Invalid operator password")
+		bob.send(t, "/kick alice")
+		bob.expect(t, "* Permission denied")
+	})
+
+	t.Run("operator can mute", func(t *testing.T) {
+		alice.send(t, "/oper secret")
+		alice.expect(t, "* You are now an operator")
+		alice.send(t, "/mute bob")
+		bob.expect(t, "* You have been muted permanently")
+		alice.expect(t, "* bob is muted permanently")
+		bob.send(t, "hello")
+		bob.expect(t, "* You are muted")
+	})
+
+	t.Run("operator can ban", func(t *testing.T) {
+		alice.send(t, "/ban bob 1m")
+		bob.expect(t, "* You have been banned by alice")
+		alice.readLine(t)
+		alice.expect(t, "* bob has left the room")
+
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Could not connect to chat server")
+		defer conn.Close()
+		banned := &testClient{conn, bufio.NewReader(conn)}
+		banned.expect(t, "Please enter your username...")
+		banned.send(t, "bob")
+		banned.expect(t, "* You are banned from this room")
+	})
+
+	t.Run("bans deduplicated names", func(t *testing.T) {
+		erin := join(t, addr, "erin")
+		defer erin.conn.Close()
+		alice.expect(t, "* erin has entered the room")
+		erin1 := join(t, addr, "erin")
+		defer erin1.conn.Close()
+		alice.expect(t, "* erin1 has entered the room")
+		erin.expect(t, "* erin1 has entered the room")
+
+		alice.send(t, "/ban erin1 1m")
+		erin1.expect(t, "* You have been banned by alice")
+		alice.readLine(t)
+		alice.expect(t, "* erin1 has left the room")
+		erin.expect(t, "* erin1 has left the room")
+		erin.conn.Close()
+		alice.expect(t, "* erin has left the room")
+
+		// Asking for erin again gives erin1 back
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Could not connect to chat server")
+		defer conn.Close()
+		banned := &testClient{conn, bufio.NewReader(conn)}
+		banned.expect(t, "Please enter your username...")
+		banned.send(t, "erin")
+		banned.expect(t, "* You are banned from this room")
+	})
+
+	t.Run("rate limits messages", func(t *testing.T) {
+		carol := join(t, addr, "carol")
+		defer carol.conn.Close()
+		for i := range 6 {
+			carol.send(t, fmt.Sprintf("message %d", i))
+		}
+		carol.expect(t, "* You are sending messages too fast")
+		alice.expect(t, "* carol has entered the room")
+		for i := range 5 {
+			alice.expect(t, fmt.Sprintf("[carol] message %d", i))
+		}
+	})
+
+	t.Run("disconnects on long lines", func(t *testing.T) {
+		dave := join(t, addr, "dave")
+		defer dave.conn.Close()
+		dave.send(t, strings.Repeat("a", 64))
+		dave.expect(t, "* Your message is too long")
+		_, err := dave.reader.ReadString('\n')
+		assert.Error(t, err, "Connection should be closed")
+	})
+}
+
+func TestHooks(t *testing.T) {
+	audit := make(chan chat.Event, 32)
+	s, err := chat.NewChatServer(chat.Options{
+		Addr: "127.0.0.1:0",
+		Hooks: []chat.Hook{
+			chat.HookFunc(func(room *chat.Room, event chat.Event) bool {
+				audit <- event
+				return true
+			}),
+			// Filter
+			chat.HookFunc(func(room *chat.Room, event chat.Event) bool {
+				switch e := event.(type) {
+				case *chat.UserJoined:
+					return e.Requested != "mallory"
+				case *chat.MessagePosted:
+					if strings.Contains(e.Text, "spam") {
+						return false
+					}
+					e.Text = strings.ReplaceAll(e.Text, "darn", "****")
+				}
+				return true
+			}),
+			// Bot
+			chat.HookFunc(func(room *chat.Room, event chat.Event) bool {
+				if e, ok := event.(*chat.MessagePosted); ok && e.Text == "!ping" {
+					room.Post("bot", "pong")
+				}
+				return true
+			}),
+		},
+	})
+	require.NoError(t, err, "Could not create chat server")
+	go s.Start()
+	defer s.Stop()
+	addr := s.(*chat.ChatServer).Addr()
+
+	alice := join(t, addr, "alice")
+	defer alice.conn.Close()
+	bob := join(t, addr, "bob")
+	defer bob.conn.Close()
+	alice.expect(t, "* bob has entered the room")
+
+	t.Run("filters messages", func(t *testing.T) {
+		bob.send(t, "buy spam")
+		bob.send(t, "oh darn")
+		alice.expect(t, "[bob] oh ****")
+	})
+
+	t.Run("bots can answer", func(t *testing.T) {
+		bob.send(t, "!ping")
+		alice.expect(t, "[bob] !ping")
+		alice.expect(t, "[bot] pong")
+		bob.expect(t, "[bot] pong")
+	})
+
+	t.Run("hooks can reject names", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err, "Could not connect to chat server")
+		defer conn.Close()
+		mallory := &testClient{conn, bufio.NewReader(conn)}
+		mallory.expect(t, "Please enter your username...")
+		mallory.send(t, "mallory")
+		_, err = mallory.reader.ReadString('\n')
+		assert.Error(t, err, "Connection should be closed")
+	})
+
+	t.Run("audits every event", func(t *testing.T) {
+		bob.conn.Close()
+		alice.expect(t, "* bob has left the room")
+
+		events := []string{}
+		for len(audit) > 0 {
+			switch e := (<-audit).(type) {
+			case *chat.UserJoined:
+				events = append(events, "joined "+e.Name)
+			case *chat.UserLeft:
+				events = append(events, "left "+e.Name)
+			case *chat.MessagePosted:
+				events = append(events, e.Name+": "+e.Text)
+			case *chat.NameRejected:
+				events = append(events, "rejected "+e.Name)
+			}
+		}
+		assert.Equal(t, []string{
+			"joined alice",
+			"joined bob",
+			"bob: buy spam",
+			"bob: oh ****",
+			"bob: !ping",
+			"bot: pong",
+			"joined mallory",
+			"rejected mallory",
+			"left bob",
+		}, events)
+	})
+}
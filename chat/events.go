@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upper bound of messages hooks may post while handling a single event, this
+// stops bots from answering each other forever
+const MAX_HOOK_POSTS = 64
+
+// Event is something that happened in the chat room. Events are always
+// passed to hooks as pointers: *UserJoined, *UserLeft, *MessagePosted or
+// *NameRejected.
+type Event interface {
+	event()
+}
+
+type UserJoined struct {
+	Time time.Time
+	Peer uint
+	Addr string
+	// Requested is the username the client asked for, Name can differ from it
+	// when the username was already taken
+	Requested string
+	Name      string
+}
+
+type UserLeft struct {
+	Time time.Time
+	Peer uint
+	Name string
+}
+
+type MessagePosted struct {
+	Time time.Time
+	// Peer is zero for messages posted by hooks
+	Peer uint
+	Name string
+	Text string
+}
+
+type NameRejected struct {
+	Time   time.Time
+	Peer   uint
+	Addr   string
+	Name   string
+	Reason string
+}
+
+func (*UserJoined) event()    {}
+func (*UserLeft) event()      {}
+func (*MessagePosted) event() {}
+func (*NameRejected) event()  {}
+
+// Hook is called from the chat server loop for every event, in the order
+// the hooks were configured, and must not block.
+//
+// UserJoined and MessagePosted are handed to hooks before they are applied:
+// hooks may rewrite a MessagePosted and returning false rejects the user or
+// drops the message without calling the remaining hooks. The return value is
+// ignored for the other events.
+type Hook interface {
+	HandleEvent(room *Room, event Event) bool
+}
+
+type HookFunc func(room *Room, event Event) bool
+
+func (f HookFunc) HandleEvent(room *Room, event Event) bool {
+	return f(room, event)
+}
+
+// Room is the view of the chat room given to hooks, it must only be used
+// from within HandleEvent
+type Room struct {
+	chatServer *ChatServer
+}
+
+func (r *Room) Name() string {
+	return r.chatServer.options.Room
+}
+
+// Users lists the usernames of everyone in the room
+func (r *Room) Users() []string {
+	return r.chatServer.usernames(nil)
+}
+
+// Post sends a message from name to everyone in the room once the current
+// event is handled. Posted messages go through the hooks as well.
+func (r *Room) Post(name string, text string) {
+	r.chatServer.posted = append(r.chatServer.posted, &MessagePosted{
+		Name: name,
+		Text: text,
+	})
+}
+
+// Notice sends text to the users called name only
+func (r *Room) Notice(name string, text string) {
+	for _, sess := range r.chatServer.sessions {
+		if sess.IsConnected() && sess.username == name {
+			sess.writer.notice(text)
+		}
+	}
+}
+
+// emit runs event through the hooks and reports if it may be applied
+func (chatServer *ChatServer) emit(event Event) bool {
+	for _, hook := range chatServer.options.Hooks {
+		if hook.HandleEvent(chatServer.room, event) {
+			continue
+		}
+		switch event.(type) {
+		case *UserJoined, *MessagePosted:
+			return false
+		}
+	}
+	return true
+}
+
+// flushPosted broadcasts the messages posted by hooks
+func (chatServer *ChatServer) flushPosted() {
+	for count := 0; len(chatServer.posted) > 0; count++ {
+		m := chatServer.posted[0]
+		chatServer.posted = chatServer.posted[1:]
+		if count == MAX_HOOK_POSTS {
+			log.Warn().Str("service", "chat").Int("dropped", len(chatServer.posted)+1).Msg("Hooks posted too many messages, dropping the rest")
+			chatServer.posted = nil
+			return
+		}
+		m.Time = time.Now()
+		if !chatServer.emit(m) {
+			continue
+		}
+		chatServer.broadcast(m, nil)
+	}
+}
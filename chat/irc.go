@@ -0,0 +1,272 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const IRC_SERVER_NAME = "budgetchat"
+
+var ircNickRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// ircMessage is a parsed IRC line, the trailing parameter is the last entry
+// of params
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+func parseIRCMessage(line string) (m ircMessage, ok bool) {
+	line = strings.TrimLeft(line, " ")
+	// The prefix is ignored for messages sent by clients
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param == "" {
+			continue
+		}
+		if m.command == "" {
+			m.command = strings.ToUpper(param)
+		} else {
+			m.params = append(m.params, param)
+		}
+	}
+	return m, m.command != ""
+}
+
+// HandleIRCClient maps an IRC connection onto a chat session. Registered IRC
+// users are always in the room, PART and QUIT both leave the chat.
+func (cs *ChatServer) HandleIRCClient(c *server.TCPClient) error {
+	c.Logger = c.Logger.With().Str("transport", "irc").Logger()
+
+	session := &ChatSession{client: c, lines: server.NewLineConn(c, server.LineOptions{MaxLineLength: cs.options.MaxLineLength, CRLF: true})}
+	writer := &ircWriter{session: session, room: cs.options.Room, nick: "*"}
+	session.writer = writer
+
+	defer func() {
+		cs.messages <- message{c, disconnected{}}
+	}()
+
+	cs.messages <- message{c, connected{session}}
+
+	var nick string
+	var user string
+	registered := false
+
+	limiter := newRateLimiter(cs.options.MessageRate, cs.options.MessageBurst)
+	for {
+		line, err := cs.readLine(session)
+		if err != nil {
+			if errors.Is(err, server.ErrLineTooLong) {
+				writer.reply("ERROR", "Closing link: line too long")
+				return err
+			}
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			return err
+		}
+
+		m, ok := parseIRCMessage(line)
+		if !ok {
+			continue
+		}
+		c.Logger.Debug().Str("command", m.command).Strs("params", m.params).Msg("received irc command")
+
+		if !registered {
+			switch m.command {
+			case "CAP", "PASS", "NICK", "USER", "PING", "PONG", "QUIT":
+			default:
+				writer.numeric("451", "You have not registered")
+				continue
+			}
+		}
+
+		switch m.command {
+		case "CAP":
+			if len(m.params) > 0 && strings.ToUpper(m.params[0]) == "LS" {
+				writer.reply("CAP", "*", "LS", "")
+			}
+		case "PASS", "PONG":
+		case "NICK":
+			if registered {
+				writer.numeric("400", "NICK", "Nickname changes are not supported")
+				continue
+			}
+			if len(m.params) == 0 {
+				writer.numeric("431", "No nickname given")
+				continue
+			}
+			if !ircNickRegex.MatchString(m.params[0]) {
+				writer.numeric("432", m.params[0], "Erroneous nickname")
+				continue
+			}
+			nick = m.params[0]
+		case "USER":
+			if registered {
+				writer.numeric("462", "You may not reregister")
+				continue
+			}
+			if len(m.params) < 4 {
+				writer.numeric("461", "USER", "Not enough parameters")
+				continue
+			}
+			user = m.params[0]
+		case "PING":
+			writer.reply("PONG", IRC_SERVER_NAME, strings.Join(m.params, " "))
+		case "JOIN":
+			if len(m.params) == 0 {
+				writer.numeric("461", "JOIN", "Not enough parameters")
+				continue
+			}
+			for channel := range strings.SplitSeq(m.params[0], ",") {
+				if !strings.EqualFold(channel, cs.options.Room) {
+					writer.numeric("403", channel, "No such channel")
+					continue
+				}
+				// Registered users already are in the room, resend the names
+				cs.messages <- message{c, namesRequested{}}
+			}
+		case "NAMES":
+			if len(m.params) > 0 && !strings.EqualFold(m.params[0], cs.options.Room) {
+				writer.numeric("366", m.params[0], "End of /NAMES list")
+				continue
+			}
+			cs.messages <- message{c, namesRequested{}}
+		case "PRIVMSG":
+			if len(m.params) < 2 || m.params[1] == "" {
+				writer.numeric("412", "No text to send")
+				continue
+			}
+			if !strings.EqualFold(m.params[0], cs.options.Room) {
+				writer.numeric("401", m.params[0], "No such nick/channel")
+				continue
+			}
+			if !limiter.allow(time.Now()) {
+				c.Logger.Warn().Msg("client is sending messages too fast, dropped message")
+				writer.serverNotice("You are sending messages too fast")
+				continue
+			}
+			cs.messages <- message{c, lineReceived{m.params[1]}}
+		case "PART":
+			writer.reply("ERROR", "Closing link: left "+cs.options.Room)
+			return nil
+		case "QUIT":
+			writer.reply("ERROR", "Closing link: quit")
+			return nil
+		default:
+			writer.numeric("421", m.command, "Unknown command")
+		}
+
+		if !registered && nick != "" && user != "" {
+			registered = true
+			cs.messages <- message{c, lineReceived{nick}}
+		}
+	}
+
+	return nil
+}
+
+// ircWriter speaks IRC to a session. The nick is shared with the connection
+// handler, everything else is only used from the chat server loop.
+type ircWriter struct {
+	session *ChatSession
+	room    string
+
+	lock sync.Mutex
+	nick string
+}
+
+func (w *ircWriter) currentNick() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.nick
+}
+
+func ircPrefix(username string) string {
+	return fmt.Sprintf("%s!%s@%s", username, username, IRC_SERVER_NAME)
+}
+
+// send writes a message from prefix, the last parameter is always sent as
+// the trailing parameter
+func (w *ircWriter) send(prefix string, command string, params ...string) error {
+	b := strings.Builder{}
+	b.WriteString(":" + prefix + " " + command)
+	for i, param := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + param)
+		} else {
+			b.WriteString(" " + param)
+		}
+	}
+	return w.session.writeLine(b.String())
+}
+
+func (w *ircWriter) reply(command string, params ...string) error {
+	return w.send(IRC_SERVER_NAME, command, params...)
+}
+
+func (w *ircWriter) numeric(code string, params ...string) error {
+	return w.reply(code, append([]string{w.currentNick()}, params...)...)
+}
+
+func (w *ircWriter) serverNotice(text string) error {
+	return w.reply("NOTICE", w.currentNick(), text)
+}
+
+func (w *ircWriter) prompt() error {
+	return w.serverNotice("Please register with NICK and USER")
+}
+
+func (w *ircWriter) welcome(requested string) error {
+	w.lock.Lock()
+	w.nick = w.session.username
+	w.lock.Unlock()
+
+	if err := w.numeric("001", fmt.Sprintf("Welcome to budget chat %s", w.session.username)); err != nil {
+		return err
+	}
+	if err := w.numeric("422", "MOTD File is missing"); err != nil {
+		return err
+	}
+	return w.send(ircPrefix(w.session.username), "JOIN", w.room)
+}
+
+func (w *ircWriter) members(usernames []string) error {
+	names := append([]string{w.session.username}, usernames...)
+	if err := w.numeric("353", "=", w.room, strings.Join(names, " ")); err != nil {
+		return err
+	}
+	return w.numeric("366", w.room, "End of /NAMES list")
+}
+
+func (w *ircWriter) joined(username string) error {
+	return w.send(ircPrefix(username), "JOIN", w.room)
+}
+
+func (w *ircWriter) left(username string) error {
+	return w.send(ircPrefix(username), "PART", w.room, "has left the room")
+}
+
+func (w *ircWriter) message(username string, text string) error {
+	return w.send(ircPrefix(username), "PRIVMSG", w.room, text)
+}
+
+func (w *ircWriter) notice(text string) error {
+	return w.serverNotice(text)
+}
@@ -0,0 +1,115 @@
+package chat_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/chat"
+)
+
+type ircClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *ircClient) send(t *testing.T, line string) {
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	require.NoError(t, err, "Could not write to irc listener")
+}
+
+func (c *ircClient) read(t *testing.T) string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	line, err := c.reader.ReadString('\n')
+	require.NoError(t, err, "Could not read from irc listener")
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestIRCListener(t *testing.T) {
+	s, err := chat.NewChatServer(chat.Options{
+		Addr:    "127.0.0.1:0",
+		IRCAddr: "127.0.0.1:0",
+		Room:    "#test",
+	})
+	require.NoError(t, err, "Could not create chat server")
+	go s.Start()
+	defer s.Stop()
+	cs := s.(*chat.ChatServer)
+
+	alice := join(t, cs.Addr(), "alice")
+	defer alice.conn.Close()
+
+	conn, err := net.Dial("tcp", cs.IRCAddr().String())
+	require.NoError(t, err, "Could not connect to irc listener")
+	defer conn.Close()
+	bob := &ircClient{conn, bufio.NewReader(conn)}
+
+	t.Run("registers and joins the room", func(t *testing.T) {
+		assert.Equal(t, ":budgetchat NOTICE * :Please register with NICK and USER", bob.read(t))
+		bob.send(t, "NICK bob")
+		bob.send(t, "USER bob 0 * :Bob")
+		assert.Equal(t, ":budgetchat 001 bob :Welcome to budget chat bob", bob.read(t))
+		assert.Equal(t, ":budgetchat 422 bob :MOTD File is missing", bob.read(t))
+		assert.Equal(t, ":bob!bob@budgetchat JOIN :#test", bob.read(t))
+		assert.Equal(t, ":budgetchat 353 bob = #test :bob alice", bob.read(t))
+		assert.Equal(t, ":budgetchat 366 bob #test :End of /NAMES list", bob.read(t))
+		alice.expect(t, "* bob has entered the room")
+	})
+
+	t.Run("answers pings", func(t *testing.T) {
+		bob.send(t, "PING :12345")
+		assert.Equal(t, ":budgetchat PONG budgetchat :12345", bob.read(t))
+	})
+
+	t.Run("relays messages both ways", func(t *testing.T) {
+		bob.send(t, "PRIVMSG #test :hello from irc")
+		alice.expect(t, "[bob] hello from irc")
+
+		alice.send(t, "hello from tcp")
+		assert.Equal(t, ":alice!alice@budgetchat PRIVMSG #test :hello from tcp", bob.read(t))
+	})
+
+	t.Run("rejects other channels", func(t *testing.T) {
+		bob.send(t, "JOIN #other")
+		assert.Equal(t, ":budgetchat 403 bob #other :No such channel", bob.read(t))
+	})
+
+	t.Run("quit leaves the room", func(t *testing.T) {
+		bob.send(t, "QUIT :bye")
+		assert.Equal(t, ":budgetchat ERROR :Closing link: quit", bob.read(t))
+		alice.expect(t, "* bob has left the room")
+	})
+}
+
+func TestIRCListenerFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Could not listen")
+	defer taken.Close()
+
+	// Pick free addresses for the servers expected to be released
+	addrs := []string{}
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err, "Could not listen")
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+
+	_, err = chat.NewChatServer(chat.Options{
+		Addr:          addrs[0],
+		WebSocketAddr: addrs[1],
+		IRCAddr:       taken.Addr().String(),
+	})
+	require.Error(t, err, "IRC listener should fail on a taken address")
+
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if assert.NoError(t, err, "%s should be released", addr) {
+			l.Close()
+		}
+	}
+}
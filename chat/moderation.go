@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// restriction is a ban or a mute, a zero until means it never expires
+type restriction struct {
+	until time.Time
+}
+
+func newRestriction(d time.Duration) restriction {
+	if d <= 0 {
+		return restriction{}
+	}
+	return restriction{time.Now().Add(d)}
+}
+
+func (r restriction) active(now time.Time) bool {
+	return r.until.IsZero() || now.Before(r.until)
+}
+
+func (r restriction) String() string {
+	if r.until.IsZero() {
+		return "permanently"
+	}
+	return "until " + r.until.Format(time.DateTime)
+}
+
+// rateLimiter is a token bucket refilled at rate tokens per second
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func remoteIP(c *server.TCPClient) string {
+	addr := c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// isBanned reports if the username or ip is currently banned, expired bans
+// are dropped along the way
+func (chatServer *ChatServer) isBanned(target string) bool {
+	ban, ok := chatServer.bans[target]
+	if !ok {
+		return false
+	}
+	if !ban.active(time.Now()) {
+		delete(chatServer.bans, target)
+		return false
+	}
+	return true
+}
+
+func (chatServer *ChatServer) findSessions(target string) []*ChatSession {
+	sessions := []*ChatSession{}
+	isIP := net.ParseIP(target) != nil
+	for _, sess := range chatServer.sessions {
+		if isIP && remoteIP(sess.client) == target || sess.IsConnected() && sess.username == target {
+			sessions = append(sessions, sess)
+		}
+	}
+	return sessions
+}
+
+func parseDuration(args []string) (time.Duration, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	return time.ParseDuration(args[0])
+}
+
+// handleCommand runs the moderation command in line, if any, and reports if
+// the line was consumed. Must only be called from the chat server loop.
+func (chatServer *ChatServer) handleCommand(session *ChatSession, line string) bool {
+	if !strings.HasPrefix(line, "/") {
+		return false
+	}
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		return false
+	}
+	command, args := fields[0], fields[1:]
+
+	switch command {
+	case "oper", "kick", "ban", "unban", "mute", "unmute":
+	default:
+		return false
+	}
+
+	logger := log.With().
+		Str("service", "chat").
+		Uint("peer", session.client.Id).
+		Str("name", session.username).
+		Str("command", command).
+		Logger()
+
+	if command == "oper" {
+		if chatServer.options.OperatorPassword == "" || len(args) != 1 || args[0] != chatServer.options.OperatorPassword {
+			logger.Warn().Msg("Failed operator authentication")
+			session.writer.notice("Invalid operator password")
+			return true
+		}
+		session.operator = true
+		logger.Info().Msg("Client is now an operator")
+		session.writer.notice("You are now an operator")
+		return true
+	}
+
+	if !session.operator {
+		logger.Warn().Msg("Client is not allowed to run moderation commands")
+		session.writer.notice("Permission denied")
+		return true
+	}
+
+	if len(args) == 0 {
+		session.writer.notice(fmt.Sprintf("Usage: /%s <name|ip> [duration]", command))
+		return true
+	}
+	target := args[0]
+	duration, err := parseDuration(args[1:])
+	if err != nil {
+		session.writer.notice(fmt.Sprintf("Invalid duration: %s", args[1]))
+		return true
+	}
+
+	switch command {
+	case "kick":
+		sessions := chatServer.findSessions(target)
+		if len(sessions) == 0 {
+			session.writer.notice(fmt.Sprintf("No user matches %s", target))
+			return true
+		}
+		for _, sess := range sessions {
+			sess.writer.notice(fmt.Sprintf("You have been kicked by %s", session.username))
+			sess.client.Close()
+		}
+		logger.Info().Str("target", target).Msg("Kicked user")
+	case "ban":
+		ban := newRestriction(duration)
+		chatServer.bans[target] = ban
+		for _, sess := range chatServer.findSessions(target) {
+			sess.writer.notice(fmt.Sprintf("You have been banned by %s", session.username))
+			sess.client.Close()
+		}
+		logger.Info().Str("target", target).Time("until", ban.until).Msg("Banned user")
+		session.writer.notice(fmt.Sprintf("%s is banned %s", target, ban))
+	case "unban":
+		delete(chatServer.bans, target)
+		logger.Info().Str("target", target).Msg("Unbanned user")
+		session.writer.notice(fmt.Sprintf("%s is no longer banned", target))
+	case "mute":
+		sessions := chatServer.findSessions(target)
+		if len(sessions) == 0 {
+			session.writer.notice(fmt.Sprintf("No user matches %s", target))
+			return true
+		}
+		mute := newRestriction(duration)
+		for _, sess := range sessions {
+			sess.muted = &mute
+			sess.writer.notice(fmt.Sprintf("You have been muted %s", mute))
+		}
+		logger.Info().Str("target", target).Time("until", mute.until).Msg("Muted user")
+		session.writer.notice(fmt.Sprintf("%s is muted %s", target, mute))
+	case "unmute":
+		for _, sess := range chatServer.findSessions(target) {
+			sess.muted = nil
+			sess.writer.notice("You are no longer muted")
+		}
+		logger.Info().Str("target", target).Msg("Unmuted user")
+		session.writer.notice(fmt.Sprintf("%s is no longer muted", target))
+	}
+
+	return true
+}
@@ -0,0 +1,297 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const DEFAULT_TRANSCRIPT_MAX_BYTES = 10 * 1024 * 1024
+
+// TRANSCRIPT_QUEUE_SIZE is the number of records waiting to be written
+// before new ones are dropped
+const TRANSCRIPT_QUEUE_SIZE = 1024
+
+const (
+	TRANSCRIPT_JOIN    = "join"
+	TRANSCRIPT_LEAVE   = "leave"
+	TRANSCRIPT_MESSAGE = "message"
+)
+
+const transcriptPrefix = "transcript-"
+const transcriptSuffix = ".jsonl"
+
+// File names sort in the order they were created
+const transcriptTimeFormat = "20060102T150405.000000000"
+
+type TranscriptRecord struct {
+	Time  time.Time `json:"time"`
+	Room  string    `json:"room"`
+	Event string    `json:"event"`
+	User  string    `json:"user"`
+	Text  string    `json:"text,omitempty"`
+}
+
+// Transcript is a Hook appending every join, leave and message of the room
+// to JSONL files in a directory, starting a new file once the current one
+// reaches maxBytes. It should be the last hook so it only records what the
+// room actually saw. Records are written by a goroutine of their own so the
+// chat server loop never waits on the disk.
+type Transcript struct {
+	dir      string
+	maxBytes int64
+	records  chan TranscriptRecord
+	done     chan struct{}
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+func NewTranscript(dir string, maxBytes int64) (*Transcript, error) {
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_TRANSCRIPT_MAX_BYTES
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &Transcript{
+		dir:      dir,
+		maxBytes: maxBytes,
+		records:  make(chan TranscriptRecord, TRANSCRIPT_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	go t.writeRecords()
+	return t, nil
+}
+
+func (t *Transcript) writeRecords() {
+	defer close(t.done)
+	for record := range t.records {
+		if err := t.Write(record); err != nil {
+			log.Error().Err(err).Str("service", "chat").Msg("could not write transcript record")
+		}
+	}
+}
+
+func (t *Transcript) HandleEvent(room *Room, event Event) bool {
+	record := TranscriptRecord{Room: room.Name()}
+	switch e := event.(type) {
+	case *UserJoined:
+		record.Time, record.Event, record.User = e.Time, TRANSCRIPT_JOIN, e.Name
+	case *UserLeft:
+		record.Time, record.Event, record.User = e.Time, TRANSCRIPT_LEAVE, e.Name
+	case *MessagePosted:
+		record.Time, record.Event, record.User, record.Text = e.Time, TRANSCRIPT_MESSAGE, e.Name, e.Text
+	default:
+		return true
+	}
+
+	t.enqueue(record)
+	return true
+}
+
+// enqueue hands record to the writer goroutine, dropping it when the
+// transcript is closed or the disk can not keep up
+func (t *Transcript) enqueue(record TranscriptRecord) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.records <- record:
+	default:
+		log.Warn().Str("service", "chat").Msg("transcript is falling behind, dropped record")
+	}
+}
+
+// Write appends record to the transcript right away
+func (t *Transcript) Write(record TranscriptRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.file == nil || t.size+int64(len(data)) > t.maxBytes && t.size > 0 {
+		if err := t.rotate(record.Time); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.file.Write(data)
+	t.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (t *Transcript) rotate(now time.Time) error {
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			return err
+		}
+		t.file = nil
+	}
+	name := transcriptPrefix + now.UTC().Format(transcriptTimeFormat) + transcriptSuffix
+	file, err := os.OpenFile(filepath.Join(t.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+// Close writes the records still queued and closes the transcript file
+func (t *Transcript) Close() error {
+	t.lock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.records)
+	}
+	t.lock.Unlock()
+	<-t.done
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+type TranscriptQuery struct {
+	// User only matches records of this exact username when not empty
+	User string
+	// Since and Until bound the record times when not zero, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Text only matches messages containing it when not empty
+	Text string
+}
+
+func (q *TranscriptQuery) matches(record *TranscriptRecord) bool {
+	if q.User != "" && record.User != q.User {
+		return false
+	}
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !record.Time.Before(q.Until) {
+		return false
+	}
+	if q.Text != "" && (record.Event != TRANSCRIPT_MESSAGE || !strings.Contains(record.Text, q.Text)) {
+		return false
+	}
+	return true
+}
+
+// transcriptFiles lists the transcript files in dir with the time each of
+// them was started at, oldest first
+func transcriptFiles(dir string) ([]string, []time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, transcriptPrefix) && strings.HasSuffix(name, transcriptSuffix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	starts := make([]time.Time, len(names))
+	for i, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, transcriptPrefix), transcriptSuffix)
+		starts[i], _ = time.Parse(transcriptTimeFormat, stamp)
+	}
+	return names, starts, nil
+}
+
+// SearchTranscripts calls found for every record in the transcripts of dir
+// matching query, in the order they were written. Returning false from found
+// stops the search.
+func SearchTranscripts(dir string, query TranscriptQuery, found func(TranscriptRecord) bool) error {
+	names, starts, err := transcriptFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		// Files only hold records up to the start of the next one
+		if !query.Since.IsZero() && i+1 < len(names) && !starts[i+1].IsZero() && starts[i+1].Before(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && !starts[i].IsZero() && !starts[i].Before(query.Until) {
+			break
+		}
+
+		more, err := searchTranscript(filepath.Join(dir, name), &query, found)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func searchTranscript(path string, query *TranscriptQuery, found func(TranscriptRecord) bool) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record TranscriptRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				// A partially written last line is skipped
+				if !errors.Is(err, io.EOF) {
+					return false, fmt.Errorf("%s:%d: %w", path, lineNumber, jsonErr)
+				}
+			} else if query.matches(&record) && !found(record) {
+				return false, nil
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package chat_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/chat"
+)
+
+func search(t *testing.T, dir string, query chat.TranscriptQuery) []string {
+	found := []string{}
+	err := chat.SearchTranscripts(dir, query, func(record chat.TranscriptRecord) bool {
+		found = append(found, record.Event+" "+record.User+" "+record.Text)
+		return true
+	})
+	require.NoError(t, err, "Could not search transcripts")
+	return found
+}
+
+func TestTranscript(t *testing.T) {
+	dir := t.TempDir()
+	s, err := chat.NewChatServer(chat.Options{
+		Addr:               "127.0.0.1:0",
+		Room:               "#test",
+		TranscriptDir:      dir,
+		TranscriptMaxBytes: 200,
+	})
+	require.NoError(t, err, "Could not create chat server")
+	go s.Start()
+	defer s.Stop()
+	addr := s.(*chat.ChatServer).Addr()
+
+	start := time.Now()
+	alice := join(t, addr, "alice")
+	defer alice.conn.Close()
+	bob := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+	bob.send(t, "hello alice")
+	alice.expect(t, "[bob] hello alice")
+	alice.send(t, "hello bob")
+	bob.expect(t, "[alice] hello bob")
+	bob.conn.Close()
+	alice.expect(t, "* bob has left the room")
+
+	require.Eventually(t, func() bool {
+		return len(search(t, dir, chat.TranscriptQuery{})) == 5
+	}, time.Second, time.Millisecond*10, "Transcript should contain every event")
+
+	t.Run("rotates files", func(t *testing.T) {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Greater(t, len(entries), 1, "Transcript should have been rotated")
+	})
+
+	t.Run("searches by user", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"join bob ",
+			"message bob hello alice",
+			"leave bob ",
+		}, search(t, dir, chat.TranscriptQuery{User: "bob"}))
+	})
+
+	t.Run("searches by text", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"message bob hello alice",
+			"message alice hello bob",
+		}, search(t, dir, chat.TranscriptQuery{Text: "hello"}))
+	})
+
+	t.Run("searches by time", func(t *testing.T) {
+		assert.Empty(t, search(t, dir, chat.TranscriptQuery{Until: start}))
+		assert.Len(t, search(t, dir, chat.TranscriptQuery{Since: start, Until: time.Now()}), 5)
+	})
+}
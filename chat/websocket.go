@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// Largest WebSocket message accepted from a browser, lines longer than
+// MaxLineLength are still rejected by HandleClient
+const MAX_WEBSOCKET_MESSAGE = 64 * 1024
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+)
+
+// WebSocket ids are kept apart from the ids handed out by the TCP server
+const websocketIdOffset uint = 1 << 20
+
+//go:embed static
+var staticFiles embed.FS
+
+var errWebSocketProtocol = errors.New("websocket protocol error")
+
+func (chatServer *ChatServer) startWebSocket() error {
+	listener, err := net.Listen("tcp", chatServer.options.WebSocketAddr)
+	if err != nil {
+		return err
+	}
+
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	chatServer.wsListener = listener
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /ws", chatServer.handleWebSocket)
+	chatServer.wsServer = &http.Server{Handler: mux}
+	return nil
+}
+
+func (chatServer *ChatServer) serveWebSocket() {
+	log.Info().Msgf("websocket gateway started on %s", chatServer.wsListener.Addr())
+	err := chatServer.wsServer.Serve(chatServer.wsListener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error().Err(err).Msg("websocket gateway stopped")
+	}
+}
+
+func (chatServer *ChatServer) WebSocketAddr() net.Addr {
+	if chatServer.wsListener == nil {
+		return nil
+	}
+	return chatServer.wsListener.Addr()
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name string, value string) bool {
+	for _, v := range h.Values(name) {
+		for token := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket upgrades the request and runs the connection through the
+// same HandleClient as the TCP sessions
+func (chatServer *ChatServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Error().Err(err).Msg("could not hijack websocket connection")
+		return
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	id := websocketIdOffset + uint(chatServer.nextWebSocketId.Add(1))
+	c := &server.TCPClient{
+		Conn:   newWebSocketConn(conn, rw.Reader),
+		Id:     id,
+		Logger: log.With().Uint("peer", id).Str("transport", "websocket").Logger(),
+	}
+	defer c.Close()
+
+	c.Logger.Info().Str("remote_addr", conn.RemoteAddr().String()).Msg("connected")
+	err = chatServer.HandleClient(c)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+			c.Logger.Info().Msg("client closed the connection")
+		} else {
+			c.Logger.Err(err).Msg("client did not handle ok")
+		}
+	} else {
+		c.Logger.Info().Msg("client done")
+	}
+}
+
+// webSocketConn exposes a WebSocket as a line based net.Conn. Every text
+// message read is terminated with a newline and every line written is sent
+// as its own text message.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	pending []byte
+	message []byte
+
+	writeLock sync.Mutex
+	lineBuf   []byte
+	closed    bool
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader) *webSocketConn {
+	return &webSocketConn{Conn: conn, reader: reader}
+}
+
+func (ws *webSocketConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		if err := ws.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a full data message is available
+func (ws *webSocketConn) readMessage() error {
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, payload)
+			return io.EOF
+		case wsOpText, wsOpBinary:
+			if ws.message != nil {
+				return errWebSocketProtocol
+			}
+			ws.message = payload
+		case wsOpContinuation:
+			if ws.message == nil {
+				return errWebSocketProtocol
+			}
+			ws.message = append(ws.message, payload...)
+		default:
+			return errWebSocketProtocol
+		}
+
+		if len(ws.message) > MAX_WEBSOCKET_MESSAGE {
+			ws.closeWith(1009)
+			return errWebSocketProtocol
+		}
+		if !fin {
+			continue
+		}
+
+		ws.pending = ws.message
+		if !bytes.HasSuffix(ws.pending, []byte{'\n'}) {
+			ws.pending = append(ws.pending, '\n')
+		}
+		ws.message = nil
+		return nil
+	}
+}
+
+func (ws *webSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var l uint16
+		if err = binary.Read(ws.reader, binary.BigEndian, &l); err != nil {
+			return
+		}
+		length = uint64(l)
+	case 127:
+		if err = binary.Read(ws.reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+	}
+
+	// Clients must mask their frames
+	if !masked || length > MAX_WEBSOCKET_MESSAGE {
+		ws.closeWith(1002)
+		err = errWebSocketProtocol
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (ws *webSocketConn) Write(p []byte) (int, error) {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	ws.lineBuf = append(ws.lineBuf, p...)
+	for {
+		i := bytes.IndexByte(ws.lineBuf, '\n')
+		if i == -1 {
+			break
+		}
+		line := bytes.TrimRight(ws.lineBuf[:i], "\r")
+		if err := ws.writeFrameLocked(wsOpText, line); err != nil {
+			return 0, err
+		}
+		ws.lineBuf = ws.lineBuf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	return ws.writeFrameLocked(opcode, payload)
+}
+
+func (ws *webSocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+	if ws.closed {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := ws.Conn.Write(frame)
+	if opcode == wsOpClose {
+		ws.closed = true
+	}
+	return err
+}
+
+func (ws *webSocketConn) closeWith(code uint16) {
+	ws.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Close sends a normal closure frame before closing the connection
+func (ws *webSocketConn) Close() error {
+	ws.closeWith(1000)
+	return ws.Conn.Close()
+}
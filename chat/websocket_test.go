@@ -0,0 +1,107 @@
+package chat_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/chat"
+)
+
+type wsClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, addr net.Addr) *wsClient {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err, "Could not connect to websocket gateway")
+
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\n" +
+		"Host: " + addr.String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	require.NoError(t, err, "Could not send websocket handshake")
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err, "Could not read websocket handshake")
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+
+	return &wsClient{conn, reader}
+}
+
+func (c *wsClient) send(t *testing.T, text string) {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(text))}
+	frame = append(frame, mask[:]...)
+	for i := range len(text) {
+		frame = append(frame, text[i]^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	require.NoError(t, err, "Could not write websocket frame")
+}
+
+func (c *wsClient) read(t *testing.T) string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	require.NoError(t, err, "Could not read websocket frame")
+	require.Equal(t, byte(0x81), header[0], "Expected a final text frame")
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var l uint16
+		require.NoError(t, binary.Read(c.reader, binary.BigEndian, &l))
+		length = int(l)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	require.NoError(t, err, "Could not read websocket payload")
+	return string(payload)
+}
+
+func TestWebSocketGateway(t *testing.T) {
+	s, err := chat.NewChatServer(chat.Options{
+		Addr:          "127.0.0.1:0",
+		WebSocketAddr: "127.0.0.1:0",
+	})
+	require.NoError(t, err, "Could not create chat server")
+	go s.Start()
+	defer s.Stop()
+	cs := s.(*chat.ChatServer)
+
+	t.Run("serves the web client", func(t *testing.T) {
+		res, err := http.Get("http://" + cs.WebSocketAddr().String() + "/")
+		require.NoError(t, err, "Could not fetch web client")
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, res.Header.Get("Content-Type"), "text/html")
+	})
+
+	t.Run("bridges websocket and tcp clients", func(t *testing.T) {
+		alice := join(t, cs.Addr(), "alice")
+		defer alice.conn.Close()
+
+		bob := dialWebSocket(t, cs.WebSocketAddr())
+		defer bob.conn.Close()
+		assert.Equal(t, "Please enter your username...", bob.read(t))
+		bob.send(t, "bob")
+		assert.Equal(t, "* The room contains: alice", bob.read(t))
+		alice.expect(t, "* bob has entered the room")
+
+		bob.send(t, "hi alice")
+		alice.expect(t, "[bob] hi alice")
+
+		alice.send(t, "hi bob")
+		assert.Equal(t, "[alice] hi bob", bob.read(t))
+	})
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+type Access int
+
+const (
+	ACCESS_NONE Access = iota
+	ACCESS_READ
+	ACCESS_READ_WRITE
+)
+
+func (a Access) String() string {
+	switch a {
+	case ACCESS_READ:
+		return "ro"
+	case ACCESS_READ_WRITE:
+		return "rw"
+	}
+	return "none"
+}
+
+type DeletePolicy int
+
+const (
+	// DELETE_ALLOW lets the "delete" request wipe the whole database
+	DELETE_ALLOW DeletePolicy = iota
+	// DELETE_NAMESPACE only wipes the namespaces the client has access to
+	DELETE_NAMESPACE
+	// DELETE_DENY ignores the "delete" request
+	DELETE_DENY
+)
+
+func ParseDeletePolicy(s string) (DeletePolicy, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return DELETE_ALLOW, nil
+	case "namespace":
+		return DELETE_NAMESPACE, nil
+	case "deny":
+		return DELETE_DENY, nil
+	}
+	return DELETE_ALLOW, fmt.Errorf("unknown delete policy: %s", s)
+}
+
+const DEFAULT_NAMESPACE_SEPARATOR = "/"
+
+// AccessRule grants access to the clients of Network. Namespaces are key
+// prefixes ending with the namespace separator.
+type AccessRule struct {
+	Network *net.IPNet
+	Access  Access
+	// Namespace puts every key of the client in the namespace, the client
+	// does not see the prefix
+	Namespace string
+	// Namespaces restricts a client without Namespace to keys in these
+	// namespaces when not empty
+	Namespaces []string
+	Delete     DeletePolicy
+}
+
+// clientAccess is what a client may do, resolved once per client
+type clientAccess struct {
+	access    Access
+	delete    DeletePolicy
+	separator string
+	// prefix is added to every key, for clients with a fixed namespace
+	prefix string
+	// namespaces the client is restricted to, none means all
+	namespaces []string
+}
+
+func resolveAccess(options *Options, addr net.Addr) *clientAccess {
+	separator := options.NamespaceSeparator
+	if separator == "" {
+		separator = DEFAULT_NAMESPACE_SEPARATOR
+	}
+	if len(options.Rules) == 0 {
+		return &clientAccess{access: ACCESS_READ_WRITE, delete: options.Delete, separator: separator}
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	for _, rule := range options.Rules {
+		if ip == nil || !rule.Network.Contains(ip) {
+			continue
+		}
+		a := &clientAccess{
+			access:     rule.Access,
+			delete:     rule.Delete,
+			separator:  separator,
+			namespaces: rule.Namespaces,
+		}
+		if rule.Namespace != "" {
+			a.prefix = rule.Namespace + separator
+			a.namespaces = nil
+		}
+		return a
+	}
+	return &clientAccess{access: ACCESS_NONE, delete: DELETE_DENY, separator: separator}
+}
+
+func (a *clientAccess) canRead() bool {
+	return a.access >= ACCESS_READ
+}
+
+func (a *clientAccess) canWrite() bool {
+	return a.access >= ACCESS_READ_WRITE
+}
+
+// canReplicate reports if the client may read every key, as replicas do
+func (a *clientAccess) canReplicate() bool {
+	return a.canRead() && a.prefix == "" && len(a.namespaces) == 0
+}
+
+// key maps the key sent by the client to the stored key, ok is false when
+// the key is outside of the client namespaces
+func (a *clientAccess) key(key string) (string, bool) {
+	if a.prefix != "" {
+		return a.prefix + key, true
+	}
+	if len(a.namespaces) == 0 {
+		return key, true
+	}
+	namespace, _, found := strings.Cut(key, a.separator)
+	return key, found && slices.Contains(a.namespaces, namespace)
+}
+
+// deletePrefixes are the key prefixes wiped by a "delete" request, a single
+// empty prefix wipes everything and ok is false when delete is not allowed
+func (a *clientAccess) deletePrefixes() (prefixes []string, ok bool) {
+	if !a.canWrite() {
+		return nil, false
+	}
+	switch a.delete {
+	case DELETE_ALLOW:
+		if a.prefix != "" {
+			return []string{a.prefix}, true
+		}
+		if len(a.namespaces) > 0 {
+			break
+		}
+		return []string{""}, true
+	case DELETE_DENY:
+		return nil, false
+	}
+
+	if a.prefix != "" {
+		return []string{a.prefix}, true
+	}
+	for _, namespace := range a.namespaces {
+		prefixes = append(prefixes, namespace+a.separator)
+	}
+	return prefixes, len(prefixes) > 0
+}
+
+// ParseAccessRules parses rules separated by ";", each being a CIDR and an
+// access of "ro", "rw" or "none" followed by optional settings, all comma
+// separated:
+//
+//	127.0.0.0/8,rw;10.0.0.0/8,rw,namespace=team,delete=namespace;0.0.0.0/0,ro,namespaces=public|shared
+func ParseAccessRules(s string) ([]AccessRule, error) {
+	rules := []AccessRule{}
+	for text := range strings.SplitSeq(s, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("rule `%s` needs a network and an access", text)
+		}
+
+		var rule AccessRule
+		var err error
+		if _, rule.Network, err = net.ParseCIDR(strings.TrimSpace(fields[0])); err != nil {
+			return nil, err
+		}
+		switch strings.TrimSpace(fields[1]) {
+		case "ro":
+			rule.Access = ACCESS_READ
+		case "rw":
+			rule.Access = ACCESS_READ_WRITE
+		case "none":
+			rule.Access = ACCESS_NONE
+		default:
+			return nil, fmt.Errorf("rule `%s` has an unknown access `%s`", text, fields[1])
+		}
+
+		for _, setting := range fields[2:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+			switch name {
+			case "namespace":
+				rule.Namespace = value
+			case "namespaces":
+				rule.Namespaces = strings.Split(value, "|")
+			case "delete":
+				if rule.Delete, err = ParseDeletePolicy(value); err != nil {
+					return nil, fmt.Errorf("rule `%s`: %w", text, err)
+				}
+			default:
+				return nil, fmt.Errorf("rule `%s` has an unknown setting `%s`", text, name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const DEFAULT_CLIENT_TIMEOUT = time.Second
+const CLIENT_RETRIES = 3
+
+// Client speaks the extended protocol to a db server. Requests are sent
+// again when no response comes in time, so they must be idempotent.
+type Client struct {
+	conn    net.Conn
+	Timeout time.Duration
+	buf     []byte
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, Timeout: DEFAULT_CLIENT_TIMEOUT, buf: make([]byte, server.MAX_DATAGRAM_PACKET)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// roundTrip sends request until a response matching accept comes back
+func (c *Client) roundTrip(request []byte, accept func(response []byte) bool) ([]byte, error) {
+	if len(request) > server.MAX_DATAGRAM_SIZE {
+		return nil, errors.New("request too large")
+	}
+	for range CLIENT_RETRIES {
+		if _, err := c.conn.Write(request); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(c.Timeout)
+		for {
+			c.conn.SetReadDeadline(deadline)
+			n, err := c.conn.Read(c.buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, err
+			}
+			// Late responses to an earlier attempt are skipped
+			if accept(c.buf[:n]) {
+				return c.buf[:n], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response after %d attempts", CLIENT_RETRIES)
+}
+
+// request sends an extended request and returns the header and fields of
+// the response, error responses are returned as errors
+func (c *Client) request(command string, fields ...string) (string, []string, error) {
+	var header string
+	var responseFields []string
+	var responseErr error
+	_, err := c.roundTrip(extendedRequest(command, fields...), func(response []byte) bool {
+		responseCommand, h, f, err := parseExtendedResponse(response)
+		if err != nil {
+			return false
+		}
+		switch responseCommand {
+		case command:
+			header, responseFields = h, f
+			return true
+		case COMMAND_ERROR:
+			responseErr = fmt.Errorf("%s: %s", command, h)
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return header, responseFields, responseErr
+}
+
+// Get reads key with a single key request
+func (c *Client) Get(key string) (string, error) {
+	if key == "" || strings.ContainsRune(key, '=') || key[0] == EXTENDED_PREFIX {
+		return "", fmt.Errorf("key `%s` can not be read with a single key request", sanitize(key))
+	}
+	response, err := c.roundTrip([]byte(key), func(response []byte) bool {
+		return strings.HasPrefix(string(response), key+"=")
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(response[len(key)+1:]), nil
+}
+
+// MGet reads keys, values too large for a mget response are read one by one
+func (c *Client) MGet(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for len(keys) > 0 {
+		header, fields, err := c.request(COMMAND_MGET, keys...)
+		if err != nil {
+			return nil, err
+		}
+		answered, _, _ := strings.Cut(header, "/")
+		n, err := strconv.Atoi(answered)
+		if err != nil || len(fields) != 2*n || n > len(keys) {
+			return nil, fmt.Errorf("mget: invalid response `%s`", header)
+		}
+		for i := 0; i < len(fields); i += 2 {
+			values[fields[i]] = fields[i+1]
+		}
+		if n == 0 {
+			if values[keys[0]], err = c.Get(keys[0]); err != nil {
+				return nil, err
+			}
+			n = 1
+		}
+		keys = keys[n:]
+	}
+	return values, nil
+}
+
+// MSet writes the key and value pairs at once and returns how many were
+// stored
+func (c *Client) MSet(pairs ...string) (int, error) {
+	header, _, err := c.request(COMMAND_MSET, pairs...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(header)
+}
+
+// dumpEntry is a key of a dump, expires is zero when it never expires
+type dumpEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// export reads the entries of keys, unset keys are left out
+func (c *Client) export(keys []string) ([]dumpEntry, error) {
+	entries := []dumpEntry{}
+	for len(keys) > 0 {
+		header, fields, err := c.request(COMMAND_EXPORT, keys...)
+		if err != nil {
+			return nil, err
+		}
+		answered, _, _ := strings.Cut(header, "/")
+		n, err := strconv.Atoi(answered)
+		if err != nil || len(fields)%3 != 0 || len(fields) > 3*n || n > len(keys) {
+			return nil, fmt.Errorf("export: invalid response `%s`", header)
+		}
+		for i := 0; i < len(fields); i += 3 {
+			expires, err := parseExpiry(fields[i+2])
+			if err != nil {
+				return nil, fmt.Errorf("export: invalid expiry of `%s`", sanitize(fields[i]))
+			}
+			entries = append(entries, dumpEntry{fields[i], fields[i+1], expires})
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("export: `%s` is too large to be exported", sanitize(keys[0]))
+		}
+		keys = keys[n:]
+	}
+	return entries, nil
+}
+
+// importEntries writes the entries at once and returns how many were
+// stored, the ones already expired are not
+func (c *Client) importEntries(entries []dumpEntry) (int, error) {
+	fields := make([]string, 0, 3*len(entries))
+	for _, e := range entries {
+		fields = append(fields, e.key, e.value, formatExpiry(e.expires))
+	}
+	header, _, err := c.request(COMMAND_IMPORT, fields...)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(header)
+}
+
+// Keys lists a page of the keys starting with prefix after the cursor key,
+// more is set when there are keys left
+func (c *Client) Keys(prefix string, cursor string, limit int) (keys []string, more bool, err error) {
+	header, fields, err := c.request(COMMAND_KEYS, prefix, cursor, strconv.Itoa(limit))
+	if err != nil {
+		return nil, false, err
+	}
+	return fields, header == "1", nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+type entry struct {
+	value string
+	// expires is zero for keys that never expire
+	expires time.Time
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// Stale keys the sorted index of a mapStore tolerates beyond its size before
+// being rebuilt without a listing
+const INDEX_SLACK = 1024
+
+// mapStore is a Store that is not safe for concurrent use, it is owned by
+// the startServer goroutine
+type mapStore struct {
+	data map[string]entry
+	// expiring indexes the keys having an expiry, for the sweep
+	expiring map[string]struct{}
+	// sorted holds the keys in order for listings. Keys created since are in
+	// added until the next listing sorts them in, and removed keys are only
+	// dropped then, removed counts them.
+	sorted  []string
+	added   []string
+	removed int
+}
+
+func NewMapStore() Store {
+	return newMapStore()
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{
+		data:     make(map[string]entry),
+		expiring: make(map[string]struct{}),
+	}
+}
+
+func (db *mapStore) Concurrent() bool {
+	return false
+}
+
+func (db *mapStore) Set(key string, value string, expires time.Time) {
+	if _, ok := db.data[key]; !ok {
+		db.added = append(db.added, key)
+		db.compactIndex()
+	}
+	db.data[key] = entry{value, expires}
+	if expires.IsZero() {
+		delete(db.expiring, key)
+	} else {
+		db.expiring[key] = struct{}{}
+	}
+}
+
+func (db *mapStore) Get(key string, now time.Time) (string, bool) {
+	value, _, ok := db.Lookup(key, now)
+	return value, ok
+}
+
+// Lookup removes the expired keys it reads
+func (db *mapStore) Lookup(key string, now time.Time) (string, time.Time, bool) {
+	e, ok := db.data[key]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	if e.expired(now) {
+		db.Remove(key)
+		return "", time.Time{}, false
+	}
+	return e.value, e.expires, true
+}
+
+func (db *mapStore) Remove(key string) {
+	if _, ok := db.data[key]; !ok {
+		return
+	}
+	delete(db.data, key)
+	delete(db.expiring, key)
+	db.removed++
+	db.compactIndex()
+}
+
+func (db *mapStore) ClearPrefix(prefix string) {
+	if prefix == "" {
+		clear(db.data)
+		clear(db.expiring)
+		db.sorted, db.added, db.removed = nil, nil, 0
+		return
+	}
+	for key := range db.data {
+		if strings.HasPrefix(key, prefix) {
+			db.Remove(key)
+		}
+	}
+}
+
+func (db *mapStore) Len() int {
+	return len(db.data)
+}
+
+func (db *mapStore) Sweep(now time.Time) int {
+	removed := 0
+	for key := range db.expiring {
+		e := db.data[key]
+		if e.expired(now) {
+			db.Remove(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (db *mapStore) Range(now time.Time, yield func(key string, value string, expires time.Time) bool) {
+	for key, e := range db.data {
+		if e.expired(now) {
+			continue
+		}
+		if !yield(key, e.value, e.expires) {
+			return
+		}
+	}
+}
+
+func (db *mapStore) Keys(prefix string, after string, limit int, now time.Time) []string {
+	db.sortIndex()
+	start, _ := slices.BinarySearch(db.sorted, prefix)
+	if i, found := slices.BinarySearch(db.sorted, after); found {
+		start = max(start, i+1)
+	} else {
+		start = max(start, i)
+	}
+
+	keys := []string{}
+	for _, key := range db.sorted[start:] {
+		if len(keys) >= limit || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if e := db.data[key]; !e.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sortIndex merges the keys added into the sorted ones, dropping the keys
+// removed
+func (db *mapStore) sortIndex() {
+	if len(db.added) == 0 && db.removed == 0 {
+		return
+	}
+	slices.Sort(db.added)
+	sorted := make([]string, 0, len(db.data))
+	i, j := 0, 0
+	for i < len(db.sorted) || j < len(db.added) {
+		var key string
+		if j == len(db.added) || (i < len(db.sorted) && db.sorted[i] <= db.added[j]) {
+			key = db.sorted[i]
+			i++
+		} else {
+			key = db.added[j]
+			j++
+		}
+		// Keys removed then created again are in both
+		if len(sorted) > 0 && sorted[len(sorted)-1] == key {
+			continue
+		}
+		if _, ok := db.data[key]; ok {
+			sorted = append(sorted, key)
+		}
+	}
+	db.sorted, db.added, db.removed = sorted, nil, 0
+}
+
+// compactIndex sorts the index once it holds more stale keys than live ones,
+// so it does not grow without listings
+func (db *mapStore) compactIndex() {
+	if len(db.added)+db.removed > len(db.data)+INDEX_SLACK {
+		db.sortIndex()
+	}
+}
@@ -2,8 +2,12 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"net"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -12,31 +16,311 @@ import (
 
 const VERSION = "alpha"
 
+const DEFAULT_SWEEP_INTERVAL = time.Second
+
 type WriteEvent struct {
 	key   string
 	value string
+	// expires is zero for keys that never expire
+	expires time.Time
 }
 type ReadEvent struct {
 	key string
-	out chan string
+	out chan readValue
+}
+
+// UpdateEvent atomically replaces the value of key with what update returns
+// for the current one, which is empty for unset keys. The expiry of key is
+// kept when keepExpiry is set and replaced by expires otherwise. out gets the
+// resulting value.
+type UpdateEvent struct {
+	key        string
+	update     func(current string) (value string, changed bool, err error)
+	expires    time.Time
+	keepExpiry bool
+	out        chan updateResult
+}
+
+type updateResult struct {
+	value   string
+	changed bool
+	err     error
+}
+
+// ListEvent lists the keys starting with prefix that sort after after, out
+// gets at most limit of them in order
+type ListEvent struct {
+	prefix string
+	after  string
+	limit  int
+	out    chan []string
+}
+
+// StatsEvent counts the keys starting with prefix and their total size in
+// bytes, keys and values included
+type StatsEvent struct {
+	prefix string
+	out    chan storeStats
+}
+
+type storeStats struct {
+	keys  int
+	bytes int
+}
+
+// BatchWriteEvent applies every write at once
+type BatchWriteEvent struct {
+	writes []WriteEvent
+}
+
+// BatchReadEvent reads every key at once, out gets the values in order
+type BatchReadEvent struct {
+	keys []string
+	out  chan []readValue
+}
+
+// readValue is the value of a key read, ok is false when the key is unset.
+// expires is zero for keys that never expire.
+type readValue struct {
+	value   string
+	expires time.Time
+	ok      bool
+}
+
+// BarrierEvent is answered once every event sent before it was applied
+type BarrierEvent struct {
+	done chan struct{}
+}
+type DeleteEvent struct {
+	// prefixes are the key prefixes to remove, an empty prefix removes every
+	// key
+	prefixes []string
 }
-type DeleteEvent struct{}
 type StopEvent struct{}
 
-func NewDbServer() (s server.Server, err error) {
-	ch := make(chan any, 128)
+type Options struct {
+	// Addr is the address the database listens on, defaults to ":8000"
+	Addr string
+	// DataDir enables persistence to the given directory when not empty,
+	// otherwise everything is kept in memory
+	DataDir string
+	// Fsync controls when the log is synced to disk, FsyncInterval defaults
+	// to DEFAULT_FSYNC_INTERVAL
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// SnapshotEvery is the number of log records after which the log is
+	// compacted into a snapshot, defaults to DEFAULT_SNAPSHOT_EVERY
+	SnapshotEvery int
+	// SnapshotInterval also compacts the log periodically when not zero
+	SnapshotInterval time.Duration
+	// TTLSuffix enables expiring keys when not empty: an insert whose value
+	// ends with the suffix followed by a duration, `key=value;ttl=30` for a
+	// ";ttl=" suffix, stores value for that long. Durations without a unit
+	// are seconds.
+	TTLSuffix string
+	// SweepInterval is how often expired keys are removed, defaults to
+	// DEFAULT_SWEEP_INTERVAL. Expired keys always read as unset.
+	SweepInterval time.Duration
+	// Rules are checked in order against the client address, the first
+	// matching one applies. Clients matching no rule are denied, everyone
+	// can read and write when there are no rules.
+	Rules []AccessRule
+	// NamespaceSeparator ends the namespace of a key, defaults to
+	// DEFAULT_NAMESPACE_SEPARATOR
+	NamespaceSeparator string
+	// Delete is the policy of the "delete" request when there are no Rules
+	Delete DeletePolicy
+	// ReplicationAddr makes the server a primary streaming its writes to the
+	// replicas connecting to this TCP address when not empty. Replicas are
+	// checked against the Rules like clients and must be able to read every
+	// key, the address should still not be exposed beyond them as the link
+	// is neither authenticated nor encrypted.
+	ReplicationAddr string
+	// ReplicationBacklog is the number of records kept for replicas catching
+	// up after a reconnect, defaults to DEFAULT_REPLICATION_BACKLOG
+	ReplicationBacklog int
+	// PrimaryAddr makes the server a read only replica of the primary having
+	// this ReplicationAddr when not empty
+	PrimaryAddr string
+	// WatchTTL is how long a watch lasts unless it is renewed, defaults to
+	// DEFAULT_WATCH_TTL
+	WatchTTL time.Duration
+	// MaxWatches is the number of keys and prefixes a client may watch,
+	// defaults to DEFAULT_MAX_WATCHES
+	MaxWatches int
+	// Shards keeps the keys in a sharded store that clients read directly
+	// when not zero, otherwise every read goes through the database goroutine
+	Shards int
+}
 
-	s, err = server.NewBaseUDPServer(func(c *server.UDPClient) error {
-		return handleClient(c, ch)
-	}, time.Second)
+type DbServer struct {
+	udp    *server.UDPServer
+	events chan any
+	done   chan struct{}
+	// store is set when it can be read without going through events
+	store Store
+
+	// Set on primaries
+	replication *server.TCPServer
+
+	// Set on replicas
+	stopping    chan struct{}
+	replicaDone chan struct{}
+	primaryLock sync.Mutex
+	primaryConn net.Conn
+
+	stopOnce sync.Once
+	stopErr  error
+}
+
+func NewDbServer(options ...Options) (s server.Server, err error) {
+	var opts Options
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = DEFAULT_FSYNC_INTERVAL
+	}
+	if opts.SnapshotEvery <= 0 {
+		opts.SnapshotEvery = DEFAULT_SNAPSHOT_EVERY
+	}
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = DEFAULT_SWEEP_INTERVAL
+	}
+	if opts.WatchTTL <= 0 {
+		opts.WatchTTL = DEFAULT_WATCH_TTL
+	}
+	if opts.MaxWatches <= 0 {
+		opts.MaxWatches = DEFAULT_MAX_WATCHES
+	}
+	if opts.ReplicationBacklog <= 0 {
+		opts.ReplicationBacklog = DEFAULT_REPLICATION_BACKLOG
+	}
+	if opts.ReplicationAddr != "" && opts.PrimaryAddr != "" {
+		return nil, errors.New("a replica can not accept replicas")
+	}
+
+	var data Store
+	if opts.Shards > 0 {
+		data = NewShardedStore(opts.Shards)
+	} else {
+		data = NewMapStore()
+	}
+	var p *persistence
+	if opts.DataDir != "" {
+		if p, err = openPersistence(opts, data); err != nil {
+			return
+		}
+		// Writes of a server that is not a replica diverge from the primary
+		if opts.PrimaryAddr == "" && p.runId != "" {
+			if err = p.saveRunId(""); err != nil {
+				p.close()
+				return nil, err
+			}
+		}
+	}
+
+	db := &DbServer{
+		events: make(chan any, 128),
+		done:   make(chan struct{}),
+	}
+	if data.Concurrent() {
+		db.store = data
+	}
+	db.udp, err = server.NewBaseUDPServer(func(c *server.UDPClient) error {
+		return handleClient(c, db.events, db.store, opts)
+	}, time.Second, opts.Addr)
 
 	if err != nil {
+		if p != nil {
+			p.close()
+		}
 		return
 	}
 
-	go startServer(ch)
+	var primary *primary
+	if opts.ReplicationAddr != "" {
+		handleReplica := func(c *server.TCPClient) error {
+			return db.handleReplica(c, &opts)
+		}
+		if db.replication, err = server.NewTCPServer(handleReplica, opts.ReplicationAddr); err != nil {
+			db.udp.Stop()
+			if p != nil {
+				p.close()
+			}
+			return
+		}
+		primary = newPrimary(opts.ReplicationBacklog)
+	}
+
+	watches := newWatchList(opts.WatchTTL, opts.MaxWatches)
+
+	go func() {
+		defer close(db.done)
+		startServer(db.events, data, p, primary, watches, opts)
+	}()
+
+	if opts.PrimaryAddr != "" {
+		var runId string
+		var lsn uint64
+		if p != nil {
+			runId, lsn = p.runId, p.lsn
+		}
+		db.stopping = make(chan struct{})
+		db.replicaDone = make(chan struct{})
+		go db.replicate(opts.PrimaryAddr, runId, lsn)
+	}
+
+	return db, nil
+}
+
+func (db *DbServer) Start() {
+	if db.replication != nil {
+		go db.replication.Start()
+	}
+	db.udp.Start()
+}
+
+// Stop closes the sockets and waits for the database to be flushed, later
+// calls return the error of the first one
+func (db *DbServer) Stop() error {
+	db.stopOnce.Do(func() {
+		db.stopErr = db.udp.Stop()
+		if db.replication != nil {
+			db.replication.Stop()
+		}
+		if db.stopping != nil {
+			db.stopReplica()
+		}
+		db.events <- StopEvent{}
+		<-db.done
+	})
+	return db.stopErr
+}
+
+// Get reads key the way clients do
+func (db *DbServer) Get(key string) string {
+	return read(db.events, db.store, key)[0].value
+}
 
-	return
+// Set writes key, without going through the access rules, and waits for it
+// to be applied
+func (db *DbServer) Set(key string, value string) {
+	db.events <- WriteEvent{key: key, value: value}
+	barrier(db.events)
+}
+
+func (db *DbServer) Addr() net.Addr {
+	return db.udp.Addr()
+}
+
+// ReplicationAddr is the address replicas connect to, nil when the server
+// does not accept replicas
+func (db *DbServer) ReplicationAddr() net.Addr {
+	if db.replication == nil {
+		return nil
+	}
+	return db.replication.Listener.Addr()
 }
 
 func endsWithCRLF(s []byte) bool {
@@ -51,7 +335,130 @@ func sanitize(s string) string {
 	return s
 }
 
-func handleClient(c *server.UDPClient, ch chan any) error {
+// parseTTL splits the TTL from value, ok is false when value has none
+func parseTTL(value string, suffix string) (string, time.Duration, bool) {
+	if suffix == "" {
+		return value, 0, false
+	}
+	i := strings.LastIndex(value, suffix)
+	if i == -1 {
+		return value, 0, false
+	}
+	ttl := value[i+len(suffix):]
+	if seconds, err := strconv.ParseUint(ttl, 10, 32); err == nil {
+		return value[:i], time.Duration(seconds) * time.Second, true
+	}
+	if d, err := time.ParseDuration(ttl); err == nil && d > 0 {
+		return value[:i], d, true
+	}
+	return value, 0, false
+}
+
+// dbClient is a client along with what it may do, shared by the single key
+// and the extended requests
+type dbClient struct {
+	*server.UDPClient
+	events  chan any
+	store   Store
+	access  *clientAccess
+	options *Options
+	// pending is set while writes sent by the client may not be applied yet
+	pending bool
+}
+
+// send queues a write of the client
+func (c *dbClient) send(event any) {
+	c.events <- event
+	c.pending = true
+}
+
+// read gets the values of the stored keys, after the pending writes of the
+// client so it reads its own writes
+func (c *dbClient) read(keys ...string) []readValue {
+	if c.store != nil && c.pending {
+		barrier(c.events)
+	}
+	c.pending = false
+	return read(c.events, c.store, keys...)
+}
+
+// writableKey maps key to the stored key, ok is false when the client may
+// not write it
+func (c *dbClient) writableKey(key string) (string, bool) {
+	if c.options.PrimaryAddr != "" {
+		c.Logger.Warn().Msgf("denied write of `%s` on a replica", key)
+		return "", false
+	}
+	if !c.access.canWrite() {
+		c.Logger.Warn().Msgf("denied write of `%s` to a read only client", key)
+		return "", false
+	}
+	storedKey, ok := c.access.key(key)
+	if !ok {
+		c.Logger.Warn().Msgf("denied write of `%s` outside of the client namespaces", key)
+	}
+	return storedKey, ok
+}
+
+// readableKey maps key to the stored key, ok is false when the client may
+// not read it
+func (c *dbClient) readableKey(key string) (string, bool) {
+	storedKey, ok := c.access.key(key)
+	if !ok {
+		c.Logger.Warn().Msgf("denied get of `%s` outside of the client namespaces", key)
+	}
+	return storedKey, ok
+}
+
+// write builds the event storing value, applying its TTL
+func (c *dbClient) write(storedKey string, value string) WriteEvent {
+	var expires time.Time
+	if v, ttl, ok := parseTTL(value, c.options.TTLSuffix); ok {
+		c.Logger.Debug().Dur("ttl", ttl).Msgf("insert of `%s` expires", storedKey)
+		value = v
+		expires = time.Now().Add(ttl)
+	}
+	return WriteEvent{storedKey, value, expires}
+}
+
+func barrier(events chan any) {
+	done := make(chan struct{})
+	events <- BarrierEvent{done}
+	<-done
+}
+
+// read gets the values of the stored keys, straight from store when it is
+// set and from the database goroutine otherwise
+func read(events chan any, store Store, keys ...string) []readValue {
+	values := make([]readValue, len(keys))
+	if store != nil {
+		now := time.Now()
+		for i, key := range keys {
+			values[i].value, values[i].expires, values[i].ok = store.Lookup(key, now)
+		}
+		return values
+	}
+	if len(keys) == 1 {
+		out := make(chan readValue, 1)
+		events <- ReadEvent{keys[0], out}
+		values[0] = <-out
+		return values
+	}
+	out := make(chan []readValue, 1)
+	events <- BatchReadEvent{keys, out}
+	return <-out
+}
+
+func handleClient(udpClient *server.UDPClient, ch chan any, store Store, options Options) error {
+	access := resolveAccess(&options, udpClient.RemoteAddr())
+	if access.access != ACCESS_READ_WRITE {
+		udpClient.Logger = udpClient.Logger.With().Stringer("access", access.access).Logger()
+	}
+	if access.prefix != "" {
+		udpClient.Logger = udpClient.Logger.With().Str("namespace", access.prefix).Logger()
+	}
+	c := &dbClient{UDPClient: udpClient, events: ch, store: store, access: access, options: &options}
+
 	// Buffer helper for building responses
 	b := bytes.Buffer{}
 	for {
@@ -59,6 +466,18 @@ func handleClient(c *server.UDPClient, ch chan any) error {
 		if !ok {
 			break
 		}
+		if access.access == ACCESS_NONE {
+			c.Logger.Warn().Msg("denied request from client without access")
+			continue
+		}
+
+		if len(message) > 0 && message[0] == EXTENDED_PREFIX {
+			if err := c.handleExtended(message); err != nil {
+				return err
+			}
+			continue
+		}
+
 		had_crlf := endsWithCRLF(message)
 
 		// Write
@@ -72,8 +491,12 @@ func handleClient(c *server.UDPClient, ch chan any) error {
 				c.Logger.Debug().Msg("skipped insert of version value")
 				continue
 			}
+			storedKey, ok := c.writableKey(key)
+			if !ok {
+				continue
+			}
 
-			ch <- WriteEvent{key, value}
+			c.send(c.write(storedKey, value))
 			continue
 		}
 
@@ -83,7 +506,16 @@ func handleClient(c *server.UDPClient, ch chan any) error {
 		c.Logger.Info().Msgf("client sent a get request for `%s`", key)
 
 		if key == "delete" {
-			ch <- DeleteEvent{}
+			if options.PrimaryAddr != "" {
+				c.Logger.Warn().Msg("denied delete request on a replica")
+				continue
+			}
+			prefixes, ok := access.deletePrefixes()
+			if !ok {
+				c.Logger.Warn().Msg("denied delete request")
+				continue
+			}
+			c.send(DeleteEvent{prefixes})
 			continue
 		}
 
@@ -91,9 +523,11 @@ func handleClient(c *server.UDPClient, ch chan any) error {
 		if key == "version" {
 			value = VERSION
 		} else {
-			out := make(chan string, 1)
-			ch <- ReadEvent{key, out}
-			value = <-out
+			storedKey, ok := c.readableKey(key)
+			if !ok {
+				continue
+			}
+			value = c.read(storedKey)[0].value
 		}
 
 		payloadSize := len(message) + len("=") + len(value)
@@ -116,23 +550,181 @@ func handleClient(c *server.UDPClient, ch chan any) error {
 	return nil
 }
 
-func startServer(c chan any) {
-	data := make(map[string]string)
-	for {
-		message, ok := <-c
-		if !ok {
+// startServer owns data and applies every event in order, p is nil when the
+// database is only kept in memory and primary is nil when it has no replicas
+func startServer(c chan any, data Store, p *persistence, primary *primary, watches *watchList, options Options) {
+	sweepTicker := time.NewTicker(options.SweepInterval)
+	defer sweepTicker.Stop()
+
+	var syncTick <-chan time.Time
+	var snapshotTick <-chan time.Time
+	if p != nil {
+		defer func() {
+			if err := p.close(); err != nil {
+				log.Error().Err(err).Msg("Could not close database log")
+			}
+		}()
+		if options.Fsync == FSYNC_INTERVAL {
+			ticker := time.NewTicker(options.FsyncInterval)
+			defer ticker.Stop()
+			syncTick = ticker.C
+		}
+		if options.SnapshotInterval > 0 {
+			ticker := time.NewTicker(options.SnapshotInterval)
+			defer ticker.Stop()
+			snapshotTick = ticker.C
+		}
+	}
+
+	// lsn is the sequence number of the last record applied
+	var lsn uint64
+	if p != nil {
+		lsn = p.lsn
+	}
+	if primary != nil {
+		defer primary.close()
+	}
+
+	persist := func(rec record) {
+		if p == nil {
 			return
 		}
+		if err := p.append(rec); err != nil {
+			log.Error().Err(err).Msg("Could not write to database log")
+			return
+		}
+		if p.needsSnapshot() {
+			if err := p.snapshot(data); err != nil {
+				log.Error().Err(err).Msg("Could not write database snapshot")
+			}
+		}
+	}
+
+	commit := func(rec record) {
+		lsn++
+		rec.lsn = lsn
+		persist(rec)
+		if primary != nil {
+			primary.publish(rec)
+		}
+	}
+
+	set := func(w WriteEvent) {
+		data.Set(w.key, w.value, w.expires)
+		commit(setRecord(w.key, w.value, w.expires))
+		watches.notify(w.key, w.value, time.Now())
+	}
+
+	for {
+		var message any
+		select {
+		case m, ok := <-c:
+			if !ok {
+				return
+			}
+			message = m
+		case now := <-sweepTicker.C:
+			if removed := data.Sweep(now); removed > 0 {
+				log.Debug().Int("removed", removed).Msg("Removed expired keys")
+			}
+			watches.expire(now)
+			continue
+		case <-syncTick:
+			if err := p.sync(); err != nil {
+				log.Error().Err(err).Msg("Could not sync database log")
+			}
+			continue
+		case <-snapshotTick:
+			if p.records > 0 {
+				if err := p.snapshot(data); err != nil {
+					log.Error().Err(err).Msg("Could not write database snapshot")
+				}
+			}
+			continue
+		}
+
 		switch m := message.(type) {
 		case StopEvent:
 			log.Info().Msg("Database handling server shutdown")
 			return
 		case WriteEvent:
-			data[m.key] = m.value
+			set(m)
+		case UpdateEvent:
+			now := time.Now()
+			current, expires, _ := data.Lookup(m.key, now)
+			value, changed, err := m.update(current)
+			if err != nil || !changed {
+				m.out <- updateResult{current, false, err}
+				continue
+			}
+			if !m.keepExpiry {
+				expires = m.expires
+			}
+			set(WriteEvent{m.key, value, expires})
+			m.out <- updateResult{value, true, nil}
+		case BarrierEvent:
+			close(m.done)
+		case ListEvent:
+			m.out <- data.Keys(m.prefix, m.after, m.limit, time.Now())
+		case StatsEvent:
+			stats := storeStats{}
+			data.Range(time.Now(), func(key string, value string, expires time.Time) bool {
+				if strings.HasPrefix(key, m.prefix) {
+					stats.keys++
+					stats.bytes += len(key) + len(value)
+				}
+				return true
+			})
+			m.out <- stats
 		case ReadEvent:
-			m.out <- data[m.key]
+			value, expires, ok := data.Lookup(m.key, time.Now())
+			m.out <- readValue{value, expires, ok}
+		case BatchWriteEvent:
+			for _, w := range m.writes {
+				set(w)
+			}
+		case BatchReadEvent:
+			now := time.Now()
+			values := make([]readValue, len(m.keys))
+			for i, key := range m.keys {
+				values[i].value, values[i].expires, values[i].ok = data.Lookup(key, now)
+			}
+			m.out <- values
 		case DeleteEvent:
-			data = make(map[string]string)
+			for _, prefix := range m.prefixes {
+				data.ClearPrefix(prefix)
+				commit(record{op: RECORD_DELETE, key: prefix})
+			}
+		case ReplicaSyncEvent:
+			m.out <- primary.sync(m.runId, m.lsn, lsn, data, m.addr)
+		case ReplicaLeftEvent:
+			primary.remove(m.replica)
+		case ReplicatedEvent:
+			m.rec.apply(data)
+			lsn = m.rec.lsn
+			persist(m.rec)
+			if m.rec.op != RECORD_DELETE {
+				now := time.Now()
+				if value, ok := data.Get(m.rec.key, now); ok {
+					watches.notify(m.rec.key, value, now)
+				}
+			}
+		case WatchEvent:
+			m.out <- watches.handle(m, time.Now())
+		case ReplicaResetEvent:
+			data.ClearPrefix("")
+			for _, rec := range m.records {
+				rec.apply(data)
+			}
+			lsn = m.lsn
+			if p != nil {
+				p.lsn = lsn
+				if err := p.snapshot(data); err != nil {
+					log.Error().Err(err).Msg("Could not write database snapshot")
+				} else if err := p.saveRunId(m.runId); err != nil {
+					log.Error().Err(err).Msg("Could not write primary run id")
+				}
+			}
 		}
 	}
 }
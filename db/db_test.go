@@ -2,70 +2,736 @@ package db_test
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	mathrand "math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/wizzymore/tcp-go/db"
+	"github.com/wizzymore/tcp-go/servertest"
 )
 
 func TestDB(t *testing.T) {
-	s, err := db.NewDbServer()
-	if err != nil {
-		panic(err)
-	}
-	go s.Start()
-	defer s.Stop()
+	t.Parallel()
+	addr := servertest.Start(t, newDB(t, db.Options{}))
 
 	t.Run("can set value", func(t *testing.T) {
-		conn, err := net.Dial("udp", ":8000")
-		if err != nil {
-			t.Error(err, "could not dial the server")
-			return
+		client := servertest.DialUDP(t, addr)
+		client.Send("foo=123", "foo")
+		client.Expect("foo=123")
+	})
+
+	t.Run("can read unset value", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		rand_num := strconv.Itoa(mathrand.Int())
+		client.Send(rand_num)
+		client.Expect(rand_num + "=")
+	})
+
+	t.Run("can't change version", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("version=123", "version")
+		client.Expect("version=alpha")
+	})
+}
+
+// newDB creates a database on an ephemeral port unless options has an
+// address, to be run with servertest.Start
+func newDB(t *testing.T, options db.Options) *db.DbServer {
+	t.Helper()
+	if options.Addr == "" {
+		options.Addr = servertest.ADDR
+	}
+	s, err := db.NewDbServer(options)
+	require.NoError(t, err, "Could not create the server")
+	return s.(*db.DbServer)
+}
+
+// dialFrom connects to s from ip, to be matched by access rules
+func dialFrom(t *testing.T, ip string, s *db.DbServer) *servertest.UDPClient {
+	t.Helper()
+	conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)}, s.Addr().(*net.UDPAddr))
+	require.NoError(t, err, "Could not dial the server")
+	t.Cleanup(func() { conn.Close() })
+	return &servertest.UDPClient{T: t, Conn: conn, Timeout: servertest.TIMEOUT}
+}
+
+func TestPersistence(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	options := db.Options{DataDir: dir, Fsync: db.FSYNC_ALWAYS, SnapshotEvery: 3}
+
+	s := newDB(t, options)
+	client := servertest.DialUDP(t, servertest.Start(t, s))
+	client.Send("a=1", "b=2", "delete", "c=3", "d=4", "c=5", "e=\x00binary\nvalue", "e")
+	client.Expect("e=\x00binary\nvalue")
+	require.NoError(t, s.Stop())
+
+	_, err := os.Stat(filepath.Join(dir, db.SNAPSHOT_FILE))
+	require.NoError(t, err, "Snapshot should have been written")
+
+	s = newDB(t, options)
+	addr := servertest.Start(t, s)
+
+	t.Run("restores values", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("c", "d", "e")
+		client.Expect("c=5", "d=4", "e=\x00binary\nvalue")
+	})
+
+	t.Run("replays deletes", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("a", "b")
+		client.Expect("a=", "b=")
+	})
+
+	t.Run("truncates a torn log", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("f=6", "f")
+		client.Expect("f=6")
+		require.NoError(t, s.Stop())
+
+		log, err := os.OpenFile(filepath.Join(dir, db.LOG_FILE), os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		log.Write([]byte{'S', 0, 0, 0})
+		log.Close()
+
+		client = servertest.DialUDP(t, servertest.Start(t, newDB(t, options)))
+		client.Send("f", "c")
+		client.Expect("f=6", "c=5")
+	})
+}
+
+func TestTTL(t *testing.T) {
+	t.Parallel()
+	addr := servertest.Start(t, newDB(t, db.Options{
+		DataDir:       t.TempDir(),
+		TTLSuffix:     ";ttl=",
+		SweepInterval: time.Millisecond * 50,
+	}))
+
+	t.Run("expires keys", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("flag=on;ttl=300ms", "flag")
+		client.Expect("flag=on")
+		time.Sleep(time.Millisecond * 400)
+		client.Send("flag")
+		client.Expect("flag=")
+	})
+
+	t.Run("overwrites clear the ttl", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("flag=on;ttl=1", "flag=off")
+		time.Sleep(time.Millisecond * 1100)
+		client.Send("flag")
+		client.Expect("flag=off")
+	})
+
+	t.Run("keeps invalid ttls in the value", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("flag=on;ttl=never", "flag")
+		client.Expect("flag=on;ttl=never")
+	})
+}
+
+func TestAccessControl(t *testing.T) {
+	t.Parallel()
+	rules, err := db.ParseAccessRules("127.0.0.1/32,rw,namespace=team,delete=namespace;127.0.0.2/32,ro;127.0.0.3/32,rw,namespaces=public,delete=deny;127.0.0.4/32,rw")
+	require.NoError(t, err)
+	s := newDB(t, db.Options{Rules: rules})
+	addr := servertest.Start(t, s)
+
+	t.Run("namespaces keys of the client", func(t *testing.T) {
+		team := servertest.DialUDP(t, addr)
+		team.Send("a=1", "a")
+		team.Expect("a=1")
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("team/a", "a")
+		admin.Expect("team/a=1", "a=")
+	})
+
+	t.Run("read only clients can not write", func(t *testing.T) {
+		reader := dialFrom(t, "127.0.0.2", s)
+		reader.Send("team/a=2", "team/a", "version")
+		reader.Expect("team/a=1", "version=alpha")
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("team/a")
+		admin.Expect("team/a=1")
+	})
+
+	t.Run("restricts clients to their namespaces", func(t *testing.T) {
+		public := dialFrom(t, "127.0.0.3", s)
+		public.Send("public/b=2", "team/a=3", "public/b")
+		public.Expect("public/b=2")
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("team/a", "public/b")
+		admin.Expect("team/a=1", "public/b=2")
+	})
+
+	t.Run("answers denied batch requests", func(t *testing.T) {
+		public := dialFrom(t, "127.0.0.3", s)
+		command, header, _ := extendedQuery(public, db.COMMAND_MGET, "public/b", "team/a")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/a"`, header)
+
+		command, header, _ = extendedQuery(public, db.COMMAND_MSET, "public/c", "3", "team/\x00", "3")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/\x00"`, header)
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("public/c")
+		admin.Expect("public/c=")
+
+		command, _, _ = extendedQuery(dialFrom(t, "127.0.0.2", s), db.COMMAND_MSET, "team/a", "2")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+	})
+
+	t.Run("answers denied watches", func(t *testing.T) {
+		public := dialFrom(t, "127.0.0.3", s)
+		command, header, _ := extendedQuery(public, db.COMMAND_WATCH, "public/b", "team/a")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/a"`, header)
+		command, header, _ = extendedQuery(public, db.COMMAND_WATCH_PREFIX, "team/")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/"`, header)
+	})
+
+	t.Run("answers denied updates", func(t *testing.T) {
+		command, header, _ := extendedQuery(dialFrom(t, "127.0.0.3", s), db.COMMAND_INCR, "team/n")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/n"`, header)
+		command, _, _ = extendedQuery(dialFrom(t, "127.0.0.2", s), db.COMMAND_CAS, "team/a", "1", "2")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("team/a")
+		admin.Expect("team/a=1")
+	})
+
+	t.Run("restricts delete", func(t *testing.T) {
+		admin := dialFrom(t, "127.0.0.4", s)
+		admin.Send("c=3")
+		// Requests of a client are handled in order, reading from it waits for
+		// its delete
+		public := dialFrom(t, "127.0.0.3", s)
+		public.Send("delete", "public/b")
+		public.Expect("public/b=2")
+
+		team := servertest.DialUDP(t, addr)
+		team.Send("delete", "a")
+		team.Expect("a=")
+		admin.Send("team/a", "c", "public/b")
+		admin.Expect("team/a=", "c=3", "public/b=2")
+
+		dialFrom(t, "127.0.0.2", s).Send("delete")
+		admin.Send("delete", "c", "public/b")
+		admin.Expect("c=", "public/b=")
+	})
+
+	t.Run("denies unmatched clients", func(t *testing.T) {
+		client := dialFrom(t, "127.0.0.5", s)
+		client.Send("a")
+		client.ExpectNothing(time.Millisecond * 200)
+	})
+}
+
+// proxy forwards connections to target and records the first line sent back
+// by the target on each of them
+type proxy struct {
+	listener  net.Listener
+	lock      sync.Mutex
+	conns     []net.Conn
+	responses []string
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &proxy{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		p.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.lock.Unlock()
+
+			go io.Copy(upstream, conn)
+			go func() {
+				r := bufio.NewReader(upstream)
+				line, _ := r.ReadString('\n')
+				p.lock.Lock()
+				p.responses = append(p.responses, line)
+				p.lock.Unlock()
+				conn.Write([]byte(line))
+				io.Copy(conn, r)
+			}()
 		}
-		conn.Write([]byte("foo=123"))
-		conn.Write([]byte("foo"))
-		scanner := bufio.NewScanner(conn)
+	}()
+	return p
+}
+
+// drop closes every forwarded connection
+func (p *proxy) drop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *proxy) lastResponse() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.responses) == 0 {
+		return ""
+	}
+	return strings.Fields(p.responses[len(p.responses)-1])[0]
+}
+
+func TestReplication(t *testing.T) {
+	t.Parallel()
+	primary := newDB(t, db.Options{ReplicationAddr: servertest.ADDR})
+	primaryClient := servertest.DialUDP(t, servertest.Start(t, primary))
+	primaryClient.Send("before=1", "before")
+	primaryClient.Expect("before=1")
 
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
-		require.True(t, scanner.Scan(), "Could not read from the server")
+	link := newProxy(t, primary.ReplicationAddr().String())
+	replicaDir := t.TempDir()
+	replica := newDB(t, db.Options{PrimaryAddr: link.listener.Addr().String(), DataDir: replicaDir})
+	replicaAddr := servertest.Start(t, replica)
 
-		assert.Equal(t, []byte("foo=123"), scanner.Bytes(), "Did not set value correctly")
+	replicated := func(t *testing.T, request string, expected string) {
+		client := servertest.DialUDP(t, replicaAddr)
+		assert.Eventually(t, func() bool {
+			client.Send(request)
+			return client.Read() == expected
+		}, time.Second*3, time.Millisecond*20, "`%s` was not replicated", expected)
+	}
+
+	t.Run("starts with a snapshot", func(t *testing.T) {
+		replicated(t, "before", "before=1")
+		assert.Equal(t, "FULL", link.lastResponse())
 	})
 
-	t.Run("can read unset value", func(t *testing.T) {
-		conn, err := net.Dial("udp", ":8000")
-		if err != nil {
-			t.Error(err, "could not dial the server")
-			return
+	t.Run("streams writes and deletes", func(t *testing.T) {
+		client := servertest.DialUDP(t, primary.Addr().String())
+		client.Send("a=1", "b=2")
+		replicated(t, "b", "b=2")
+		client.Send("delete", "c=3")
+		replicated(t, "c", "c=3")
+		replicaClient := servertest.DialUDP(t, replicaAddr)
+		replicaClient.Send("a")
+		replicaClient.Expect("a=")
+	})
+
+	t.Run("rejects writes on replicas", func(t *testing.T) {
+		replicaClient := servertest.DialUDP(t, replicaAddr)
+		replicaClient.Send("d=4", "d")
+		replicaClient.Expect("d=")
+		client := servertest.DialUDP(t, primary.Addr().String())
+		client.Send("d")
+		client.Expect("d=")
+	})
+
+	t.Run("catches up after a reconnect", func(t *testing.T) {
+		link.drop()
+		servertest.DialUDP(t, primary.Addr().String()).Send("e=5", "c=6")
+		replicated(t, "e", "e=5")
+		replicaClient := servertest.DialUDP(t, replicaAddr)
+		replicaClient.Send("c")
+		replicaClient.Expect("c=6")
+		assert.Equal(t, "CONTINUE", link.lastResponse())
+	})
+
+	t.Run("continues after a restart", func(t *testing.T) {
+		require.NoError(t, replica.Stop())
+
+		servertest.DialUDP(t, primary.Addr().String()).Send("e=8")
+		replica = newDB(t, db.Options{PrimaryAddr: link.listener.Addr().String(), DataDir: replicaDir})
+		replicaAddr = servertest.Start(t, replica)
+		replicated(t, "e", "e=8")
+		assert.Equal(t, "CONTINUE", link.lastResponse())
+	})
+
+	t.Run("persists replicated data", func(t *testing.T) {
+		require.NoError(t, replica.Stop())
+
+		client := servertest.DialUDP(t, primary.Addr().String())
+		client.Send("f=7", "f")
+		client.Expect("f=7")
+
+		replicaClient := servertest.DialUDP(t, servertest.Start(t, newDB(t, db.Options{DataDir: replicaDir})))
+		replicaClient.Send("c", "f")
+		replicaClient.Expect("c=6", "f=")
+	})
+}
+
+func TestReplicationAccess(t *testing.T) {
+	t.Parallel()
+	rules, err := db.ParseAccessRules("127.0.0.1/32,rw,namespace=team;127.0.0.2/32,ro;127.0.0.3/32,rw,namespaces=public")
+	require.NoError(t, err)
+	primary := newDB(t, db.Options{Rules: rules, ReplicationAddr: servertest.ADDR})
+	servertest.Start(t, primary)
+
+	// Replicas are checked before they send their sync request
+	connectFrom := func(ip string) *servertest.LineClient {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		conn, err := dialer.Dial("tcp", primary.ReplicationAddr().String())
+		require.NoError(t, err, "Could not connect to the primary")
+		t.Cleanup(func() { conn.Close() })
+		return servertest.NewLineClient(t, conn)
+	}
+
+	t.Run("serves replicas reading every key", func(t *testing.T) {
+		replica := connectFrom("127.0.0.2")
+		replica.Send("SYNC - 0")
+		assert.True(t, strings.HasPrefix(replica.Read(), "FULL "))
+	})
+
+	t.Run("denies namespaced clients", func(t *testing.T) {
+		connectFrom("127.0.0.1").ExpectClosed()
+		connectFrom("127.0.0.3").ExpectClosed()
+	})
+
+	t.Run("denies unmatched clients", func(t *testing.T) {
+		connectFrom("127.0.0.4").ExpectClosed()
+	})
+}
+
+func TestReplicaRejectsInvalidSnapshots(t *testing.T) {
+	t.Parallel()
+	primary := servertest.Listen(t)
+	// The replica waits REPLICA_RETRY_DELAY between attempts, longer than
+	// servertest.Accept waits
+	primary.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 5))
+	servertest.Start(t, newDB(t, db.Options{PrimaryAddr: primary.Addr().String()}))
+
+	for _, response := range []string{"FULL run 1 -1\n", "FULL run 1 9223372036854775807\n"} {
+		conn, err := primary.Accept()
+		require.NoError(t, err, "Replica should connect")
+		client := servertest.NewLineClient(t, conn)
+		line := client.Read()
+		assert.True(t, strings.HasPrefix(line, "SYNC "), "Unexpected sync request %q", line)
+		conn.Write([]byte(response))
+		conn.Close()
+	}
+	// The replica survived both and still reconnects
+	conn, err := primary.Accept()
+	require.NoError(t, err, "Replica should reconnect")
+	conn.Close()
+}
+
+func extendedRequest(command string, fields ...string) string {
+	b := strings.Builder{}
+	b.WriteString("\x00" + command + "\x00")
+	for _, field := range fields {
+		b.WriteString(strconv.Itoa(len(field)) + ":" + field)
+	}
+	return b.String()
+}
+
+// extendedQuery sends an extended request and splits the response into its
+// command, header and fields
+func extendedQuery(client *servertest.UDPClient, command string, fields ...string) (string, string, []string) {
+	client.T.Helper()
+	client.Send(extendedRequest(command, fields...))
+	return readExtended(client)
+}
+
+func readExtended(client *servertest.UDPClient) (string, string, []string) {
+	client.T.Helper()
+	data := client.Read()
+	require.NotEmpty(client.T, data, "Empty response")
+
+	parts := strings.SplitN(data[1:], "\x00", 3)
+	require.Len(client.T, parts, 3, "Malformed response")
+	rest := parts[2]
+	response := []string{}
+	for rest != "" {
+		size, data, found := strings.Cut(rest, ":")
+		require.True(client.T, found, "Malformed response field")
+		length, err := strconv.Atoi(size)
+		require.NoError(client.T, err)
+		response = append(response, data[:length])
+		rest = data[length:]
+	}
+	return parts[0], parts[1], response
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	addr := servertest.Start(t, newDB(t, db.Options{}))
+
+	t.Run("sets and gets many keys", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		command, header, _ := extendedQuery(client, db.COMMAND_MSET, "a", "1", "b", "x=y\x00z", "version", "2")
+		assert.Equal(t, db.COMMAND_MSET, command)
+		assert.Equal(t, "2", header)
+
+		command, header, fields := extendedQuery(client, db.COMMAND_MGET, "a", "b", "unset", "version")
+		assert.Equal(t, db.COMMAND_MGET, command)
+		assert.Equal(t, "4/4", header)
+		assert.Equal(t, []string{"a", "1", "b", "x=y\x00z", "unset", "", "version", "alpha"}, fields)
+	})
+
+	t.Run("keeps the single key protocol", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("a")
+		client.Expect("a=1")
+		client.Send("c=3")
+		_, _, fields := extendedQuery(client, db.COMMAND_MGET, "c")
+		assert.Equal(t, []string{"c", "3"}, fields)
+	})
+
+	t.Run("truncates responses larger than a datagram", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		big := strings.Repeat("x", 40_000)
+		extendedQuery(client, db.COMMAND_MSET, "big1", big)
+		extendedQuery(client, db.COMMAND_MSET, "big2", big)
+
+		_, header, fields := extendedQuery(client, db.COMMAND_MGET, "a", "big1", "big2", "c")
+		assert.Equal(t, "2/4", header)
+		assert.Equal(t, []string{"a", "1", "big1", big}, fields)
+
+		_, header, fields = extendedQuery(client, db.COMMAND_MGET, "big2", "c")
+		assert.Equal(t, "2/2", header)
+		assert.Equal(t, []string{"big2", big, "c", "3"}, fields)
+	})
+
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		command, header, _ := extendedQuery(client, db.COMMAND_MSET, "a")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, "mset needs key and value pairs", header)
+
+		command, _, _ = extendedQuery(client, "nope")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+
+		client.Send("\x00mget\x0099:a")
+		command, header, _ = readExtended(client)
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, "malformed request", header)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	addr := servertest.Start(t, newDB(t, db.Options{
+		WatchTTL:      time.Millisecond * 300,
+		MaxWatches:    3,
+		SweepInterval: time.Millisecond * 50,
+	}))
+	// Watches belong to the address of the watcher, it is kept across the
+	// subtests
+	watcher := servertest.DialUDP(t, addr)
+
+	t.Run("pushes watched keys", func(t *testing.T) {
+		watcher.T = t
+		_, header, _ := extendedQuery(watcher, db.COMMAND_WATCH, "cfg")
+		assert.Equal(t, "1", header)
+		_, header, _ = extendedQuery(watcher, db.COMMAND_WATCH_PREFIX, "app/")
+		assert.Equal(t, "2", header)
+
+		writer := servertest.DialUDP(t, addr)
+		writer.Send("other=0", "cfg=1", "app/x=2")
+		watcher.Expect("cfg=1", "app/x=2")
+
+		extendedQuery(writer, db.COMMAND_MSET, "app/y", "3", "cfg", "4")
+		watcher.Expect("app/y=3", "cfg=4")
+		watcher.ExpectNothing(time.Millisecond * 50)
+	})
+
+	t.Run("caps watches per client", func(t *testing.T) {
+		watcher.T = t
+		command, header, _ := extendedQuery(watcher, db.COMMAND_WATCH, "a", "b")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, "too many watches", header)
+
+		// Renewing does not count again
+		_, header, _ = extendedQuery(watcher, db.COMMAND_WATCH, "cfg", "a")
+		assert.Equal(t, "3", header)
+		_, header, _ = extendedQuery(watcher, db.COMMAND_UNWATCH, "a")
+		assert.Equal(t, "2", header)
+	})
+
+	t.Run("expires watches", func(t *testing.T) {
+		watcher.T = t
+		time.Sleep(time.Millisecond * 400)
+		servertest.DialUDP(t, addr).Send("cfg=5")
+		watcher.ExpectNothing(time.Millisecond * 200)
+
+		_, header, _ := extendedQuery(watcher, db.COMMAND_WATCH, "cfg")
+		assert.Equal(t, "1", header)
+	})
+}
+
+func TestAtomic(t *testing.T) {
+	t.Parallel()
+	addr := servertest.Start(t, newDB(t, db.Options{TTLSuffix: ";ttl=", SweepInterval: time.Millisecond * 50}))
+
+	t.Run("increments integers", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		_, header, fields := extendedQuery(client, db.COMMAND_INCR, "n")
+		assert.Equal(t, "1", header)
+		assert.Equal(t, []string{"n", "1"}, fields)
+		_, _, fields = extendedQuery(client, db.COMMAND_INCR, "n", "41")
+		assert.Equal(t, []string{"n", "42"}, fields)
+		_, _, fields = extendedQuery(client, db.COMMAND_DECR, "n", "50")
+		assert.Equal(t, []string{"n", "-8"}, fields)
+		client.Send("n")
+		client.Expect("n=-8")
+
+		client.Send("text=abc")
+		command, header, _ := extendedQuery(client, db.COMMAND_INCR, "text")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, "value is not an integer", header)
+
+		client.Send("max=9223372036854775807")
+		command, header, _ = extendedQuery(client, db.COMMAND_INCR, "max")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, "integer overflow", header)
+	})
+
+	t.Run("increments atomically", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 4 {
+			client := servertest.DialUDP(t, addr)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 50 {
+					extendedQuery(client, db.COMMAND_INCR, "counter")
+				}
+			}()
 		}
-		rand_num := strconv.Itoa(mathrand.Int())
-		conn.Write([]byte(rand_num))
-		scanner := bufio.NewScanner(conn)
+		wg.Wait()
+		client := servertest.DialUDP(t, addr)
+		client.Send("counter")
+		client.Expect("counter=200")
+	})
 
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
-		require.True(t, scanner.Scan(), "Could not read from the server")
+	t.Run("compares and sets", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("lock=free")
+		_, header, fields := extendedQuery(client, db.COMMAND_CAS, "lock", "taken", "mine")
+		assert.Equal(t, "0", header)
+		assert.Equal(t, []string{"lock", "free"}, fields)
+		_, header, fields = extendedQuery(client, db.COMMAND_CAS, "lock", "free", "mine")
+		assert.Equal(t, "1", header)
+		assert.Equal(t, []string{"lock", "mine"}, fields)
 
-		assert.Equal(t, []byte(rand_num+"="), scanner.Bytes(), "Did not set value correctly")
+		_, header, _ = extendedQuery(client, db.COMMAND_CAS, "unset", "", "first")
+		assert.Equal(t, "1", header)
+		client.Send("unset")
+		client.Expect("unset=first")
 	})
 
-	t.Run("can't change version", func(t *testing.T) {
-		conn, err := net.Dial("udp", ":8000")
-		if err != nil {
-			t.Error(err, "could not dial the server")
-			return
+	t.Run("appends", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		extendedQuery(client, db.COMMAND_APPEND, "log", "a\n")
+		_, header, fields := extendedQuery(client, db.COMMAND_APPEND, "log", "b\n")
+		assert.Equal(t, "1", header)
+		assert.Equal(t, []string{"log", "a\nb\n"}, fields)
+	})
+
+	t.Run("keeps the ttl", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("visits=1;ttl=200ms")
+		_, _, fields := extendedQuery(client, db.COMMAND_INCR, "visits")
+		assert.Equal(t, []string{"visits", "2"}, fields)
+		time.Sleep(time.Millisecond * 300)
+		client.Send("visits")
+		client.Expect("visits=")
+	})
+}
+
+func TestListing(t *testing.T) {
+	t.Parallel()
+	rules, err := db.ParseAccessRules("127.0.0.1/32,rw;127.0.0.2/32,rw,namespace=team")
+	require.NoError(t, err)
+	s := newDB(t, db.Options{Rules: rules})
+	addr := servertest.Start(t, s)
+
+	pairs := []string{}
+	for i := range 250 {
+		pairs = append(pairs, fmt.Sprintf("a/%03d", i), "v")
+	}
+	client := servertest.DialUDP(t, addr)
+	extendedQuery(client, db.COMMAND_MSET, pairs...)
+	extendedQuery(client, db.COMMAND_MSET, "b/1", "value", "team/x", "1", "team/y", "2")
+
+	t.Run("lists keys in pages", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		listed := []string{}
+		cursor := ""
+		for page := 0; ; page++ {
+			require.Less(t, page, 10, "Listing did not end")
+			_, more, keys := extendedQuery(client, db.COMMAND_KEYS, "a/", cursor)
+			require.NotEmpty(t, keys)
+			listed = append(listed, keys...)
+			cursor = keys[len(keys)-1]
+			if more == "0" {
+				break
+			}
 		}
-		conn.Write([]byte("version=123"))
-		conn.Write([]byte("version"))
-		scanner := bufio.NewScanner(conn)
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
-		require.True(t, scanner.Scan(), "Could not read from the server")
-
-		assert.NotEqual(t, "version=123", scanner.Text(), "Did not set value correctly")
-		assert.Equal(t, "version=alpha", scanner.Text(), "Did not set value correctly")
+		assert.Len(t, listed, 250)
+		assert.Equal(t, "a/000", listed[0])
+		assert.Equal(t, "a/249", listed[249])
+
+		_, more, keys := extendedQuery(client, db.COMMAND_KEYS, "", "a/248", "3")
+		assert.Equal(t, "1", more)
+		assert.Equal(t, []string{"a/249", "b/1", "team/x"}, keys)
+	})
+
+	t.Run("counts keys and bytes", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		_, _, fields := extendedQuery(client, db.COMMAND_STATS, "b/")
+		assert.Equal(t, []string{"keys", "1", "bytes", "8"}, fields)
+		_, _, fields = extendedQuery(client, db.COMMAND_STATS)
+		assert.Equal(t, []string{"keys", "253", "bytes", strconv.Itoa(250*6 + 8 + 14)}, fields)
+	})
+
+	t.Run("stays in the client namespace", func(t *testing.T) {
+		team := dialFrom(t, "127.0.0.2", s)
+		_, more, keys := extendedQuery(team, db.COMMAND_KEYS)
+		assert.Equal(t, "0", more)
+		assert.Equal(t, []string{"x", "y"}, keys)
+		_, _, keys = extendedQuery(team, db.COMMAND_KEYS, "", "x")
+		assert.Equal(t, []string{"y"}, keys)
+		_, _, fields := extendedQuery(team, db.COMMAND_STATS)
+		assert.Equal(t, []string{"keys", "2", "bytes", "14"}, fields)
+	})
+
+	t.Run("answers denied prefixes", func(t *testing.T) {
+		rules, err := db.ParseAccessRules("127.0.0.1/32,rw,namespaces=public")
+		require.NoError(t, err)
+		public := servertest.DialUDP(t, servertest.Start(t, newDB(t, db.Options{Rules: rules})))
+
+		command, header, _ := extendedQuery(public, db.COMMAND_KEYS, "team/")
+		assert.Equal(t, db.COMMAND_ERROR, command)
+		assert.Equal(t, `access denied to "team/"`, header)
+		command, _, _ = extendedQuery(public, db.COMMAND_STATS, "team/")
+		assert.Equal(t, db.COMMAND_ERROR, command)
 	})
 }
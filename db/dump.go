@@ -0,0 +1,379 @@
+package db
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const (
+	DUMP_JSON = "json"
+	DUMP_CSV  = "csv"
+)
+
+// Keys and values that can not be written as is are base64 encoded, with
+// the encoding column or field set to "base64"
+const DUMP_BASE64 = "base64"
+
+// Times DumpDataDir reads the files of a directory being snapshotted before
+// giving up
+const DUMP_DATA_DIR_ATTEMPTS = 10
+
+var dumpCSVHeader = []string{"key", "value", "encoding", "expires"}
+
+// DumpRecord is a key/value pair of a dump. JSON dumps hold a record per
+// line, CSV dumps a header followed by a record per row. Expires is the
+// RFC 3339 time the key expires at, empty when it never does.
+type DumpRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+}
+
+// needsBase64 reports if s would not survive the format unchanged: JSON
+// only holds UTF-8 and CSV readers turn "\r\n" into "\n"
+func needsBase64(s string, format string) bool {
+	return !utf8.ValidString(s) || format == DUMP_CSV && strings.ContainsRune(s, '\r')
+}
+
+func encodeDumpRecord(e dumpEntry, format string) DumpRecord {
+	record := DumpRecord{Key: e.key, Value: e.value}
+	if needsBase64(e.key, format) || needsBase64(e.value, format) {
+		record.Key = base64.StdEncoding.EncodeToString([]byte(e.key))
+		record.Value = base64.StdEncoding.EncodeToString([]byte(e.value))
+		record.Encoding = DUMP_BASE64
+	}
+	if !e.expires.IsZero() {
+		record.Expires = e.expires.UTC().Format(time.RFC3339Nano)
+	}
+	return record
+}
+
+func (r *DumpRecord) decode() (dumpEntry, error) {
+	e := dumpEntry{key: r.Key, value: r.Value}
+	if r.Expires != "" {
+		expires, err := time.Parse(time.RFC3339Nano, r.Expires)
+		if err != nil {
+			return dumpEntry{}, fmt.Errorf("invalid expiry: %w", err)
+		}
+		e.expires = expires
+	}
+	switch r.Encoding {
+	case "":
+		return e, nil
+	case DUMP_BASE64:
+		key, err := base64.StdEncoding.DecodeString(r.Key)
+		if err != nil {
+			return dumpEntry{}, err
+		}
+		value, err := base64.StdEncoding.DecodeString(r.Value)
+		if err != nil {
+			return dumpEntry{}, err
+		}
+		e.key, e.value = string(key), string(value)
+		return e, nil
+	}
+	return dumpEntry{}, fmt.Errorf("unknown encoding `%s`", r.Encoding)
+}
+
+// DumpWriter writes key/value pairs in a dump format
+type DumpWriter struct {
+	format string
+	buf    *bufio.Writer
+	json   *json.Encoder
+	csv    *csv.Writer
+}
+
+func NewDumpWriter(w io.Writer, format string) (*DumpWriter, error) {
+	d := &DumpWriter{format: format, buf: bufio.NewWriter(w)}
+	switch format {
+	case DUMP_JSON:
+		d.json = json.NewEncoder(d.buf)
+		d.json.SetEscapeHTML(false)
+	case DUMP_CSV:
+		d.csv = csv.NewWriter(d.buf)
+		if err := d.csv.Write(dumpCSVHeader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown dump format: %s", format)
+	}
+	return d, nil
+}
+
+// Write writes key and its value, expires is zero for keys that never
+// expire
+func (d *DumpWriter) Write(key string, value string, expires time.Time) error {
+	return d.write(dumpEntry{key, value, expires})
+}
+
+func (d *DumpWriter) write(e dumpEntry) error {
+	record := encodeDumpRecord(e, d.format)
+	if d.json != nil {
+		return d.json.Encode(record)
+	}
+	return d.csv.Write([]string{record.Key, record.Value, record.Encoding, record.Expires})
+}
+
+func (d *DumpWriter) Flush() error {
+	if d.csv != nil {
+		d.csv.Flush()
+		if err := d.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return d.buf.Flush()
+}
+
+// DumpReader reads the key/value pairs of a dump
+type DumpReader struct {
+	json *json.Decoder
+	csv  *csv.Reader
+	line int
+}
+
+func NewDumpReader(r io.Reader, format string) (*DumpReader, error) {
+	d := &DumpReader{}
+	switch format {
+	case DUMP_JSON:
+		d.json = json.NewDecoder(r)
+	case DUMP_CSV:
+		d.csv = csv.NewReader(r)
+		header, err := d.csv.Read()
+		if err != nil {
+			return nil, err
+		}
+		// Dumps written before expiries were dumped have no expires column
+		if !slices.Equal(header, dumpCSVHeader) && !slices.Equal(header, dumpCSVHeader[:3]) {
+			return nil, fmt.Errorf("invalid csv header %v", header)
+		}
+		d.csv.FieldsPerRecord = len(header)
+		d.line = 1
+	default:
+		return nil, fmt.Errorf("unknown dump format: %s", format)
+	}
+	return d, nil
+}
+
+// Read returns the next pair and when it expires, zero when it never does.
+// It returns io.EOF once the dump ended.
+func (d *DumpReader) Read() (string, string, time.Time, error) {
+	e, err := d.read()
+	return e.key, e.value, e.expires, err
+}
+
+func (d *DumpReader) read() (dumpEntry, error) {
+	d.line++
+	var record DumpRecord
+	if d.json != nil {
+		if err := d.json.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return dumpEntry{}, io.EOF
+			}
+			return dumpEntry{}, fmt.Errorf("record %d: %w", d.line, err)
+		}
+	} else {
+		row, err := d.csv.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return dumpEntry{}, io.EOF
+			}
+			return dumpEntry{}, err
+		}
+		record = DumpRecord{Key: row[0], Value: row[1], Encoding: row[2]}
+		if len(row) > 3 {
+			record.Expires = row[3]
+		}
+	}
+	e, err := record.decode()
+	if err != nil {
+		return dumpEntry{}, fmt.Errorf("record %d: %w", d.line, err)
+	}
+	return e, nil
+}
+
+// Dump writes the keys starting with prefix along with their expiries, the
+// server keeps serving writes so the dump is not a snapshot of a single point
+// in time. Keys deleted while dumping are left out.
+func (c *Client) Dump(prefix string, w *DumpWriter) (int, error) {
+	dumped := 0
+	cursor := ""
+	for {
+		keys, more, err := c.Keys(prefix, cursor, MAX_LIST_LIMIT)
+		if err != nil {
+			return dumped, err
+		}
+		if len(keys) > 0 {
+			entries, err := c.export(keys)
+			if err != nil {
+				return dumped, err
+			}
+			for _, e := range entries {
+				if err := w.write(e); err != nil {
+					return dumped, err
+				}
+				dumped++
+			}
+			cursor = keys[len(keys)-1]
+		}
+		if !more || len(keys) == 0 {
+			return dumped, w.Flush()
+		}
+	}
+}
+
+// Restore writes every pair of the dump to the server as is, with its
+// expiry, keeping the keys missing from the dump. Keys that expired since
+// they were dumped are not restored.
+func (c *Client) Restore(r *DumpReader) (int, error) {
+	restored := 0
+	entries := []dumpEntry{}
+	size := 1 + len(COMMAND_IMPORT) + 1
+	flush := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		n, err := c.importEntries(entries)
+		restored += n
+		entries = entries[:0]
+		size = 1 + len(COMMAND_IMPORT) + 1
+		return err
+	}
+
+	for {
+		e, err := r.read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return restored, flush()
+			}
+			return restored, err
+		}
+		entrySize := fieldSize(e.key) + fieldSize(e.value) + fieldSize(formatExpiry(e.expires))
+		if size+entrySize > server.MAX_DATAGRAM_SIZE {
+			if err := flush(); err != nil {
+				return restored, err
+			}
+		}
+		entries = append(entries, e)
+		size += entrySize
+	}
+}
+
+// DumpDataDir writes the keys starting with prefix, along with their
+// expiries, from the persistence files of dir, which may belong to a running
+// server. The files are read again when the server wrote a snapshot while
+// they were read, as it empties the log.
+func DumpDataDir(dir string, prefix string, w *DumpWriter) (int, error) {
+	var data Store
+	for attempt := 1; ; attempt++ {
+		before, err := statSnapshot(dir)
+		if err != nil {
+			return 0, err
+		}
+		p := &persistence{dir: dir}
+		data = NewMapStore()
+		if err := p.loadSnapshot(data); err != nil {
+			return 0, fmt.Errorf("could not load snapshot: %w", err)
+		}
+		if err := p.replayLog(data, false); err != nil {
+			return 0, fmt.Errorf("could not replay log: %w", err)
+		}
+		after, err := statSnapshot(dir)
+		if err != nil {
+			return 0, err
+		}
+		if sameSnapshot(before, after) {
+			break
+		}
+		if attempt == DUMP_DATA_DIR_ATTEMPTS {
+			return 0, fmt.Errorf("snapshots of %s were written during %d attempts to read it", dir, attempt)
+		}
+	}
+
+	entries := []dumpEntry{}
+	data.Range(time.Now(), func(key string, value string, expires time.Time) bool {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, dumpEntry{key, value, expires})
+		}
+		return true
+	})
+	slices.SortFunc(entries, func(a, b dumpEntry) int { return strings.Compare(a.key, b.key) })
+	for _, e := range entries {
+		if err := w.write(e); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), w.Flush()
+}
+
+// statSnapshot returns nil when dir has no snapshot
+func statSnapshot(dir string) (os.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(dir, SNAPSHOT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// sameSnapshot reports if no snapshot was written between a and b, snapshots
+// being renamed over the previous one
+func sameSnapshot(a os.FileInfo, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// RestoreDataDir writes every pair of the dump to the persistence files of
+// dir with its expiry, keeping the keys missing from the dump and skipping
+// the expired ones. The server of dir must not be running.
+func RestoreDataDir(dir string, r *DumpReader) (int, error) {
+	data := NewMapStore()
+	p, err := openPersistence(Options{DataDir: dir, Fsync: FSYNC_NEVER}, data)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	now := time.Now()
+	for {
+		e, err := r.read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				p.close()
+				return restored, err
+			}
+			break
+		}
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			continue
+		}
+		data.Set(e.key, e.value, e.expires)
+		rec := setRecord(e.key, e.value, e.expires)
+		rec.lsn = p.lsn + 1
+		if err := p.append(rec); err != nil {
+			p.close()
+			return restored, err
+		}
+		restored++
+	}
+
+	if err := p.snapshot(data); err != nil {
+		p.close()
+		return restored, err
+	}
+	return restored, p.close()
+}
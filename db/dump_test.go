@@ -0,0 +1,204 @@
+package db_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/db"
+	"github.com/wizzymore/tcp-go/servertest"
+)
+
+var dumpPairs = map[string]string{
+	"plain":        "value",
+	"multi\nline":  "a\r\nb\nc",
+	"binary":       "\x00\xff\xfe=",
+	"quoted,comma": `"hello", world`,
+	"unicode":      "héllo wörld",
+	"empty":        "",
+}
+
+func TestDump(t *testing.T) {
+	t.Parallel()
+	for _, format := range []string{db.DUMP_JSON, db.DUMP_CSV} {
+		t.Run(format+" through servers", func(t *testing.T) {
+			source := newDB(t, db.Options{})
+			conn := servertest.DialUDP(t, servertest.Start(t, source))
+			target := newDB(t, db.Options{})
+			servertest.Start(t, target)
+
+			pairs := []string{}
+			for key, value := range dumpPairs {
+				pairs = append(pairs, key, value)
+			}
+			extendedQuery(conn, db.COMMAND_MSET, pairs...)
+
+			client, err := db.Dial(source.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			buf := bytes.Buffer{}
+			w, err := db.NewDumpWriter(&buf, format)
+			require.NoError(t, err)
+			dumped, err := client.Dump("", w)
+			require.NoError(t, err)
+			assert.Equal(t, len(dumpPairs), dumped)
+
+			targetClient, err := db.Dial(target.Addr().String())
+			require.NoError(t, err)
+			defer targetClient.Close()
+			r, err := db.NewDumpReader(&buf, format)
+			require.NoError(t, err)
+			restored, err := targetClient.Restore(r)
+			require.NoError(t, err)
+			assert.Equal(t, len(dumpPairs), restored)
+
+			keys := []string{}
+			for key := range dumpPairs {
+				keys = append(keys, key)
+			}
+			values, err := targetClient.MGet(keys)
+			require.NoError(t, err)
+			assert.Equal(t, dumpPairs, values)
+		})
+	}
+
+	t.Run("keeps expiries and values as is", func(t *testing.T) {
+		source := newDB(t, db.Options{TTLSuffix: ";ttl="})
+		conn := servertest.DialUDP(t, servertest.Start(t, source))
+		before := time.Now()
+		extendedQuery(conn, db.COMMAND_MSET, "flag", "on;ttl=1h", "short", "x;ttl=300ms", "plain", "v")
+
+		// Unset keys are left out of exports
+		_, header, fields := extendedQuery(conn, db.COMMAND_EXPORT, "plain", "missing")
+		assert.Equal(t, "2/2", header)
+		assert.Equal(t, []string{"plain", "v", ""}, fields)
+
+		client, err := db.Dial(source.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		buf := bytes.Buffer{}
+		w, err := db.NewDumpWriter(&buf, db.DUMP_CSV)
+		require.NoError(t, err)
+		dumped, err := client.Dump("", w)
+		require.NoError(t, err)
+		assert.Equal(t, 3, dumped)
+
+		r, err := db.NewDumpReader(bytes.NewReader(buf.Bytes()), db.DUMP_CSV)
+		require.NoError(t, err)
+		key, value, expires, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, "flag", key)
+		assert.Equal(t, "on", value)
+		assert.WithinDuration(t, before.Add(time.Hour), expires, time.Second)
+
+		// A value looking like a TTL is restored as is
+		buf.WriteString("literal,v;ttl=30,,\n")
+		buf.WriteString("expired,x,," + time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano) + "\n")
+		target := servertest.DialUDP(t, servertest.Start(t, newDB(t, db.Options{TTLSuffix: ";ttl="})))
+		targetClient, err := db.Dial(target.Conn.RemoteAddr().String())
+		require.NoError(t, err)
+		defer targetClient.Close()
+		r, err = db.NewDumpReader(&buf, db.DUMP_CSV)
+		require.NoError(t, err)
+		restored, err := targetClient.Restore(r)
+		require.NoError(t, err)
+		assert.Equal(t, 4, restored)
+
+		target.Send("literal", "flag", "short", "expired")
+		target.Expect("literal=v;ttl=30", "flag=on", "short=x", "expired=")
+		time.Sleep(time.Millisecond * 400)
+		target.Send("short")
+		target.Expect("short=")
+	})
+
+	t.Run("reads dumps without expiries", func(t *testing.T) {
+		r, err := db.NewDumpReader(strings.NewReader("key,value,encoding\na,1,\n"), db.DUMP_CSV)
+		require.NoError(t, err)
+		key, value, expires, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, "a", key)
+		assert.Equal(t, "1", value)
+		assert.True(t, expires.IsZero())
+	})
+
+	t.Run("through data directories", func(t *testing.T) {
+		sourceDir := t.TempDir()
+		source := newDB(t, db.Options{DataDir: sourceDir})
+		conn := servertest.DialUDP(t, servertest.Start(t, source))
+		for key, value := range dumpPairs {
+			extendedQuery(conn, db.COMMAND_MSET, key, value)
+		}
+		conn.Send("other=1", "other")
+		conn.Expect("other=1")
+		require.NoError(t, source.Stop())
+
+		buf := bytes.Buffer{}
+		w, err := db.NewDumpWriter(&buf, db.DUMP_JSON)
+		require.NoError(t, err)
+		dumped, err := db.DumpDataDir(sourceDir, "", w)
+		require.NoError(t, err)
+		assert.Equal(t, len(dumpPairs)+1, dumped)
+
+		targetDir := t.TempDir()
+		r, err := db.NewDumpReader(&buf, db.DUMP_JSON)
+		require.NoError(t, err)
+		restored, err := db.RestoreDataDir(targetDir, r)
+		require.NoError(t, err)
+		assert.Equal(t, len(dumpPairs)+1, restored)
+
+		targetConn := servertest.DialUDP(t, servertest.Start(t, newDB(t, db.Options{DataDir: targetDir})))
+		targetConn.Send("other")
+		targetConn.Expect("other=1")
+		_, _, fields := extendedQuery(targetConn, db.COMMAND_MGET, "binary", "multi\nline")
+		assert.Equal(t, []string{"binary", dumpPairs["binary"], "multi\nline", dumpPairs["multi\nline"]}, fields)
+	})
+	t.Run("through the data directory of a server writing snapshots", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newDB(t, db.Options{DataDir: dir, Fsync: db.FSYNC_NEVER, SnapshotEvery: 5})
+		servertest.Start(t, s)
+
+		var written atomic.Int64
+		stop := make(chan struct{})
+		writing := make(chan struct{})
+		go func() {
+			defer close(writing)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Set(fmt.Sprintf("k/%06d", i), "v")
+				written.Store(int64(i + 1))
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-writing
+		}()
+
+		for deadline := time.Now().Add(time.Millisecond * 500); time.Now().Before(deadline); {
+			// Every key written before the dump started is in it
+			expected := written.Load()
+			buf := bytes.Buffer{}
+			w, err := db.NewDumpWriter(&buf, db.DUMP_CSV)
+			require.NoError(t, err)
+			dumped, err := db.DumpDataDir(dir, "k/", w)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, int64(dumped), expected)
+
+			r, err := db.NewDumpReader(&buf, db.DUMP_CSV)
+			require.NoError(t, err)
+			for i := range expected {
+				key, _, _, err := r.Read()
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("k/%06d", i), key, "Dump is missing keys")
+			}
+		}
+	})
+}
@@ -0,0 +1,600 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// Extended requests start with a NUL byte, which a single key request never
+// does in practice, followed by the command and its fields:
+//
+//	\x00<command>\x00<len>:<field><len>:<field>...
+//
+// Fields are length prefixed so keys and values may hold any byte. Responses
+// use the same form, with a header between the command and the fields:
+//
+//	\x00<command>\x00<header>\x00<len>:<field>...
+//
+// Malformed or unknown requests, and requests on keys the client may not
+// access, get an "error" response whose header is the reason.
+const EXTENDED_PREFIX = '\x00'
+
+const (
+	// mget <key>... answers with "<answered>/<requested>" and the key/value
+	// pairs of the first answered keys, unset keys have empty values. Pairs
+	// that would not fit in a datagram are left out, clients request them
+	// again.
+	COMMAND_MGET = "mget"
+	// mset <key> <value>... stores every pair at once and answers with the
+	// number of pairs stored
+	COMMAND_MSET = "mset"
+	// export <key>... answers like mget with key, value and expiry triples,
+	// unset keys being answered without a triple. Expiries are in unix
+	// nanoseconds, empty for keys that never expire.
+	COMMAND_EXPORT = "export"
+	// import <key> <value> <expiry>... stores every triple of an export at
+	// once, values are stored as is without looking for a TTL and keys
+	// already expired are skipped. It answers with the number of triples
+	// stored.
+	COMMAND_IMPORT = "import"
+	// watch <key>... and watchprefix <prefix>... make the server push
+	// "key=value" datagrams whenever a matching key is written, deletes are
+	// not pushed. Watches expire unless watched again and answer with the
+	// number of watches the client holds, unwatch and unwatchprefix remove
+	// them.
+	COMMAND_WATCH          = "watch"
+	COMMAND_WATCH_PREFIX   = "watchprefix"
+	COMMAND_UNWATCH        = "unwatch"
+	COMMAND_UNWATCH_PREFIX = "unwatchprefix"
+	// cas <key> <expected> <value> writes value when key holds expected,
+	// unset keys hold an empty value. incr and decr <key> [<delta>] add to
+	// or subtract from integer values, 1 by default, and append <key>
+	// <suffix> extends the value, those three keep the TTL of key. They
+	// answer with "1" when key was written, "0" otherwise, along with the
+	// key and its resulting value.
+	COMMAND_CAS    = "cas"
+	COMMAND_INCR   = "incr"
+	COMMAND_DECR   = "decr"
+	COMMAND_APPEND = "append"
+	// keys [<prefix> [<cursor> [<limit>]]] lists the keys starting with
+	// prefix in order, after the cursor key when not empty. It answers with
+	// "1" when more keys follow the ones listed, which are cut short to fit
+	// in a datagram, the last key listed being the cursor of the next page.
+	COMMAND_KEYS = "keys"
+	// stats [<prefix>] answers with the "keys" count and total "bytes" of
+	// the keys starting with prefix, as name and value pairs
+	COMMAND_STATS = "stats"
+	COMMAND_ERROR = "error"
+)
+
+const DEFAULT_LIST_LIMIT = 100
+const MAX_LIST_LIMIT = 1000
+
+var errMalformedRequest = errors.New("malformed request")
+var errNotInteger = errors.New("value is not an integer")
+var errOverflow = errors.New("integer overflow")
+var errValueTooLarge = errors.New("value too large")
+
+type extendedCommand func(c *dbClient, fields []string) error
+
+var extendedCommands = map[string]extendedCommand{
+	COMMAND_MGET:   (*dbClient).handleMget,
+	COMMAND_MSET:   (*dbClient).handleMset,
+	COMMAND_EXPORT: (*dbClient).handleExport,
+	COMMAND_IMPORT: (*dbClient).handleImport,
+	COMMAND_CAS:    (*dbClient).handleCas,
+	COMMAND_INCR:   func(c *dbClient, fields []string) error { return c.handleIncr(COMMAND_INCR, fields, 1) },
+	COMMAND_DECR:   func(c *dbClient, fields []string) error { return c.handleIncr(COMMAND_DECR, fields, -1) },
+	COMMAND_APPEND: (*dbClient).handleAppend,
+	COMMAND_KEYS:   (*dbClient).handleKeys,
+	COMMAND_STATS:  (*dbClient).handleStats,
+	COMMAND_WATCH: func(c *dbClient, keys []string) error {
+		return c.handleWatch(COMMAND_WATCH, keys, false, false)
+	},
+	COMMAND_WATCH_PREFIX: func(c *dbClient, prefixes []string) error {
+		return c.handleWatch(COMMAND_WATCH_PREFIX, prefixes, true, false)
+	},
+	COMMAND_UNWATCH: func(c *dbClient, keys []string) error {
+		return c.handleWatch(COMMAND_UNWATCH, keys, false, true)
+	},
+	COMMAND_UNWATCH_PREFIX: func(c *dbClient, prefixes []string) error {
+		return c.handleWatch(COMMAND_UNWATCH_PREFIX, prefixes, true, true)
+	},
+}
+
+// parseExtended splits an extended request into its command and fields
+func parseExtended(message []byte) (string, []string, error) {
+	command, rest, found := bytes.Cut(message[1:], []byte{0})
+	if !found || len(command) == 0 {
+		return "", nil, errMalformedRequest
+	}
+	fields, err := parseFields(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(command), fields, nil
+}
+
+// parseExtendedResponse splits an extended response into its command, header
+// and fields
+func parseExtendedResponse(message []byte) (string, string, []string, error) {
+	if len(message) == 0 || message[0] != EXTENDED_PREFIX {
+		return "", "", nil, errMalformedRequest
+	}
+	parts := bytes.SplitN(message[1:], []byte{0}, 3)
+	if len(parts) != 3 {
+		return "", "", nil, errMalformedRequest
+	}
+	fields, err := parseFields(parts[2])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return string(parts[0]), string(parts[1]), fields, nil
+}
+
+func parseFields(rest []byte) ([]string, error) {
+	fields := []string{}
+	for len(rest) > 0 {
+		size, data, found := bytes.Cut(rest, []byte{':'})
+		if !found {
+			return nil, errMalformedRequest
+		}
+		n, err := strconv.Atoi(string(size))
+		if err != nil || n < 0 || n > len(data) {
+			return nil, errMalformedRequest
+		}
+		fields = append(fields, string(data[:n]))
+		rest = data[n:]
+	}
+	return fields, nil
+}
+
+// extendedRequest encodes a request of command
+func extendedRequest(command string, fields ...string) []byte {
+	size := 1 + len(command) + 1
+	for _, field := range fields {
+		size += fieldSize(field)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, EXTENDED_PREFIX)
+	b = append(b, command...)
+	b = append(b, 0)
+	for _, field := range fields {
+		b = appendField(b, field)
+	}
+	return b
+}
+
+func appendField(b []byte, field string) []byte {
+	b = strconv.AppendInt(b, int64(len(field)), 10)
+	b = append(b, ':')
+	return append(b, field...)
+}
+
+func fieldSize(field string) int {
+	return len(strconv.Itoa(len(field))) + 1 + len(field)
+}
+
+func extendedResponse(command string, header string, fields ...string) []byte {
+	size := 1 + len(command) + 1 + len(header) + 1
+	for _, field := range fields {
+		size += fieldSize(field)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, EXTENDED_PREFIX)
+	b = append(b, command...)
+	b = append(b, 0)
+	b = append(b, header...)
+	b = append(b, 0)
+	for _, field := range fields {
+		b = appendField(b, field)
+	}
+	return b
+}
+
+func (c *dbClient) reply(command string, header string, fields ...string) error {
+	response := extendedResponse(command, header, fields...)
+	if len(response) > server.MAX_DATAGRAM_SIZE {
+		c.Logger.Warn().Int("size", len(response)).Msgf("%s response does not fit in a datagram", command)
+		response = extendedResponse(COMMAND_ERROR, "response too large")
+	}
+	return c.Write(response)
+}
+
+func (c *dbClient) replyError(reason string) error {
+	return c.reply(COMMAND_ERROR, reason)
+}
+
+// replyDenied answers a request on key the client may not access, the key
+// is quoted as it may hold a NUL byte
+func (c *dbClient) replyDenied(key string) error {
+	return c.replyError("access denied to " + strconv.Quote(key))
+}
+
+func (c *dbClient) handleExtended(message []byte) error {
+	command, fields, err := parseExtended(message)
+	if err != nil {
+		c.Logger.Warn().Msgf("client sent a malformed extended request `%s`", sanitize(string(message)))
+		return c.replyError(err.Error())
+	}
+	c.Logger.Info().Int("fields", len(fields)).Msgf("client sent a %s request", command)
+
+	handler, ok := extendedCommands[command]
+	if !ok {
+		return c.replyError(fmt.Sprintf("unknown command %s", command))
+	}
+	return handler(c, fields)
+}
+
+func (c *dbClient) handleMget(keys []string) error {
+	if len(keys) == 0 {
+		return c.replyError("mget needs keys")
+	}
+
+	storedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		if key == "version" {
+			continue
+		}
+		storedKey, ok := c.readableKey(key)
+		if !ok {
+			return c.replyDenied(key)
+		}
+		storedKeys[i] = storedKey
+	}
+	values := c.read(storedKeys...)
+
+	// The header is sized for every key being answered
+	total := strconv.Itoa(len(keys))
+	size := 1 + len(COMMAND_MGET) + 1 + len(total)*2 + 1 + 1
+	answered := 0
+	pairs := []string{}
+	for i, key := range keys {
+		value := values[i].value
+		if key == "version" {
+			value = VERSION
+		}
+		size += fieldSize(key) + fieldSize(value)
+		if size > server.MAX_DATAGRAM_SIZE {
+			c.Logger.Debug().Int("answered", answered).Int("requested", len(keys)).Msg("mget response truncated")
+			break
+		}
+		pairs = append(pairs, key, value)
+		answered++
+	}
+	return c.reply(COMMAND_MGET, fmt.Sprintf("%d/%d", answered, len(keys)), pairs...)
+}
+
+func (c *dbClient) handleExport(keys []string) error {
+	if len(keys) == 0 {
+		return c.replyError("export needs keys")
+	}
+
+	storedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		storedKey, ok := c.readableKey(key)
+		if !ok {
+			return c.replyDenied(key)
+		}
+		storedKeys[i] = storedKey
+	}
+	values := c.read(storedKeys...)
+
+	total := strconv.Itoa(len(keys))
+	size := 1 + len(COMMAND_EXPORT) + 1 + len(total)*2 + 1 + 1
+	answered := 0
+	triples := []string{}
+	for i, key := range keys {
+		value := values[i]
+		if !value.ok {
+			answered++
+			continue
+		}
+		expires := formatExpiry(value.expires)
+		size += fieldSize(key) + fieldSize(value.value) + fieldSize(expires)
+		if size > server.MAX_DATAGRAM_SIZE {
+			c.Logger.Debug().Int("answered", answered).Int("requested", len(keys)).Msg("export response truncated")
+			break
+		}
+		triples = append(triples, key, value.value, expires)
+		answered++
+	}
+	return c.reply(COMMAND_EXPORT, fmt.Sprintf("%d/%d", answered, len(keys)), triples...)
+}
+
+func (c *dbClient) handleImport(triples []string) error {
+	if len(triples) == 0 || len(triples)%3 != 0 {
+		return c.replyError("import needs key, value and expiry triples")
+	}
+
+	// Every key is checked before anything is written
+	storedKeys := make([]string, len(triples)/3)
+	expiries := make([]time.Time, len(triples)/3)
+	for i := range storedKeys {
+		key := triples[3*i]
+		expires, err := parseExpiry(triples[3*i+2])
+		if err != nil {
+			return c.replyError(fmt.Sprintf("invalid expiry of %s", strconv.Quote(key)))
+		}
+		expiries[i] = expires
+		if key == "version" {
+			continue
+		}
+		storedKey, ok := c.writableKey(key)
+		if !ok {
+			return c.replyDenied(key)
+		}
+		storedKeys[i] = storedKey
+	}
+	now := time.Now()
+	writes := []WriteEvent{}
+	for i, storedKey := range storedKeys {
+		if triples[3*i] == "version" {
+			c.Logger.Debug().Msg("skipped import of version value")
+			continue
+		}
+		if !expiries[i].IsZero() && !expiries[i].After(now) {
+			continue
+		}
+		writes = append(writes, WriteEvent{storedKey, triples[3*i+1], expiries[i]})
+	}
+	if len(writes) > 0 {
+		c.send(BatchWriteEvent{writes})
+	}
+	return c.reply(COMMAND_IMPORT, strconv.Itoa(len(writes)))
+}
+
+// formatExpiry encodes expires for export and import requests
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(expires.UnixNano(), 10)
+}
+
+func parseExpiry(field string) (time.Time, error) {
+	if field == "" {
+		return time.Time{}, nil
+	}
+	n, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}, errMalformedRequest
+	}
+	return time.Unix(0, n), nil
+}
+
+func (c *dbClient) handleMset(pairs []string) error {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return c.replyError("mset needs key and value pairs")
+	}
+
+	// Every key is checked before anything is written
+	storedKeys := make([]string, len(pairs)/2)
+	for i := range storedKeys {
+		key := pairs[2*i]
+		if key == "version" {
+			continue
+		}
+		storedKey, ok := c.writableKey(key)
+		if !ok {
+			return c.replyDenied(key)
+		}
+		storedKeys[i] = storedKey
+	}
+	writes := []WriteEvent{}
+	for i, storedKey := range storedKeys {
+		if pairs[2*i] == "version" {
+			c.Logger.Debug().Msg("skipped insert of version value")
+			continue
+		}
+		writes = append(writes, c.write(storedKey, pairs[2*i+1]))
+	}
+	if len(writes) > 0 {
+		c.send(BatchWriteEvent{writes})
+	}
+	return c.reply(COMMAND_MSET, strconv.Itoa(len(writes)))
+}
+
+func (c *dbClient) handleWatch(command string, keys []string, prefix bool, remove bool) error {
+	if len(keys) == 0 {
+		return c.replyError(command + " needs keys")
+	}
+
+	storedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		storedKey, ok := c.readableKey(key)
+		if !ok {
+			return c.replyDenied(key)
+		}
+		storedKeys[i] = storedKey
+	}
+
+	out := make(chan watchResult, 1)
+	c.events <- WatchEvent{c.UDPClient, c.access.prefix, storedKeys, prefix, remove, out}
+	result := <-out
+	if result.err != nil {
+		c.Logger.Warn().Int("watches", result.count).Msg("denied watch over the limit")
+		return c.replyError(result.err.Error())
+	}
+	return c.reply(command, strconv.Itoa(result.count))
+}
+
+// update runs an UpdateEvent on key and answers with its result
+func (c *dbClient) update(command string, key string, event UpdateEvent) error {
+	if key == "version" {
+		return c.replyError("version can not be written")
+	}
+	storedKey, ok := c.writableKey(key)
+	if !ok {
+		return c.replyDenied(key)
+	}
+
+	event.key = storedKey
+	event.out = make(chan updateResult, 1)
+	c.send(event)
+	result := <-event.out
+	if result.err != nil {
+		return c.replyError(result.err.Error())
+	}
+	changed := "0"
+	if result.changed {
+		changed = "1"
+	}
+	return c.reply(command, changed, key, result.value)
+}
+
+func (c *dbClient) handleCas(fields []string) error {
+	if len(fields) != 3 {
+		return c.replyError("cas needs a key, the expected value and a value")
+	}
+	expected := fields[1]
+	write := c.write(fields[0], fields[2])
+	return c.update(COMMAND_CAS, fields[0], UpdateEvent{
+		update: func(current string) (string, bool, error) {
+			return write.value, current == expected, nil
+		},
+		expires: write.expires,
+	})
+}
+
+func (c *dbClient) handleIncr(command string, fields []string, sign int64) error {
+	if len(fields) != 1 && len(fields) != 2 {
+		return c.replyError(command + " needs a key and an optional delta")
+	}
+	delta := int64(1)
+	if len(fields) == 2 {
+		var err error
+		if delta, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return c.replyError(errNotInteger.Error())
+		}
+	}
+	if sign < 0 {
+		if delta == math.MinInt64 {
+			return c.replyError(errOverflow.Error())
+		}
+		delta = -delta
+	}
+
+	return c.update(command, fields[0], UpdateEvent{
+		update: func(current string) (string, bool, error) {
+			var n int64
+			if current != "" {
+				var err error
+				if n, err = strconv.ParseInt(current, 10, 64); err != nil {
+					return "", false, errNotInteger
+				}
+			}
+			if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+				return "", false, errOverflow
+			}
+			return strconv.FormatInt(n+delta, 10), true, nil
+		},
+		keepExpiry: true,
+	})
+}
+
+func (c *dbClient) handleAppend(fields []string) error {
+	if len(fields) != 2 {
+		return c.replyError("append needs a key and a suffix")
+	}
+	suffix := fields[1]
+	return c.update(COMMAND_APPEND, fields[0], UpdateEvent{
+		update: func(current string) (string, bool, error) {
+			// Values stay readable with a single key request
+			if len(fields[0])+1+len(current)+len(suffix) > server.MAX_DATAGRAM_SIZE {
+				return "", false, errValueTooLarge
+			}
+			return current + suffix, true, nil
+		},
+		keepExpiry: true,
+	})
+}
+
+// readablePrefix maps prefix to the stored prefix, ok is false when the
+// client may not read every key starting with it
+func (c *dbClient) readablePrefix(prefix string) (string, bool) {
+	storedPrefix, ok := c.access.key(prefix)
+	if !ok {
+		c.Logger.Warn().Msgf("denied scan of `%s` outside of the client namespaces", prefix)
+	}
+	return storedPrefix, ok
+}
+
+func (c *dbClient) handleKeys(fields []string) error {
+	if len(fields) > 3 {
+		return c.replyError("keys needs an optional prefix, cursor and limit")
+	}
+	var prefix, cursor string
+	limit := DEFAULT_LIST_LIMIT
+	if len(fields) > 0 {
+		prefix = fields[0]
+	}
+	if len(fields) > 1 {
+		cursor = fields[1]
+	}
+	if len(fields) > 2 {
+		n, err := strconv.Atoi(fields[2])
+		if err != nil || n <= 0 {
+			return c.replyError("invalid limit")
+		}
+		limit = min(n, MAX_LIST_LIMIT)
+	}
+
+	storedPrefix, ok := c.readablePrefix(prefix)
+	if !ok {
+		return c.replyDenied(prefix)
+	}
+	after := ""
+	if cursor != "" {
+		after = c.access.prefix + cursor
+	}
+
+	out := make(chan []string, 1)
+	c.events <- ListEvent{storedPrefix, after, limit + 1, out}
+	storedKeys := <-out
+
+	more := len(storedKeys) > limit
+	size := 1 + len(COMMAND_KEYS) + 1 + 1 + 1
+	keys := []string{}
+	for _, storedKey := range storedKeys[:min(len(storedKeys), limit)] {
+		key := strings.TrimPrefix(storedKey, c.access.prefix)
+		size += fieldSize(key)
+		if size > server.MAX_DATAGRAM_SIZE {
+			more = true
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	header := "0"
+	if more {
+		header = "1"
+	}
+	return c.reply(COMMAND_KEYS, header, keys...)
+}
+
+func (c *dbClient) handleStats(fields []string) error {
+	if len(fields) > 1 {
+		return c.replyError("stats needs an optional prefix")
+	}
+	prefix := ""
+	if len(fields) == 1 {
+		prefix = fields[0]
+	}
+	storedPrefix, ok := c.readablePrefix(prefix)
+	if !ok {
+		return c.replyDenied(prefix)
+	}
+
+	out := make(chan storeStats, 1)
+	c.events <- StatsEvent{storedPrefix, out}
+	stats := <-out
+	return c.reply(COMMAND_STATS, "", "keys", strconv.Itoa(stats.keys), "bytes", strconv.Itoa(stats.bytes))
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type FsyncPolicy int
+
+const (
+	// FSYNC_INTERVAL syncs the log every FsyncInterval
+	FSYNC_INTERVAL FsyncPolicy = iota
+	// FSYNC_ALWAYS syncs the log after every write
+	FSYNC_ALWAYS
+	// FSYNC_NEVER leaves syncing to the operating system
+	FSYNC_NEVER
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "interval":
+		return FSYNC_INTERVAL, nil
+	case "always":
+		return FSYNC_ALWAYS, nil
+	case "never":
+		return FSYNC_NEVER, nil
+	}
+	return FSYNC_INTERVAL, fmt.Errorf("unknown fsync policy: %s", s)
+}
+
+const DEFAULT_FSYNC_INTERVAL = time.Second
+const DEFAULT_SNAPSHOT_EVERY = 10_000
+
+const LOG_FILE = "db.log"
+const SNAPSHOT_FILE = "db.snapshot"
+
+// PRIMARY_FILE holds the run id of the primary a replica got its data from,
+// so it can continue from its log position after a restart
+const PRIMARY_FILE = "db.primary"
+
+const (
+	RECORD_SET byte = 'S'
+	// RECORD_SET_TTL values start with the expiry as big endian unix
+	// nanoseconds
+	RECORD_SET_TTL byte = 'T'
+	// RECORD_DELETE removes the keys starting with its key, every key when
+	// it is empty
+	RECORD_DELETE byte = 'D'
+)
+
+// Records larger than this are treated as corrupted
+const MAX_RECORD_FIELD = 16 * 1024 * 1024
+
+var errCorruptRecord = errors.New("corrupt record")
+
+var snapshotMagic = []byte("PHDB1")
+
+// record is a single entry of the log and the snapshot, encoded as:
+//
+//	op(1) lsn(8) key_len(4) key value_len(4) value crc32(4)
+type record struct {
+	op    byte
+	lsn   uint64
+	key   string
+	value string
+}
+
+func (r *record) encode() []byte {
+	b := make([]byte, 0, 1+8+4+len(r.key)+4+len(r.value)+4)
+	b = append(b, r.op)
+	b = binary.BigEndian.AppendUint64(b, r.lsn)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(r.key)))
+	b = append(b, r.key...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(r.value)))
+	b = append(b, r.value...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// decodeRecord reads the next record, returning io.EOF only when r ended
+// cleanly between two records
+func decodeRecord(r *bufio.Reader) (rec record, n int, err error) {
+	crc := crc32.NewIEEE()
+	read := func(size int) ([]byte, error) {
+		buf := make([]byte, size)
+		m, err := io.ReadFull(r, buf)
+		n += m
+		crc.Write(buf[:m])
+		return buf, err
+	}
+
+	header, err := read(1 + 8 + 4)
+	if err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return rec, n, io.EOF
+		}
+		return rec, n, io.ErrUnexpectedEOF
+	}
+	rec.op = header[0]
+	rec.lsn = binary.BigEndian.Uint64(header[1:9])
+	keyLen := binary.BigEndian.Uint32(header[9:13])
+	if rec.op != RECORD_SET && rec.op != RECORD_SET_TTL && rec.op != RECORD_DELETE || keyLen > MAX_RECORD_FIELD {
+		return rec, n, errCorruptRecord
+	}
+
+	key, err := read(int(keyLen))
+	if err != nil {
+		return rec, n, io.ErrUnexpectedEOF
+	}
+	rec.key = string(key)
+
+	lenBuf, err := read(4)
+	if err != nil {
+		return rec, n, io.ErrUnexpectedEOF
+	}
+	valueLen := binary.BigEndian.Uint32(lenBuf)
+	if valueLen > MAX_RECORD_FIELD {
+		return rec, n, errCorruptRecord
+	}
+	value, err := read(int(valueLen))
+	if err != nil {
+		return rec, n, io.ErrUnexpectedEOF
+	}
+	rec.value = string(value)
+
+	sum := crc.Sum32()
+	var expected [4]byte
+	m, err := io.ReadFull(r, expected[:])
+	n += m
+	if err != nil {
+		return rec, n, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(expected[:]) != sum {
+		return rec, n, errCorruptRecord
+	}
+	return rec, n, nil
+}
+
+func setRecord(key string, value string, expires time.Time) record {
+	if expires.IsZero() {
+		return record{op: RECORD_SET, key: key, value: value}
+	}
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(expires.UnixNano()))
+	return record{op: RECORD_SET_TTL, key: key, value: string(stamp) + value}
+}
+
+func (r *record) apply(db Store) {
+	switch r.op {
+	case RECORD_SET:
+		db.Set(r.key, r.value, time.Time{})
+	case RECORD_SET_TTL:
+		if len(r.value) < 8 {
+			return
+		}
+		expires := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(r.value[:8]))))
+		db.Set(r.key, r.value[8:], expires)
+	case RECORD_DELETE:
+		db.ClearPrefix(r.key)
+	}
+}
+
+// persistence keeps the database in an append only log of every write and
+// delete, compacted into a snapshot once it holds SnapshotEvery records. It
+// is only used from the startServer goroutine.
+type persistence struct {
+	dir     string
+	options Options
+	log     *os.File
+	// lsn is the sequence number of the last record written
+	lsn uint64
+	// runId is the run of the primary the records were replicated from,
+	// empty when unknown
+	runId string
+	// records is the number of records in the log since the last snapshot
+	records int
+	dirty   bool
+}
+
+// openPersistence loads the snapshot and replays the log found in dir into
+// the empty data
+func openPersistence(options Options, data Store) (p *persistence, err error) {
+	p = &persistence{dir: options.DataDir, options: options}
+	if err = os.MkdirAll(p.dir, 0755); err != nil {
+		return
+	}
+
+	if err = p.loadSnapshot(data); err != nil {
+		return nil, fmt.Errorf("could not load snapshot: %w", err)
+	}
+	if err = p.replayLog(data, true); err != nil {
+		return nil, fmt.Errorf("could not replay log: %w", err)
+	}
+	if err = p.loadRunId(); err != nil {
+		return nil, fmt.Errorf("could not load primary run id: %w", err)
+	}
+
+	p.log, err = os.OpenFile(filepath.Join(p.dir, LOG_FILE), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys that expired while the server was down
+	data.Sweep(time.Now())
+
+	log.Info().
+		Str("dir", p.dir).
+		Int("keys", data.Len()).
+		Uint64("lsn", p.lsn).
+		Int("log_records", p.records).
+		Msg("Database loaded from disk")
+	return p, nil
+}
+
+func (p *persistence) loadSnapshot(data Store) error {
+	file, err := os.Open(filepath.Join(p.dir, SNAPSHOT_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, len(snapshotMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return errors.New("not a snapshot file")
+	}
+	p.lsn = binary.BigEndian.Uint64(header[len(snapshotMagic):])
+
+	for {
+		rec, _, err := decodeRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		rec.apply(data)
+	}
+}
+
+func (p *persistence) loadRunId() error {
+	runId, err := os.ReadFile(filepath.Join(p.dir, PRIMARY_FILE))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	p.runId = strings.TrimSpace(string(runId))
+	return nil
+}
+
+// saveRunId records the primary run the data comes from. It must only be
+// called once the data written matches that run, a crash in between then
+// leaves the previous run id and the replica does a full sync.
+func (p *persistence) saveRunId(runId string) error {
+	tmpPath := filepath.Join(p.dir, PRIMARY_FILE+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(runId+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(p.dir, PRIMARY_FILE)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	p.runId = runId
+	return nil
+}
+
+// replayLog applies the log records newer than the snapshot, a torn or
+// corrupted tail left by a crash is truncated when repair is set and ignored
+// otherwise
+func (p *persistence) replayLog(data Store, repair bool) error {
+	path := filepath.Join(p.dir, LOG_FILE)
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, n, err := decodeRecord(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorruptRecord) {
+				if !repair {
+					return nil
+				}
+				log.Warn().Err(err).Int64("offset", offset).Msg("Truncating damaged database log")
+				return os.Truncate(path, offset)
+			}
+			return err
+		}
+		offset += int64(n)
+		p.records++
+		// Records already part of the snapshot, the log was not truncated yet
+		if rec.lsn <= p.lsn {
+			continue
+		}
+		p.lsn = rec.lsn
+		rec.apply(data)
+	}
+}
+
+// append writes rec, whose lsn must follow the last record written
+func (p *persistence) append(rec record) error {
+	p.lsn = rec.lsn
+	if _, err := p.log.Write(rec.encode()); err != nil {
+		return err
+	}
+	p.records++
+	if p.options.Fsync == FSYNC_ALWAYS {
+		return p.log.Sync()
+	}
+	p.dirty = true
+	return nil
+}
+
+func (p *persistence) sync() error {
+	if !p.dirty {
+		return nil
+	}
+	p.dirty = false
+	return p.log.Sync()
+}
+
+// needsSnapshot reports if the log grew enough to be compacted
+func (p *persistence) needsSnapshot() bool {
+	return p.records >= p.options.SnapshotEvery
+}
+
+// snapshot writes data to a new snapshot and empties the log
+func (p *persistence) snapshot(data Store) error {
+	tmpPath := filepath.Join(p.dir, SNAPSHOT_FILE+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	w := bufio.NewWriter(file)
+	w.Write(snapshotMagic)
+	w.Write(binary.BigEndian.AppendUint64(nil, p.lsn))
+	data.Range(time.Now(), func(key string, value string, expires time.Time) bool {
+		rec := setRecord(key, value, expires)
+		rec.lsn = p.lsn
+		_, err = w.Write(rec.encode())
+		return err == nil
+	})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(p.dir, SNAPSHOT_FILE)); err != nil {
+		return err
+	}
+	if dir, err := os.Open(p.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Replay skips the records covered by the snapshot, so a crash before
+	// this truncate is harmless
+	if err := p.log.Truncate(0); err != nil {
+		return err
+	}
+	p.records = 0
+	p.dirty = false
+
+	log.Info().Int("keys", data.Len()).Uint64("lsn", p.lsn).Msg("Database snapshot written")
+	return nil
+}
+
+func (p *persistence) close() error {
+	if err := p.sync(); err != nil {
+		p.log.Close()
+		return err
+	}
+	return p.log.Close()
+}
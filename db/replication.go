@@ -0,0 +1,366 @@
+package db
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const DEFAULT_REPLICATION_BACKLOG = 10_000
+
+// Records buffered for a replica before it is considered too slow and
+// disconnected
+const REPLICA_BUFFER = 1024
+
+// Delay before a replica reconnects to its primary
+const REPLICA_RETRY_DELAY = time.Second
+
+// Snapshot records preallocated by a replica, the count announced by the
+// primary is not trusted further
+const REPLICA_SNAPSHOT_PREALLOC = 1024
+
+var errReplicaStopping = errors.New("replica is stopping")
+var errReplicaDenied = errors.New("replication denied by the access rules")
+
+// The replication link is line based until the primary answers the sync
+// request, then carries encoded records:
+//
+//	replica: SYNC <run id> <lsn>
+//	primary: CONTINUE <run id>                  followed by the missed records
+//	primary: FULL <run id> <lsn> <record count> followed by a snapshot
+//
+// after which every record written by the primary is streamed. The run id
+// changes every time the primary starts, "-" is sent for none.
+const (
+	REPLICATION_SYNC     = "SYNC"
+	REPLICATION_CONTINUE = "CONTINUE"
+	REPLICATION_FULL     = "FULL"
+)
+
+// ReplicaSyncEvent registers a replica having applied every record up to
+// lsn of the primary run runId
+type ReplicaSyncEvent struct {
+	runId string
+	lsn   uint64
+	addr  net.Addr
+	out   chan replicaSync
+}
+
+// ReplicaLeftEvent unregisters a replica whose link closed
+type ReplicaLeftEvent struct {
+	replica *replica
+}
+
+// ReplicatedEvent applies a record streamed by the primary
+type ReplicatedEvent struct {
+	rec record
+}
+
+// ReplicaResetEvent replaces the keys of a replica with a snapshot of the
+// primary run runId taken at lsn
+type ReplicaResetEvent struct {
+	records []record
+	runId   string
+	lsn     uint64
+}
+
+type replica struct {
+	addr    net.Addr
+	records chan record
+}
+
+type replicaSync struct {
+	replica *replica
+	runId   string
+	full    bool
+	// lsn is the snapshot position for a full sync
+	lsn uint64
+	// records are the snapshot for a full sync, the missed records otherwise
+	records []record
+}
+
+// primary keeps the recent records for replicas catching up and streams new
+// ones to the connected replicas. It is only used from the startServer
+// goroutine.
+type primary struct {
+	runId    string
+	capacity int
+	// backlog holds the last records, with consecutive lsns
+	backlog  []record
+	replicas map[*replica]struct{}
+}
+
+func newPrimary(capacity int) *primary {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &primary{
+		runId:    hex.EncodeToString(id),
+		capacity: capacity,
+		replicas: make(map[*replica]struct{}),
+	}
+}
+
+func (p *primary) publish(rec record) {
+	p.backlog = append(p.backlog, rec)
+	if len(p.backlog) > 2*p.capacity {
+		p.backlog = append(p.backlog[:0:0], p.backlog[len(p.backlog)-p.capacity:]...)
+	}
+
+	for r := range p.replicas {
+		select {
+		case r.records <- rec:
+		default:
+			log.Warn().Stringer("replica", r.addr).Msg("Replica is too slow, disconnecting it")
+			p.remove(r)
+		}
+	}
+}
+
+// sync registers a replica, it continues from since when the backlog still
+// holds every record after it and gets a snapshot of data otherwise
+func (p *primary) sync(runId string, since uint64, lsn uint64, data Store, addr net.Addr) replicaSync {
+	r := &replica{addr: addr, records: make(chan record, REPLICA_BUFFER)}
+	p.replicas[r] = struct{}{}
+
+	if runId == p.runId && since <= lsn {
+		if since == lsn {
+			return replicaSync{replica: r, runId: p.runId}
+		}
+		if len(p.backlog) > 0 && p.backlog[0].lsn <= since+1 {
+			missed := p.backlog[since+1-p.backlog[0].lsn:]
+			return replicaSync{replica: r, runId: p.runId, records: append([]record(nil), missed...)}
+		}
+	}
+
+	records := make([]record, 0, data.Len())
+	data.Range(time.Now(), func(key string, value string, expires time.Time) bool {
+		rec := setRecord(key, value, expires)
+		rec.lsn = lsn
+		records = append(records, rec)
+		return true
+	})
+	return replicaSync{replica: r, runId: p.runId, full: true, lsn: lsn, records: records}
+}
+
+func (p *primary) remove(r *replica) {
+	if _, ok := p.replicas[r]; !ok {
+		return
+	}
+	delete(p.replicas, r)
+	close(r.records)
+}
+
+func (p *primary) close() {
+	for r := range p.replicas {
+		p.remove(r)
+	}
+}
+
+// handleReplica serves the replication link of a replica, which the access
+// rules must let read every key
+func (db *DbServer) handleReplica(c *server.TCPClient, options *Options) error {
+	if !resolveAccess(options, c.RemoteAddr()).canReplicate() {
+		c.Logger.Warn().Msg("denied replication to a client that may not read every key")
+		return errReplicaDenied
+	}
+	reader := bufio.NewReader(c)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != REPLICATION_SYNC {
+		return fmt.Errorf("invalid sync request `%s`", sanitize(line))
+	}
+	since, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sync position: %w", err)
+	}
+
+	out := make(chan replicaSync, 1)
+	select {
+	case db.events <- ReplicaSyncEvent{fields[1], since, c.RemoteAddr(), out}:
+	case <-db.done:
+		return nil
+	}
+	var sync replicaSync
+	select {
+	case sync = <-out:
+	case <-db.done:
+		return nil
+	}
+	defer func() {
+		select {
+		case db.events <- ReplicaLeftEvent{sync.replica}:
+		case <-db.done:
+		}
+	}()
+
+	w := bufio.NewWriter(c)
+	if sync.full {
+		c.Logger.Info().Uint64("lsn", sync.lsn).Int("keys", len(sync.records)).Msg("replica needs a full sync")
+		fmt.Fprintf(w, "%s %s %d %d\n", REPLICATION_FULL, sync.runId, sync.lsn, len(sync.records))
+	} else {
+		c.Logger.Info().Uint64("lsn", since).Int("missed", len(sync.records)).Msg("replica continues")
+		fmt.Fprintf(w, "%s %s\n", REPLICATION_CONTINUE, sync.runId)
+	}
+	for _, rec := range sync.records {
+		if _, err := w.Write(rec.encode()); err != nil {
+			return err
+		}
+	}
+
+	for {
+		c.SetWriteDeadline(time.Now().Add(time.Second * 10))
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		rec, ok := <-sync.replica.records
+		if !ok {
+			return nil
+		}
+		for {
+			if _, err := w.Write(rec.encode()); err != nil {
+				return err
+			}
+			if len(sync.replica.records) == 0 {
+				break
+			}
+			if rec, ok = <-sync.replica.records; !ok {
+				w.Flush()
+				return nil
+			}
+		}
+	}
+}
+
+// replicate follows the primary until the server stops, reconnecting when
+// the link breaks. runId and lsn are the primary run and the position the
+// database was loaded at, runId is empty when unknown.
+func (db *DbServer) replicate(primaryAddr string, runId string, lsn uint64) {
+	defer close(db.replicaDone)
+	if runId == "" {
+		runId = "-"
+	}
+	for {
+		err := db.followPrimary(primaryAddr, &runId, &lsn)
+		select {
+		case <-db.stopping:
+			return
+		default:
+		}
+		log.Warn().Err(err).Str("primary", primaryAddr).Msg("Lost the replication link, reconnecting")
+
+		select {
+		case <-db.stopping:
+			return
+		case <-time.After(REPLICA_RETRY_DELAY):
+		}
+	}
+}
+
+func (db *DbServer) followPrimary(primaryAddr string, runId *string, lsn *uint64) error {
+	conn, err := net.DialTimeout("tcp", primaryAddr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	db.primaryLock.Lock()
+	select {
+	case <-db.stopping:
+		db.primaryLock.Unlock()
+		return nil
+	default:
+	}
+	db.primaryConn = conn
+	db.primaryLock.Unlock()
+
+	if _, err := fmt.Fprintf(conn, "%s %s %d\n", REPLICATION_SYNC, *runId, *lsn); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == REPLICATION_CONTINUE:
+		log.Info().Str("primary", primaryAddr).Uint64("lsn", *lsn).Msg("Continuing replication")
+	case len(fields) == 4 && fields[0] == REPLICATION_FULL:
+		snapshotLSN, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+		if count < 0 {
+			return fmt.Errorf("invalid snapshot size %d", count)
+		}
+		records := make([]record, 0, min(count, REPLICA_SNAPSHOT_PREALLOC))
+		for range count {
+			rec, _, err := decodeRecord(r)
+			if err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+		if err := db.sendReplicaEvent(ReplicaResetEvent{records, fields[1], snapshotLSN}); err != nil {
+			return err
+		}
+		*lsn = snapshotLSN
+		log.Info().Str("primary", primaryAddr).Uint64("lsn", *lsn).Int("keys", count).Msg("Replicated a snapshot of the primary")
+	default:
+		return fmt.Errorf("invalid sync response `%s`", sanitize(line))
+	}
+	*runId = fields[1]
+
+	for {
+		rec, _, err := decodeRecord(r)
+		if err != nil {
+			return err
+		}
+		if rec.lsn != *lsn+1 {
+			return errors.New("replication stream skipped records")
+		}
+		if err := db.sendReplicaEvent(ReplicatedEvent{rec}); err != nil {
+			return err
+		}
+		*lsn = rec.lsn
+	}
+}
+
+// sendReplicaEvent hands e to the database unless the replica is stopping
+func (db *DbServer) sendReplicaEvent(e any) error {
+	select {
+	case db.events <- e:
+		return nil
+	case <-db.stopping:
+		return errReplicaStopping
+	case <-db.done:
+		return errReplicaStopping
+	}
+}
+
+func (db *DbServer) stopReplica() {
+	db.primaryLock.Lock()
+	close(db.stopping)
+	if db.primaryConn != nil {
+		db.primaryConn.Close()
+	}
+	db.primaryLock.Unlock()
+	<-db.replicaDone
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SHARDS = 32
+
+// Store holds the key/value pairs. It is only written to by the startServer
+// goroutine so writes stay ordered with the log and the replicas, reads may
+// come from any goroutine when the store is Concurrent.
+type Store interface {
+	// Concurrent reports if the store can be read while it is written to
+	Concurrent() bool
+	Set(key string, value string, expires time.Time)
+	// Get returns the value of key, expired keys read as unset
+	Get(key string, now time.Time) (string, bool)
+	// Lookup is Get also returning when key expires
+	Lookup(key string, now time.Time) (value string, expires time.Time, ok bool)
+	Remove(key string)
+	// ClearPrefix removes every key starting with prefix, all of them when
+	// prefix is empty
+	ClearPrefix(prefix string)
+	Len() int
+	// Sweep removes every expired key and returns how many were removed
+	Sweep(now time.Time) int
+	// Range calls yield for every key not expired at now until it returns
+	// false, yield must not use the store
+	Range(now time.Time, yield func(key string, value string, expires time.Time) bool)
+	// Keys lists in order the first limit keys starting with prefix and
+	// sorting after after, skipping the keys expired at now
+	Keys(prefix string, after string, limit int, now time.Time) []string
+}
+
+type shard struct {
+	lock sync.RWMutex
+	data *mapStore
+}
+
+// shardedStore spreads the keys over shards each guarded by a RWMutex, so
+// clients can read while other shards are written to
+type shardedStore struct {
+	seed   maphash.Seed
+	shards []shard
+}
+
+// NewShardedStore creates a Concurrent store of the given number of shards,
+// defaulting to DEFAULT_SHARDS
+func NewShardedStore(shards int) Store {
+	if shards <= 0 {
+		shards = DEFAULT_SHARDS
+	}
+	s := &shardedStore{seed: maphash.MakeSeed(), shards: make([]shard, shards)}
+	for i := range s.shards {
+		s.shards[i].data = newMapStore()
+	}
+	return s
+}
+
+func (s *shardedStore) shard(key string) *shard {
+	return &s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *shardedStore) Concurrent() bool {
+	return true
+}
+
+func (s *shardedStore) Set(key string, value string, expires time.Time) {
+	shard := s.shard(key)
+	shard.lock.Lock()
+	shard.data.Set(key, value, expires)
+	shard.lock.Unlock()
+}
+
+func (s *shardedStore) Get(key string, now time.Time) (string, bool) {
+	value, _, ok := s.Lookup(key, now)
+	return value, ok
+}
+
+// Lookup leaves expired keys to the sweep, so reads never take the write
+// lock
+func (s *shardedStore) Lookup(key string, now time.Time) (string, time.Time, bool) {
+	shard := s.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	e, ok := shard.data.data[key]
+	if !ok || e.expired(now) {
+		return "", time.Time{}, false
+	}
+	return e.value, e.expires, true
+}
+
+func (s *shardedStore) Remove(key string) {
+	shard := s.shard(key)
+	shard.lock.Lock()
+	shard.data.Remove(key)
+	shard.lock.Unlock()
+}
+
+func (s *shardedStore) ClearPrefix(prefix string) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		shard.data.ClearPrefix(prefix)
+		shard.lock.Unlock()
+	}
+}
+
+func (s *shardedStore) Len() int {
+	n := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		n += shard.data.Len()
+		shard.lock.RUnlock()
+	}
+	return n
+}
+
+func (s *shardedStore) Sweep(now time.Time) int {
+	removed := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		removed += shard.data.Sweep(now)
+		shard.lock.Unlock()
+	}
+	return removed
+}
+
+func (s *shardedStore) Range(now time.Time, yield func(key string, value string, expires time.Time) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		more := true
+		shard.lock.RLock()
+		shard.data.Range(now, func(key string, value string, expires time.Time) bool {
+			more = yield(key, value, expires)
+			return more
+		})
+		shard.lock.RUnlock()
+		if !more {
+			return
+		}
+	}
+}
+
+// Keys takes the write locks as listing sorts the keys written since the
+// last one
+func (s *shardedStore) Keys(prefix string, after string, limit int, now time.Time) []string {
+	keys := []string{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		keys = append(keys, shard.data.Keys(prefix, after, limit, now)...)
+		shard.lock.Unlock()
+	}
+	slices.Sort(keys)
+	return keys[:min(len(keys), limit)]
+}
@@ -0,0 +1,179 @@
+package db_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/db"
+	"github.com/wizzymore/tcp-go/servertest"
+)
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+	stores := map[string]func() db.Store{
+		"map":     db.NewMapStore,
+		"sharded": func() db.Store { return db.NewShardedStore(4) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+			now := time.Now()
+			s.Set("a/1", "1", time.Time{})
+			s.Set("a/2", "2", now.Add(time.Minute))
+			s.Set("b/1", "3", now.Add(-time.Second))
+
+			value, ok := s.Get("a/1", now)
+			assert.True(t, ok)
+			assert.Equal(t, "1", value)
+			_, ok = s.Get("b/1", now)
+			assert.False(t, ok, "Expired keys should read as unset")
+
+			seen := map[string]string{}
+			s.Range(now, func(key string, value string, expires time.Time) bool {
+				seen[key] = value
+				return true
+			})
+			assert.Equal(t, map[string]string{"a/1": "1", "a/2": "2"}, seen)
+
+			// The map store already removed the expired key it read
+			assert.NotZero(t, s.Sweep(now.Add(time.Hour)))
+			assert.Equal(t, 1, s.Len())
+
+			s.Set("a/3", "3", time.Time{})
+			s.Set("c", "4", time.Time{})
+			s.Set("a/0", "0", now.Add(-time.Second))
+			assert.Equal(t, []string{"a/1", "a/3"}, s.Keys("a/", "", 10, now))
+			assert.Equal(t, []string{"a/3", "c"}, s.Keys("", "a/1", 10, now))
+			assert.Equal(t, []string{"a/1"}, s.Keys("", "", 1, now))
+			s.ClearPrefix("a/")
+			assert.Equal(t, 1, s.Len())
+			s.ClearPrefix("")
+			assert.Equal(t, 0, s.Len())
+		})
+	}
+}
+
+func TestStoreKeys(t *testing.T) {
+	t.Parallel()
+	for name, s := range map[string]db.Store{"map": db.NewMapStore(), "sharded": db.NewShardedStore(4)} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			// Enough churn to rebuild the index between listings
+			for round := range 3 {
+				for i := range 2 * db.INDEX_SLACK {
+					s.Set(fmt.Sprintf("k/%05d", i), strconv.Itoa(round), time.Time{})
+				}
+				for i := range 2 * db.INDEX_SLACK {
+					if i%2 == 1 {
+						s.Remove(fmt.Sprintf("k/%05d", i))
+					}
+				}
+			}
+
+			listed := []string{}
+			after := ""
+			for {
+				keys := s.Keys("k/", after, 100, now)
+				if len(keys) == 0 {
+					break
+				}
+				listed = append(listed, keys...)
+				after = keys[len(keys)-1]
+			}
+			require.Len(t, listed, db.INDEX_SLACK)
+			for i, key := range listed {
+				assert.Equal(t, fmt.Sprintf("k/%05d", 2*i), key)
+			}
+		})
+	}
+}
+
+func TestShardedReads(t *testing.T) {
+	t.Parallel()
+	s := newDB(t, db.Options{Shards: 8, TTLSuffix: ";ttl="})
+	addr := servertest.Start(t, s)
+
+	t.Run("reads its own writes", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		for i := range 100 {
+			value := strconv.Itoa(i)
+			client.Send("key="+value, "key")
+			client.Expect("key=" + value)
+		}
+		client.Send("delete", "key")
+		client.Expect("key=")
+	})
+
+	t.Run("expires keys", func(t *testing.T) {
+		client := servertest.DialUDP(t, addr)
+		client.Send("flag=on;ttl=100ms", "flag")
+		client.Expect("flag=on")
+		time.Sleep(time.Millisecond * 150)
+		client.Send("flag")
+		client.Expect("flag=")
+	})
+
+	t.Run("reads in process", func(t *testing.T) {
+		s.Set("local", "1")
+		assert.Equal(t, "1", s.Get("local"))
+		client := servertest.DialUDP(t, addr)
+		client.Send("local")
+		client.Expect("local=1")
+	})
+}
+
+const benchmarkKeys = 10_000
+
+// benchmarkDB compares reading through the database goroutine to reading
+// the sharded store directly, with writeEvery of the operations being writes
+// when not zero
+func benchmarkDB(b *testing.B, writeEvery int) {
+	designs := []struct {
+		name    string
+		options db.Options
+	}{
+		{"actor", db.Options{}},
+		{"sharded", db.Options{Shards: db.DEFAULT_SHARDS}},
+	}
+	for _, design := range designs {
+		b.Run(design.name, func(b *testing.B) {
+			design.options.Addr = servertest.ADDR
+			s, err := db.NewDbServer(design.options)
+			require.NoError(b, err)
+			server := s.(*db.DbServer)
+			defer server.Stop()
+
+			keys := make([]string, benchmarkKeys)
+			for i := range keys {
+				keys[i] = "key-" + strconv.Itoa(i)
+				server.Set(keys[i], strconv.Itoa(i))
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if writeEvery > 0 && i%writeEvery == 0 {
+						server.Set(key, "updated")
+					} else {
+						server.Get(key)
+					}
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkDB(b, 0)
+}
+
+func BenchmarkReadWrite(b *testing.B) {
+	benchmarkDB(b, 10)
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const DEFAULT_WATCH_TTL = time.Minute
+const DEFAULT_MAX_WATCHES = 16
+
+var errTooManyWatches = errors.New("too many watches")
+
+// WatchEvent adds or removes the watches of a client on keys, or on key
+// prefixes when prefix is set, out gets the number of watches the client
+// holds afterwards
+type WatchEvent struct {
+	client *server.UDPClient
+	// namespace is stripped from the keys pushed to the client
+	namespace string
+	keys      []string
+	prefix    bool
+	remove    bool
+	out       chan watchResult
+}
+
+type watchResult struct {
+	count int
+	err   error
+}
+
+type watch struct {
+	client    *server.UDPClient
+	namespace string
+	expires   time.Time
+}
+
+// watchList pushes "key=value" datagrams to the clients watching a key when
+// it is written, from the socket the client watched through. Watches expire unless they are renewed by watching again.
+// It is only used from the startServer goroutine.
+type watchList struct {
+	ttl time.Duration
+	max int
+	// keys and prefixes map a stored key or prefix to its watches by client
+	// address
+	keys     map[string]map[string]*watch
+	prefixes map[string]map[string]*watch
+	counts   map[string]int
+}
+
+func newWatchList(ttl time.Duration, max int) *watchList {
+	return &watchList{
+		ttl:      ttl,
+		max:      max,
+		keys:     make(map[string]map[string]*watch),
+		prefixes: make(map[string]map[string]*watch),
+		counts:   make(map[string]int),
+	}
+}
+
+func (w *watchList) handle(m WatchEvent, now time.Time) watchResult {
+	watches := w.keys
+	if m.prefix {
+		watches = w.prefixes
+	}
+	client := m.client.RemoteAddr().String()
+
+	if m.remove {
+		for _, key := range m.keys {
+			w.remove(watches, key, client)
+		}
+		return watchResult{count: w.counts[client]}
+	}
+
+	added := 0
+	for _, key := range m.keys {
+		if _, ok := watches[key][client]; !ok {
+			added++
+		}
+	}
+	if w.counts[client]+added > w.max {
+		return watchResult{count: w.counts[client], err: errTooManyWatches}
+	}
+
+	for _, key := range m.keys {
+		if watches[key] == nil {
+			watches[key] = make(map[string]*watch)
+		}
+		if _, ok := watches[key][client]; !ok {
+			w.counts[client]++
+		}
+		watches[key][client] = &watch{m.client, m.namespace, now.Add(w.ttl)}
+	}
+	return watchResult{count: w.counts[client]}
+}
+
+func (w *watchList) remove(watches map[string]map[string]*watch, key string, client string) {
+	if _, ok := watches[key][client]; !ok {
+		return
+	}
+	delete(watches[key], client)
+	if len(watches[key]) == 0 {
+		delete(watches, key)
+	}
+	w.counts[client]--
+	if w.counts[client] == 0 {
+		delete(w.counts, client)
+	}
+}
+
+// notify pushes the new value of key to its watchers
+func (w *watchList) notify(key string, value string, now time.Time) {
+	for _, watch := range w.keys[key] {
+		w.push(watch, key, value, now)
+	}
+	for prefix, watches := range w.prefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, watch := range watches {
+			w.push(watch, key, value, now)
+		}
+	}
+}
+
+func (w *watchList) push(watch *watch, key string, value string, now time.Time) {
+	if !now.Before(watch.expires) {
+		return
+	}
+	payload := strings.TrimPrefix(key, watch.namespace) + "=" + value
+	if len(payload) > server.MAX_DATAGRAM_SIZE {
+		return
+	}
+	if err := watch.client.Write([]byte(payload)); err != nil {
+		log.Debug().Err(err).Stringer("addr", watch.client.RemoteAddr()).Msg("Could not push a watched key")
+	}
+}
+
+// expire removes the watches that were not renewed in time
+func (w *watchList) expire(now time.Time) {
+	for _, watches := range []map[string]map[string]*watch{w.keys, w.prefixes} {
+		for key, clients := range watches {
+			for client, watch := range clients {
+				if !now.Before(watch.expires) {
+					w.remove(watches, key, client)
+				}
+			}
+		}
+	}
+}
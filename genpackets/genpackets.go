@@ -15,15 +15,28 @@ import (
 
 var fileFlag = flag.String("file", "", "File to generate types for")
 var typesFlag = flag.String("types", "", "Types to take in consdieration. Ex: Packet1,Packet2")
+var lengthsFlag = flag.String("lengths", "u8", "Type of the length prefix of strings and slices: u8 or u32")
+
+var numberTypes = []string{"int64", "int32", "int16", "int8", "uint64", "uint32", "uint16", "uint8"}
 
 type Field struct {
 	Name string
 	Type string
+	// Kind is string, number, numbers or structs for slices of structs of
+	// the file, empty when the type is not supported
+	Kind string
+	// Elem is the element type of a slice
+	Elem string
+	// Length is the type of the length prefix of strings and slices
+	Length string
 }
 
 type StructInfo struct {
 	Name   string
 	Fields []Field
+	// Packet is set for the structs with an Opcode method, the others are
+	// only marshalled as elements of a slice
+	Packet bool
 }
 
 func main() {
@@ -32,6 +45,10 @@ func main() {
 		flag.Usage()
 		return
 	}
+	lengthType := map[string]string{"u8": "uint8", "u32": "uint32"}[*lengthsFlag]
+	if lengthType == "" {
+		log.Fatalf("unsupported length prefix %s", *lengthsFlag)
+	}
 	types := []string{}
 	for t := range strings.SplitSeq(*typesFlag, ",") {
 		ty := strings.TrimSpace(t)
@@ -46,6 +63,17 @@ func main() {
 	}
 
 	var structs []StructInfo
+	packets := map[string]bool{}
+
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv != nil && fn.Name.Name == "Opcode" {
+			recv := fn.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			packets[exprToString(recv)] = true
+		}
+	}
 
 	for _, decl := range file.Decls {
 		genDecl, ok := decl.(*ast.GenDecl)
@@ -78,8 +106,9 @@ func main() {
 			for _, field := range s.Fields.List {
 				for _, name := range field.Names {
 					structInfo.Fields = append(structInfo.Fields, Field{
-						Name: name.Name,
-						Type: exprToString(field.Type),
+						Name:   name.Name,
+						Type:   exprToString(field.Type),
+						Length: lengthType,
 					})
 				}
 			}
@@ -88,6 +117,28 @@ func main() {
 		}
 	}
 
+	names := map[string]bool{}
+	for i := range structs {
+		structs[i].Packet = packets[structs[i].Name]
+		names[structs[i].Name] = true
+	}
+	for _, s := range structs {
+		for i := range s.Fields {
+			f := &s.Fields[i]
+			elem, isSlice := strings.CutPrefix(f.Type, "[]")
+			switch {
+			case f.Type == "string":
+				f.Kind = "string"
+			case slices.Contains(numberTypes, f.Type):
+				f.Kind = "number"
+			case isSlice && slices.Contains(numberTypes, elem):
+				f.Kind, f.Elem = "numbers", elem
+			case isSlice && names[elem]:
+				f.Kind, f.Elem = "structs", elem
+			}
+		}
+	}
+
 	out, _ := os.Create(fmt.Sprintf("%s_gen.go", (*fileFlag)[0:len(*fileFlag)-3]))
 	defer out.Close()
 	tmpl.Execute(out, map[string]any{"structs": structs, "package": file.Name})
@@ -108,49 +159,36 @@ func exprToString(expr ast.Expr) string {
 	}
 }
 
-var tmpl = template.Must(template.New("").Parse(`// Code generated by genpacket.go. DO NOT EDIT.
-
-package {{.package}}
-
-import (
-	"bytes"
-	"encoding/binary"
-	"io"
-
-	"github.com/wizzymore/tcp-go/reader"
-)
-{{range .structs}}
-func (p *{{.Name}}) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
-	err = buff.WriteByte(p.Opcode())
-	if err != nil {
-		return
-	}
-{{range .Fields}}
-	{{- if eq .Type "string"}}
+var tmpl = template.Must(template.New("").Parse(`{{define "marshalLength"}}
+	{{- if eq .Length "uint32"}}
+	err = binary.Write(buff, binary.BigEndian, uint32(len(p.{{.Name}})))
+	{{- else}}
 	err = buff.WriteByte(byte(len(p.{{.Name}})))
+	{{- end}}
 	if err != nil {
 		return
 	}
-	n, err := buff.WriteString(p.{{.Name}})
-	if err != nil {
-		return
-	}
-	if n != len(p.{{.Name}}) {
-		err = io.ErrUnexpectedEOF
-		return
-	}
-	{{- else if or (eq .Type "[]int64") (eq .Type "[]int32") (eq .Type "[]int16") (eq .Type "[]int8") (eq .Type "[]uint64") (eq .Type "[]uint32") (eq .Type "[]uint16") (eq .Type "[]uint8")}}
-	err = buff.WriteByte(byte(len(p.{{.Name}})))
+{{- end}}{{define "marshalFields"}}
+{{- range .Fields}}
+	{{- if eq .Kind "string"}}
+	{{- template "marshalLength" .}}
+	buff.WriteString(p.{{.Name}})
+	{{- else if eq .Kind "numbers"}}
+	{{- template "marshalLength" .}}
+	err = binary.Write(buff, binary.BigEndian, p.{{.Name}})
 	if err != nil {
 		return
 	}
-	err = binary.Write(&buff, binary.BigEndian, p.{{.Name}})
-	if err != nil {
-		return
+	{{- else if eq .Kind "structs"}}
+	{{- template "marshalLength" .}}
+	for i := range p.{{.Name}} {
+		err = p.{{.Name}}[i].marshal(buff)
+		if err != nil {
+			return
+		}
 	}
-	{{- else if or (eq .Type "int64") (eq .Type "int32") (eq .Type "int16") (eq .Type "int8") (eq .Type "uint64") (eq .Type "uint32") (eq .Type "uint16") (eq .Type "uint8")}}
-	err = binary.Write(&buff, binary.BigEndian, p.{{.Name}})
+	{{- else if eq .Kind "number"}}
+	err = binary.Write(buff, binary.BigEndian, p.{{.Name}})
 	if err != nil {
 		return
 	}
@@ -158,40 +196,48 @@ func (p *{{.Name}}) Marshal() (b []byte, err error) {
 	panic("Provided unsupported type {{.Type}} for {{.Name}}")
 	{{- end}}
 {{end}}
-	b = buff.Bytes()
-	return
-}
-
-func (p *{{.Name}}) Unmarshal(r io.Reader) (err error) {
-{{range .Fields}} {{- if eq .Type "string"}}
+{{- end}}{{define "unmarshalFields"}}
+{{- range .Fields}}
+	{{- if eq .Kind "string"}}
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length {{.Length}}
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
 		var buf []byte
-		buf, err = reader.ReadN(r, int(length))
+		buf, err = io.ReadAll(io.LimitReader(r, int64(length)))
 		if err != nil {
 			return
 		}
+		if len(buf) != int(length) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
 		p.{{.Name}} = string(buf)
 	}
-	{{- else if or (eq .Type "[]int64") (eq .Type "[]int32") (eq .Type "[]int16") (eq .Type "[]int8") (eq .Type "[]uint64") (eq .Type "[]uint32") (eq .Type "[]uint16") (eq .Type "[]uint8")}}
+	{{- else if or (eq .Kind "numbers") (eq .Kind "structs")}}
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length {{.Length}}
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
-		buf := make([]uint16, length)
-		err = reader.ReadB(r, buf)
-		if err != nil {
-			return
+		p.{{.Name}} = {{.Type}}{}
+		for range length {
+			var elem {{.Elem}}
+			{{- if eq .Kind "numbers"}}
+			err = reader.ReadB(r, &elem)
+			{{- else}}
+			err = elem.unmarshal(r)
+			{{- end}}
+			if err != nil {
+				return
+			}
+			p.{{.Name}} = append(p.{{.Name}}, elem)
 		}
-		p.{{.Name}} = buf
 	}
-	{{- else if or (eq .Type "int64") (eq .Type "int32") (eq .Type "int16") (eq .Type "int8") (eq .Type "uint64") (eq .Type "uint32") (eq .Type "uint16") (eq .Type "uint8")}}
+	{{- else if eq .Kind "number"}}
 	err = reader.ReadB(r, &p.{{.Name}})
 	if err != nil {
 		return
@@ -200,6 +246,43 @@ func (p *{{.Name}}) Unmarshal(r io.Reader) (err error) {
 	panic("Provided unsupported type {{.Type}} for {{.Name}}")
 	{{- end}}
 {{end}}
+{{- end}}// Code generated by genpacket.go. DO NOT EDIT.
+
+package {{.package}}
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/wizzymore/tcp-go/reader"
+)
+{{range .structs}}
+{{- if .Packet}}
+func (p *{{.Name}}) Marshal() (b []byte, err error) {
+	buff := &bytes.Buffer{}
+	err = buff.WriteByte(p.Opcode())
+	if err != nil {
+		return
+	}
+{{template "marshalFields" .}}
+	b = buff.Bytes()
 	return
 }
-{{end}}`))
+
+func (p *{{.Name}}) Unmarshal(r io.Reader) (err error) {
+{{- template "unmarshalFields" .}}
+	return
+}
+{{else}}
+func (p *{{.Name}}) marshal(buff *bytes.Buffer) (err error) {
+{{- template "marshalFields" .}}
+	return
+}
+
+func (p *{{.Name}}) unmarshal(r io.Reader) (err error) {
+{{- template "unmarshalFields" .}}
+	return
+}
+{{end}}
+{{- end}}`))
@@ -0,0 +1,170 @@
+package isl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Cipher spec operations, a spec is a list of operations ended by
+// CIPHER_END. xor and add are followed by their operand byte.
+const (
+	CIPHER_END         byte = 0x00
+	CIPHER_REVERSEBITS byte = 0x01
+	CIPHER_XOR         byte = 0x02
+	CIPHER_XORPOS      byte = 0x03
+	CIPHER_ADD         byte = 0x04
+	CIPHER_ADDPOS      byte = 0x05
+)
+
+// MAX_CIPHER_SPEC is the longest spec accepted, its end included
+const MAX_CIPHER_SPEC = 80
+
+var ErrNoopCipher = errors.New("cipher leaves every byte unchanged")
+
+type operation struct {
+	op      byte
+	operand byte
+}
+
+// Cipher obfuscates a stream byte by byte, the result depending on the
+// position of the byte in the stream
+type Cipher []operation
+
+// ReadCipher reads a spec up to its end
+func ReadCipher(r io.ByteReader) (Cipher, error) {
+	cipher := Cipher{}
+	size := 0
+	next := func() (byte, error) {
+		size++
+		if size > MAX_CIPHER_SPEC {
+			return 0, errors.New("cipher spec too long")
+		}
+		return r.ReadByte()
+	}
+
+	for {
+		op, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case CIPHER_END:
+			return cipher, nil
+		case CIPHER_REVERSEBITS, CIPHER_XORPOS, CIPHER_ADDPOS:
+			cipher = append(cipher, operation{op: op})
+		case CIPHER_XOR, CIPHER_ADD:
+			operand, err := next()
+			if err != nil {
+				return nil, err
+			}
+			cipher = append(cipher, operation{op, operand})
+		default:
+			return nil, fmt.Errorf("unknown cipher operation 0x%02x", op)
+		}
+	}
+}
+
+// Spec encodes the cipher as read by ReadCipher
+func (c Cipher) Spec() []byte {
+	spec := []byte{}
+	for _, o := range c {
+		spec = append(spec, o.op)
+		if o.op == CIPHER_XOR || o.op == CIPHER_ADD {
+			spec = append(spec, o.operand)
+		}
+	}
+	return append(spec, CIPHER_END)
+}
+
+func (c Cipher) encode(b byte, pos int) byte {
+	for _, o := range c {
+		switch o.op {
+		case CIPHER_REVERSEBITS:
+			b = bits.Reverse8(b)
+		case CIPHER_XOR:
+			b ^= o.operand
+		case CIPHER_XORPOS:
+			b ^= byte(pos)
+		case CIPHER_ADD:
+			b += o.operand
+		case CIPHER_ADDPOS:
+			b += byte(pos)
+		}
+	}
+	return b
+}
+
+func (c Cipher) decode(b byte, pos int) byte {
+	for i := len(c) - 1; i >= 0; i-- {
+		switch o := c[i]; o.op {
+		case CIPHER_REVERSEBITS:
+			b = bits.Reverse8(b)
+		case CIPHER_XOR:
+			b ^= o.operand
+		case CIPHER_XORPOS:
+			b ^= byte(pos)
+		case CIPHER_ADD:
+			b -= o.operand
+		case CIPHER_ADDPOS:
+			b -= byte(pos)
+		}
+	}
+	return b
+}
+
+// Noop reports if the cipher leaves every byte unchanged, positions only
+// matter modulo 256
+func (c Cipher) Noop() bool {
+	for pos := range 256 {
+		for b := range 256 {
+			if c.encode(byte(b), pos) != byte(b) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Reader decodes a stream, pos counts the bytes read so far
+type Reader struct {
+	r      io.Reader
+	cipher Cipher
+	pos    int
+}
+
+func (c Cipher) NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, cipher: c}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := range p[:n] {
+		p[i] = r.cipher.decode(p[i], r.pos)
+		r.pos++
+	}
+	return n, err
+}
+
+// Writer encodes a stream, pos counts the bytes written so far
+type Writer struct {
+	w      io.Writer
+	cipher Cipher
+	pos    int
+	buf    []byte
+}
+
+func (c Cipher) NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, cipher: c}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for i, b := range p {
+		w.buf = append(w.buf, w.cipher.encode(b, w.pos+i))
+	}
+	n, err := w.w.Write(w.buf)
+	w.pos += n
+	return n, err
+}
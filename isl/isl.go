@@ -0,0 +1,65 @@
+package isl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// MAX_LINE_LENGTH is the longest request line a client may send
+const MAX_LINE_LENGTH = 5000
+
+// Handler negotiates the cipher of the client, then answers every line of
+// toys with the one it has the most copies of, ex: "10x toy car,15x dog"
+// gets "15x dog"
+func Handler(c *server.TCPClient) error {
+	raw := bufio.NewReader(c)
+	cipher, err := ReadCipher(raw)
+	if err != nil {
+		return fmt.Errorf("invalid cipher spec: %w", err)
+	}
+	if cipher.Noop() {
+		return ErrNoopCipher
+	}
+	c.Logger.Debug().Hex("cipher", cipher.Spec()).Msg("Negotiated cipher")
+
+	r := bufio.NewReaderSize(cipher.NewReader(raw), MAX_LINE_LENGTH+1)
+	w := cipher.NewWriter(c)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		toy, err := mostCopies(string(line[:len(line)-1]))
+		if err != nil {
+			return err
+		}
+		c.Logger.Debug().Str("toy", toy).Msg("Answered request")
+		if _, err := w.Write([]byte(toy + "\n")); err != nil {
+			return err
+		}
+	}
+}
+
+func mostCopies(request string) (string, error) {
+	best, bestCount := "", -1
+	for toy := range strings.SplitSeq(request, ",") {
+		count, _, ok := strings.Cut(toy, "x ")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil {
+			return "", fmt.Errorf("invalid toy `%s`", toy)
+		}
+		if n > bestCount {
+			best, bestCount = toy, n
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,133 @@
+package isl_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/isl"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+func cipher(t *testing.T, spec ...byte) isl.Cipher {
+	c, err := isl.ReadCipher(bytes.NewReader(spec))
+	require.NoError(t, err, "Could not read cipher spec")
+	return c
+}
+
+func TestCipher(t *testing.T) {
+	t.Run("encodes with the position of each byte", func(t *testing.T) {
+		for _, test := range []struct {
+			spec     []byte
+			expected []byte
+		}{
+			{[]byte{0x02, 0x01, 0x01, 0x00}, []byte{0x96, 0x26, 0xb6, 0xb6, 0x76}},
+			{[]byte{0x05, 0x05, 0x00}, []byte{0x68, 0x67, 0x70, 0x72, 0x77}},
+		} {
+			var out bytes.Buffer
+			c := cipher(t, test.spec...)
+			w := c.NewWriter(&out)
+			_, err := w.Write([]byte("hel"))
+			require.NoError(t, err)
+			_, err = w.Write([]byte("lo"))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, out.Bytes())
+
+			decoded, err := io.ReadAll(c.NewReader(bytes.NewReader(test.expected)))
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(decoded))
+		}
+	})
+
+	t.Run("detects no-op ciphers", func(t *testing.T) {
+		assert.True(t, cipher(t, 0x00).Noop())
+		assert.True(t, cipher(t, 0x02, 0x00, 0x00).Noop())
+		assert.True(t, cipher(t, 0x02, 0xab, 0x02, 0xab, 0x00).Noop())
+		assert.True(t, cipher(t, 0x01, 0x01, 0x00).Noop())
+		assert.True(t, cipher(t, 0x02, 0xa0, 0x02, 0x0b, 0x02, 0xab, 0x00).Noop())
+		assert.True(t, cipher(t, 0x03, 0x03, 0x04, 0x00, 0x00).Noop())
+		assert.False(t, cipher(t, 0x03, 0x00).Noop())
+		assert.False(t, cipher(t, 0x05, 0x05, 0x05, 0x00).Noop())
+	})
+
+	t.Run("rejects invalid specs", func(t *testing.T) {
+		for _, spec := range [][]byte{
+			{0x06, 0x00},
+			{0x02},
+			{0x01},
+			bytes.Repeat([]byte{0x01}, isl.MAX_CIPHER_SPEC),
+		} {
+			_, err := isl.ReadCipher(bytes.NewReader(spec))
+			assert.Error(t, err, "Spec %x should be rejected", spec)
+		}
+	})
+}
+
+func TestISL(t *testing.T) {
+	s, err := server.NewTCPServer(isl.Handler, "127.0.0.1:0")
+	require.NoError(t, err, "Could not create isl server")
+	go s.Start()
+	defer s.Stop()
+
+	dial := func(t *testing.T) net.Conn {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err, "Could not connect to isl server")
+		conn.SetDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	t.Run("answers requests with the cipher", func(t *testing.T) {
+		conn := dial(t)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte{0x02, 0x7b, 0x05, 0x01, 0x00})
+		require.NoError(t, err)
+		_, err = conn.Write([]byte{0xf2, 0x20, 0xba, 0x44, 0x18, 0x84, 0xba, 0xaa, 0xd0, 0x26, 0x44, 0xa4, 0xa8, 0x7e})
+		require.NoError(t, err)
+		response := make([]byte, 7)
+		_, err = io.ReadFull(conn, response)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x72, 0x20, 0xba, 0xd8, 0x78, 0x70, 0xee}, response)
+
+		_, err = conn.Write([]byte{0x6a, 0x48, 0xd6, 0x58, 0x34, 0x44, 0xd6, 0x7a, 0x98, 0x4e, 0x0c, 0xcc, 0x94, 0x31})
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, response)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xf2, 0xd0, 0x26, 0xc8, 0xa4, 0xd8, 0x7e}, response)
+	})
+
+	t.Run("serves clients with their own cipher", func(t *testing.T) {
+		conn := dial(t)
+		defer conn.Close()
+
+		c := cipher(t, 0x04, 0x10, 0x03, 0x00)
+		conn.Write(c.Spec())
+		w := c.NewWriter(conn)
+		r := bufio.NewReader(c.NewReader(conn))
+		for _, test := range [][2]string{
+			{"3x rat,10x car,9x dog on a string\n", "10x car\n"},
+			{"1x cat\n", "1x cat\n"},
+		} {
+			_, err := w.Write([]byte(test[0]))
+			require.NoError(t, err)
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, test[1], line)
+		}
+	})
+
+	t.Run("disconnects no-op ciphers", func(t *testing.T) {
+		conn := dial(t)
+		defer conn.Close()
+
+		conn.Write([]byte{0x02, 0xaa, 0x02, 0xaa, 0x00})
+		conn.Write([]byte("1x cat\n"))
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
@@ -1,16 +1,14 @@
 package jobcentre
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
-	"io"
 	"net"
 	"slices"
 	"sync"
 
 	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/jsonlines"
 	"github.com/wizzymore/tcp-go/server"
 )
 
@@ -36,29 +34,17 @@ type ErrorResponse struct {
 	Error  string `json:"error,omitempty"`
 }
 
-func WriteResponse(client *server.TCPClient, res any) error {
-	data, err := json.Marshal(&res)
-
-	if err != nil {
-		return err
-	}
-
-	data = append(data, '\n')
-	n, err := client.Write(data)
-	if err != nil {
+func writeResponse(client *jsonlines.Conn, res any) error {
+	if err := client.Reply(res); err != nil {
 		return err
 	}
 
-	if len(data) != n {
-		return io.ErrUnexpectedEOF
-	}
-
 	client.Logger.Debug().Any("res", res).Msg("sent new response to client")
 
 	return nil
 }
 
-func WriteStatus(client *server.TCPClient, statusType StatusType, message string) error {
+func writeStatus(client *jsonlines.Conn, statusType StatusType, message string) error {
 	var status string
 	switch statusType {
 	case STATUS_OK:
@@ -72,28 +58,15 @@ func WriteStatus(client *server.TCPClient, statusType StatusType, message string
 		Status: status,
 		Error:  message,
 	}
-	data, err := json.Marshal(&er)
-	if err != nil {
-		return err
-	}
-	data = append(data, '\n')
-	n, err := client.Write(data)
-	if err != nil {
+	if err := client.Reply(&er); err != nil {
 		return err
 	}
-	if len(data) != n {
-		return io.ErrUnexpectedEOF
-	}
 
 	client.Logger.Debug().Any("res", er).Msg("sent new error message to client")
 
 	return nil
 }
 
-type Request struct {
-	Request string `json:"request"`
-}
-
 type GetRequest struct {
 	Queues []string `json:"queues"`
 	Wait   *bool    `json:"wait,omitempty"`
@@ -127,8 +100,10 @@ type DeleteRequest struct {
 }
 
 type message struct {
-	client  *server.TCPClient
+	client  *jsonlines.Conn
 	request any
+	// handled is closed once the response to request was sent, if any
+	handled chan struct{}
 }
 
 type disconnected struct{}
@@ -140,10 +115,21 @@ type JobCentreServer struct {
 	cancel_ctx context.CancelFunc
 	messages   chan message
 	wg         sync.WaitGroup
+	mux        *jsonlines.Mux
 }
 
 func NewJobCentreServer() (s server.Server, err error) {
 	jc := &JobCentreServer{}
+	// Numbers in jobs are kept as they were sent
+	jc.mux = jsonlines.NewMux(jsonlines.Options{
+		MethodField: "request",
+		UseNumber:   true,
+		Malformed:   malformed,
+	})
+	jsonlines.Handle(jc.mux, "put", request[PutRequest](jc))
+	jsonlines.Handle(jc.mux, "get", request[GetRequest](jc))
+	jsonlines.Handle(jc.mux, "abort", request[AbortRequest](jc))
+	jsonlines.Handle(jc.mux, "delete", request[DeleteRequest](jc))
 	jc.s, err = server.NewTCPServer(jc.handler)
 	jc.ctx, jc.cancel_ctx = context.WithCancel(context.Background())
 	jc.messages = make(chan message, 1024)
@@ -187,7 +173,7 @@ func (self *JobCentreServer) internal() error {
 
 	jobNextId := 1
 
-	clients := make(map[uint]*server.TCPClient)
+	clients := make(map[uint]*jsonlines.Conn)
 	waiters := []Waiter{}
 
 	queues := make(map[string][]*Job)
@@ -227,7 +213,7 @@ func (self *JobCentreServer) internal() error {
 									Id:     job.Id,
 								}
 
-								if err := WriteResponse(clients[waiter.ClientId], &res); err != nil {
+								if err := writeResponse(clients[waiter.ClientId], &res); err != nil {
 									if !errors.Is(err, net.ErrClosed) {
 										message.client.Logger.Err(err).Msg("could not write get response to waiter")
 									}
@@ -259,7 +245,7 @@ func (self *JobCentreServer) internal() error {
 					Id:     job.Id,
 				}
 
-				if err := WriteResponse(message.client, &res); err != nil {
+				if err := writeResponse(message.client, &res); err != nil {
 					if !errors.Is(err, net.ErrClosed) {
 						message.client.Logger.Err(err).Msg("could not write put response to client")
 					}
@@ -276,7 +262,7 @@ func (self *JobCentreServer) internal() error {
 							Id:     job.Id,
 						}
 
-						if err := WriteResponse(clients[waiter.ClientId], &res); err != nil {
+						if err := writeResponse(clients[waiter.ClientId], &res); err != nil {
 							if !errors.Is(err, net.ErrClosed) {
 								message.client.Logger.Err(err).Msg("could not write get response to waiter - 2")
 							}
@@ -303,7 +289,7 @@ func (self *JobCentreServer) internal() error {
 						})
 						break
 					}
-					WriteStatus(message.client, STATUS_NO_JOB, "")
+					writeStatus(message.client, STATUS_NO_JOB, "")
 					break
 				}
 
@@ -315,7 +301,7 @@ func (self *JobCentreServer) internal() error {
 					Id:     job.Id,
 				}
 
-				if err := WriteResponse(message.client, &res); err != nil {
+				if err := writeResponse(message.client, &res); err != nil {
 					if !errors.Is(err, net.ErrClosed) {
 						message.client.Logger.Err(err).Msg("could not write get response to client")
 					}
@@ -335,12 +321,12 @@ func (self *JobCentreServer) internal() error {
 					}
 				}
 				if job == nil || job.owner != message.client.Id {
-					WriteStatus(message.client, STATUS_NO_JOB, "")
+					writeStatus(message.client, STATUS_NO_JOB, "")
 					break
 				}
 
 				queues[job.Queue] = append(queues[job.Queue], job)
-				WriteStatus(message.client, STATUS_OK, "")
+				writeStatus(message.client, STATUS_OK, "")
 			case *DeleteRequest:
 				var job *Job
 				var idx int
@@ -352,7 +338,7 @@ func (self *JobCentreServer) internal() error {
 					}
 				}
 				if job == nil {
-					WriteStatus(message.client, STATUS_NO_JOB, "")
+					writeStatus(message.client, STATUS_NO_JOB, "")
 					break
 				}
 
@@ -363,75 +349,59 @@ func (self *JobCentreServer) internal() error {
 						queues[job.Queue] = append(queues[job.Queue][:idx], queues[job.Queue][idx+1:]...)
 					}
 				}
-				WriteStatus(message.client, STATUS_OK, "")
+				writeStatus(message.client, STATUS_OK, "")
+			}
+			if message.handled != nil {
+				close(message.handled)
 			}
 		}
 	}
 }
 
-func (self *JobCentreServer) handler(client *server.TCPClient) (err error) {
-	defer func(client *server.TCPClient) {
+func (self *JobCentreServer) handler(c *server.TCPClient) error {
+	client := self.mux.NewConn(c)
+	defer func(client *jsonlines.Conn) {
 		self.messages <- message{
 			client,
 			disconnected{},
+			nil,
 		}
 	}(client)
 
 	self.messages <- message{
 		client,
 		connected{},
+		nil,
 	}
 
-	reader := bufio.NewReader(client.Conn)
-	var data []byte
-	var request Request
-	for {
-		data, err = reader.ReadBytes('\n')
-		if err != nil {
-			return
-		}
-		err = json.Unmarshal(data, &request)
-		if err != nil {
-			if err = unknownRequest(client); err != nil {
-				return
-			}
-		}
-
-		var req any
-		switch request.Request {
-		case "put":
-			req = new(PutRequest)
-		case "get":
-			req = new(GetRequest)
-		case "abort":
-			req = new(AbortRequest)
-		case "delete":
-			req = new(DeleteRequest)
-		default:
-			if err = unknownRequest(client); err != nil {
-				return
-			}
-			continue
-		}
+	return self.mux.ServeConn(client)
+}
 
-		err = json.Unmarshal(data, req)
-		if err != nil {
-			if err = WriteStatus(client, STATUS_ERROR, "invalid put request"); err != nil {
-				return
-			}
+// request passes a request to the jobs handler, which replies to it. The next
+// request waits for it so the responses keep the order of the requests.
+func request[T any](self *JobCentreServer) func(client *jsonlines.Conn, req *T) (any, error) {
+	return func(client *jsonlines.Conn, req *T) (any, error) {
+		handled := make(chan struct{})
+		self.messages <- message{client, req, handled}
+		select {
+		case <-handled:
+		case <-self.ctx.Done():
 		}
-		client.Logger.Debug().
-			Any("request", req).
-			Type("request-type", req).
-			Msg("received a new request")
-		self.messages <- message{client, req}
+		return nil, nil
 	}
 }
 
-func unknownRequest(client *server.TCPClient) error {
-	return WriteStatus(client, STATUS_ERROR, UNKNOWN_ERROR)
+func malformed(err error) any {
+	text := err.Error()
+	if errors.Is(err, jsonlines.ErrMissingMethod) || errors.Is(err, jsonlines.ErrUnknownMethod) {
+		text = UNKNOWN_ERROR
+	}
+	return ErrorResponse{
+		Status: STATUS_ERROR_MESSAGE,
+		Error:  text,
+	}
 }
 
-func noJob(client *server.TCPClient) error {
-	return WriteStatus(client, STATUS_NO_JOB, UNKNOWN_ERROR)
+func noJob(client *jsonlines.Conn) error {
+	return writeStatus(client, STATUS_NO_JOB, UNKNOWN_ERROR)
 }
@@ -0,0 +1,206 @@
+package jsonlines
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// MAX_PIPELINED is the number of requests read ahead of the one being handled
+const MAX_PIPELINED = 64
+
+var ErrMissingMethod = errors.New("method was not provided")
+var ErrUnknownMethod = errors.New("unknown method")
+
+type Options struct {
+	// MethodField is the field of the requests naming their method, defaults
+	// to "method"
+	MethodField string
+	// DisallowUnknownFields rejects the requests with fields their type does
+	// not have, the method field included
+	DisallowUnknownFields bool
+	// UseNumber decodes the numbers of untyped fields as json.Number instead
+	// of float64
+	UseNumber bool
+	// MaxLineLength is the longest request, defaults to
+	// server.DEFAULT_MAX_LINE_LENGTH
+	MaxLineLength int
+	// Malformed is the response to a request that could not be decoded or
+	// handled, defaults to an ErrorResponse
+	Malformed func(err error) any
+	// DisconnectMalformed closes the connection after a malformed request
+	DisconnectMalformed bool
+}
+
+// ErrorResponse is the default response to malformed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Conn is a client sending one JSON request per line
+type Conn struct {
+	*server.TCPClient
+	lines *server.LineConn
+}
+
+// Reply sends v to the client right away, it is safe to call from any
+// goroutine to answer a request later
+func (c *Conn) Reply(v any) error {
+	if err := c.write(v); err != nil {
+		return err
+	}
+	return c.lines.Flush()
+}
+
+func (c *Conn) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.lines.WriteLine(string(data))
+}
+
+// method decodes a request and handles it, returning its response
+type method func(c *Conn, request []byte) (any, error)
+
+// Mux dispatches the requests of its clients to the handler of their method
+type Mux struct {
+	options Options
+	methods map[string]method
+}
+
+func NewMux(options ...Options) *Mux {
+	m := &Mux{methods: make(map[string]method)}
+	if len(options) > 0 {
+		m.options = options[0]
+	}
+	if m.options.MethodField == "" {
+		m.options.MethodField = "method"
+	}
+	if m.options.Malformed == nil {
+		m.options.Malformed = func(err error) any {
+			return ErrorResponse{err.Error()}
+		}
+	}
+	return m
+}
+
+// Handle registers the handler of the requests for method. A nil response is
+// not sent, the handler may Reply later instead. An error is answered with
+// the Malformed response.
+func Handle[T any](m *Mux, method string, handler func(c *Conn, request *T) (any, error)) {
+	m.methods[method] = func(c *Conn, data []byte) (any, error) {
+		request := new(T)
+		if err := m.decode(data, request); err != nil {
+			return nil, err
+		}
+		return handler(c, request)
+	}
+}
+
+func (m *Mux) decode(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if m.options.DisallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if m.options.UseNumber {
+		decoder.UseNumber()
+	}
+	return decoder.Decode(v)
+}
+
+// NewConn prepares c to be served, for servers keeping track of their
+// clients before ServeConn
+func (m *Mux) NewConn(c *server.TCPClient) *Conn {
+	return &Conn{c, server.NewLineConn(c, server.LineOptions{MaxLineLength: m.options.MaxLineLength})}
+}
+
+// Serve is a server.TCPHandle handling the requests of c
+func (m *Mux) Serve(c *server.TCPClient) error {
+	return m.ServeConn(m.NewConn(c))
+}
+
+// ServeConn handles the requests of c in order until it disconnects. The
+// next requests are read while one is handled, and responses are sent once
+// no request is waiting.
+func (m *Mux) ServeConn(c *Conn) error {
+	requests := make(chan []byte, MAX_PIPELINED)
+	done := make(chan struct{})
+	defer close(done)
+
+	var readErr error
+	go func() {
+		defer close(requests)
+		for {
+			line, err := c.lines.ReadLine()
+			if err != nil {
+				readErr = err
+				return
+			}
+			select {
+			case requests <- bytes.Clone(line):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for request := range requests {
+		if err := m.dispatch(c, request); err != nil {
+			c.lines.Flush()
+			return err
+		}
+		if len(requests) == 0 {
+			if err := c.lines.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if errors.Is(readErr, server.ErrLineTooLong) {
+		c.Logger.Warn().Msg("client sent a request that is too long")
+		c.Reply(m.options.Malformed(readErr))
+	}
+	return readErr
+}
+
+// dispatch handles request and writes its response, it only fails when the
+// client has to be disconnected
+func (m *Mux) dispatch(c *Conn, request []byte) error {
+	c.Logger.Debug().Bytes("request", request).Msg("received a new request")
+	response, err := m.handle(c, request)
+	if err != nil {
+		c.Logger.Debug().Err(err).Msg("client sent a malformed request")
+		if werr := c.write(m.options.Malformed(err)); werr != nil {
+			return werr
+		}
+		if m.options.DisconnectMalformed {
+			return err
+		}
+		return nil
+	}
+	if response == nil {
+		return nil
+	}
+	c.Logger.Debug().Any("response", response).Msg("sent a new response")
+	return c.write(response)
+}
+
+func (m *Mux) handle(c *Conn, request []byte) (any, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(request, &fields); err != nil {
+		return nil, err
+	}
+	var name string
+	if raw, ok := fields[m.options.MethodField]; !ok || json.Unmarshal(raw, &name) != nil {
+		return nil, ErrMissingMethod
+	}
+	method, ok := m.methods[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMethod, name)
+	}
+	return method(c, request)
+}
@@ -0,0 +1,192 @@
+package jsonlines_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/jsonlines"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+type echoRequest struct {
+	Method string `json:"method"`
+	Value  any    `json:"value"`
+}
+
+type echoResponse struct {
+	Value any    `json:"value"`
+	Type  string `json:"type"`
+}
+
+func echo(c *jsonlines.Conn, request *echoRequest) (any, error) {
+	if request.Value == nil {
+		return nil, errors.New("no value")
+	}
+	return echoResponse{request.Value, fmt.Sprintf("%T", request.Value)}, nil
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	done   chan error
+}
+
+// serve runs mux over an in memory connection
+func serve(t *testing.T, mux *jsonlines.Mux) *testClient {
+	local, remote := net.Pipe()
+	c := &testClient{local, bufio.NewReader(local), make(chan error, 1)}
+	go func() {
+		c.done <- mux.Serve(&server.TCPClient{Conn: remote, Logger: zerolog.Nop()})
+		remote.Close()
+	}()
+	t.Cleanup(func() { local.Close() })
+	return c
+}
+
+func (c *testClient) send(t *testing.T, lines ...string) {
+	_, err := c.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	require.NoError(t, err, "Could not write request")
+}
+
+// sendAsync writes while responses are read, the server may stop reading
+func (c *testClient) sendAsync(lines ...string) {
+	go c.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+func (c *testClient) expect(t *testing.T, responses ...string) {
+	for _, response := range responses {
+		c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		line, err := c.reader.ReadString('\n')
+		require.NoError(t, err, "Could not read response")
+		assert.JSONEq(t, response, line)
+	}
+}
+
+// expectError reads a response to a request the json package rejected, its
+// message depends on the go version
+func (c *testClient) expectError(t *testing.T) {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	line, err := c.reader.ReadString('\n')
+	require.NoError(t, err, "Could not read response")
+	var response jsonlines.ErrorResponse
+	require.NoError(t, json.Unmarshal([]byte(line), &response))
+	assert.NotEmpty(t, response.Error)
+}
+
+func (c *testClient) expectClosed(t *testing.T) error {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	_, err := c.reader.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF, "Connection should be closed")
+	return <-c.done
+}
+
+func TestMux(t *testing.T) {
+	mux := jsonlines.NewMux()
+	jsonlines.Handle(mux, "echo", echo)
+	c := serve(t, mux)
+
+	t.Run("dispatches on the method", func(t *testing.T) {
+		c.send(t, `{"method":"echo","value":"hi"}`)
+		c.expect(t, `{"value":"hi","type":"string"}`)
+	})
+
+	t.Run("answers malformed requests", func(t *testing.T) {
+		c.send(t,
+			`{"method":"nope"}`,
+			`{"value":1}`,
+			`{"method":1}`,
+			`{"method":"echo"`,
+			`{"method":"echo","value":1} {}`,
+			`[]`,
+			`{"method":"echo"}`,
+		)
+		c.expect(t,
+			`{"error":"unknown method: nope"}`,
+			`{"error":"method was not provided"}`,
+			`{"error":"method was not provided"}`,
+		)
+		for range 3 {
+			c.expectError(t)
+		}
+		c.expect(t, `{"error":"no value"}`)
+	})
+
+	t.Run("answers pipelined requests in order", func(t *testing.T) {
+		requests := []string{}
+		responses := []string{}
+		for i := range 2 * jsonlines.MAX_PIPELINED {
+			requests = append(requests, fmt.Sprintf(`{"method":"echo","value":"%d"}`, i))
+			responses = append(responses, fmt.Sprintf(`{"value":"%d","type":"string"}`, i))
+		}
+		c.sendAsync(requests...)
+		c.expect(t, responses...)
+	})
+
+	c.conn.Close()
+	assert.ErrorIs(t, <-c.done, io.EOF)
+}
+
+func TestMuxOptions(t *testing.T) {
+	t.Run("decodes strictly", func(t *testing.T) {
+		mux := jsonlines.NewMux(jsonlines.Options{DisallowUnknownFields: true, UseNumber: true})
+		jsonlines.Handle(mux, "echo", echo)
+		c := serve(t, mux)
+		c.send(t, `{"method":"echo","value":12345678901234567890}`, `{"method":"echo","value":1,"other":2}`)
+		c.expect(t, `{"value":12345678901234567890,"type":"json.Number"}`)
+		c.expectError(t)
+	})
+
+	t.Run("uses a method field", func(t *testing.T) {
+		mux := jsonlines.NewMux(jsonlines.Options{MethodField: "request"})
+		jsonlines.Handle(mux, "echo", echo)
+		c := serve(t, mux)
+		c.send(t, `{"request":"echo","value":true}`)
+		c.expect(t, `{"value":true,"type":"bool"}`)
+	})
+
+	t.Run("disconnects on malformed requests", func(t *testing.T) {
+		mux := jsonlines.NewMux(jsonlines.Options{
+			Malformed:           func(err error) any { return "bye" },
+			DisconnectMalformed: true,
+		})
+		jsonlines.Handle(mux, "echo", echo)
+		c := serve(t, mux)
+		c.send(t, `{"method":"echo","value":1}`, `{"method":"nope"}`, `{"method":"echo","value":1}`)
+		c.expect(t, `{"value":1,"type":"float64"}`, `"bye"`)
+		assert.ErrorIs(t, c.expectClosed(t), jsonlines.ErrUnknownMethod)
+	})
+
+	t.Run("disconnects on requests too long", func(t *testing.T) {
+		mux := jsonlines.NewMux(jsonlines.Options{MaxLineLength: 32})
+		jsonlines.Handle(mux, "echo", echo)
+		c := serve(t, mux)
+		c.sendAsync(`{"method":"echo","value":"` + strings.Repeat("a", 32) + `"}`)
+		c.expect(t, `{"error":"line too long"}`)
+		assert.ErrorIs(t, c.expectClosed(t), server.ErrLineTooLong)
+	})
+
+	t.Run("replies later", func(t *testing.T) {
+		mux := jsonlines.NewMux()
+		jsonlines.Handle(mux, "later", func(c *jsonlines.Conn, request *echoRequest) (any, error) {
+			go func() {
+				time.Sleep(time.Millisecond * 50)
+				c.Reply(echoResponse{request.Value, "later"})
+			}()
+			return nil, nil
+		})
+		jsonlines.Handle(mux, "echo", echo)
+		c := serve(t, mux)
+		c.send(t, `{"method":"later","value":1}`, `{"method":"echo","value":2}`)
+		c.expect(t, `{"value":2,"type":"float64"}`, `{"value":1,"type":"later"}`)
+	})
+}
@@ -0,0 +1,32 @@
+package linereversal
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// MAX_LINE_LENGTH is the longest line a client may send
+const MAX_LINE_LENGTH = 10_000
+
+// Handler sends every line back reversed, it runs over LRCP sessions
+func Handler(c *server.TCPClient) error {
+	r := bufio.NewReaderSize(c, MAX_LINE_LENGTH+1)
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		reversed := slices.Clone(line[:len(line)-1])
+		slices.Reverse(reversed)
+		if _, err := c.Write(append(reversed, '\n')); err != nil {
+			return err
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"maps"
@@ -9,22 +11,51 @@ import (
 	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/wizzymore/tcp-go/chat"
 	"github.com/wizzymore/tcp-go/db"
+	"github.com/wizzymore/tcp-go/isl"
 	"github.com/wizzymore/tcp-go/jobcentre"
+	"github.com/wizzymore/tcp-go/linereversal"
 	"github.com/wizzymore/tcp-go/means"
 	"github.com/wizzymore/tcp-go/mob"
+	"github.com/wizzymore/tcp-go/pest"
 	"github.com/wizzymore/tcp-go/primetime"
 	"github.com/wizzymore/tcp-go/server"
 	"github.com/wizzymore/tcp-go/smoke_test"
 	"github.com/wizzymore/tcp-go/traffic"
+	"github.com/wizzymore/tcp-go/vcs"
 )
 
 var logLevelFlag = flag.Int("log", int(zerolog.DebugLevel), "Set the log level: 0=debug, 1=info, 2=warn, 3=error, 4=fatal, 5=panic")
 var colorFlag = flag.Bool("nocolor", false, "Disable colored log output")
+var dbDataFlag = flag.String("db-data", "", "Directory to persist the db server to, empty to keep it in memory")
+var dbFsyncFlag = flag.String("db-fsync", "interval", "When to fsync the db log: always, interval or never")
+var dbSnapshotEveryFlag = flag.Int("db-snapshot-every", db.DEFAULT_SNAPSHOT_EVERY, "Number of db log records after which a snapshot is taken")
+var dbSnapshotIntervalFlag = flag.Duration("db-snapshot-interval", 5*time.Minute, "Interval at which a db snapshot is taken, 0 to disable")
+var dbTTLSuffixFlag = flag.String("db-ttl-suffix", "", "Value suffix setting a db key expiry (ex: ;ttl= for key=value;ttl=30), empty to disable")
+var dbACLFlag = flag.String("db-acl", "", "Db access rules (ex: 127.0.0.0/8,rw;10.0.0.0/8,rw,namespace=team;0.0.0.0/0,ro), empty to allow everyone")
+var dbDeleteFlag = flag.String("db-delete", "allow", "Policy of the db delete request without -db-acl: allow or deny")
+var dbReplicationFlag = flag.String("db-replication", "", "Address the db server accepts replicas on, empty to disable. Replicas must be allowed to read every key by -db-acl, keep it private")
+var dbPrimaryFlag = flag.String("db-primary", "", "Replication address of the primary the db server replicates, empty to disable")
+var dbShardsFlag = flag.Int("db-shards", 0, "Number of db store shards read concurrently by clients, 0 to read through a single goroutine")
+var dbWatchTTLFlag = flag.Duration("db-watch-ttl", db.DEFAULT_WATCH_TTL, "How long a db watch lasts unless renewed")
+var dbMaxWatchesFlag = flag.Int("db-max-watches", db.DEFAULT_MAX_WATCHES, "Number of keys and prefixes a db client may watch")
+var chatOperPasswordFlag = flag.String("chat-oper-password", "", "Password for chat operators, operators are disabled when empty")
+var chatMaxLineFlag = flag.Int("chat-max-line", chat.DEFAULT_MAX_LINE_LENGTH, "Longest line in bytes a chat client may send")
+var chatRateFlag = flag.Float64("chat-rate", 0, "Messages per second a chat client may send, 0 for unlimited")
+var chatBurstFlag = flag.Int("chat-burst", 5, "Messages a chat client may send back to back")
+var chatWebSocketFlag = flag.String("chat-ws", "", "Address of the chat WebSocket gateway and web client (ex: :8080), empty to disable")
+var chatIRCFlag = flag.String("chat-irc", "", "Address of the chat IRC listener (ex: :6667), empty to disable")
+var chatRoomFlag = flag.String("chat-room", chat.DEFAULT_ROOM, "Channel name of the chat room for IRC clients")
+var chatTranscriptFlag = flag.String("chat-transcript", "", "Directory to write the chat transcript to, empty to disable")
+var chatTranscriptSizeFlag = flag.Int64("chat-transcript-size", chat.DEFAULT_TRANSCRIPT_MAX_BYTES, "Size in bytes at which a new chat transcript file is started")
+var vcsDataFlag = flag.String("vcs-data", "", "Directory to store the vcs files in, empty to keep them in memory")
+var metricsFlag = flag.Duration("metrics", 0, "Interval at which the connection metrics of the test, prime-time, means and isl servers are logged, 0 to disable")
+var pestAuthorityFlag = flag.String("pest-authority", pest.DEFAULT_AUTHORITY_ADDR, "Address of the authority server of the pest control sites")
 
 func init() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
@@ -35,21 +66,265 @@ func init() {
 type ServerFunc func() (server.Server, error)
 
 var servers = map[string]ServerFunc{
-	"mob":        func() (server.Server, error) { return mob.NewMobServer() },
-	"db":         db.NewDbServer,
-	"chat":       chat.NewChatServer,
-	"test":       func() (server.Server, error) { return server.NewTCPServer(smoke_test.Handler) },
-	"prime-time": func() (server.Server, error) { return server.NewTCPServer(primetime.Handler) },
-	"means":      func() (server.Server, error) { return server.NewTCPServer(means.Handler) },
-	"traffic":    traffic.NewTrafficServer,
-	"jobs":       jobcentre.NewJobCentreServer,
+	"mob":           func() (server.Server, error) { return mob.NewMobServer() },
+	"db":            newDbServer,
+	"chat":          newChatServer,
+	"test":          func() (server.Server, error) { return server.NewTCPServer(smoke_test.Handler) },
+	"prime-time":    func() (server.Server, error) { return server.NewTCPServer(primetime.Handler) },
+	"means":         func() (server.Server, error) { return server.NewTCPServer(means.Handler) },
+	"traffic":       traffic.NewTrafficServer,
+	"isl":           func() (server.Server, error) { return server.NewTCPServer(isl.Handler) },
+	"vcs":           newVCSServer,
+	"pest":          newPestServer,
+	"jobs":          jobcentre.NewJobCentreServer,
+	"line-reversal": func() (server.Server, error) { return server.NewLRCPServer(linereversal.Handler, server.LRCPOptions{}) },
+}
+
+func newDbServer() (server.Server, error) {
+	fsync, err := db.ParseFsyncPolicy(*dbFsyncFlag)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := db.ParseAccessRules(*dbACLFlag)
+	if err != nil {
+		return nil, err
+	}
+	deletePolicy, err := db.ParseDeletePolicy(*dbDeleteFlag)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewDbServer(db.Options{
+		DataDir:          *dbDataFlag,
+		Fsync:            fsync,
+		SnapshotEvery:    *dbSnapshotEveryFlag,
+		SnapshotInterval: *dbSnapshotIntervalFlag,
+		TTLSuffix:        *dbTTLSuffixFlag,
+		Rules:            rules,
+		Delete:           deletePolicy,
+		ReplicationAddr:  *dbReplicationFlag,
+		PrimaryAddr:      *dbPrimaryFlag,
+		Shards:           *dbShardsFlag,
+		WatchTTL:         *dbWatchTTLFlag,
+		MaxWatches:       *dbMaxWatchesFlag,
+	})
+}
+
+func newChatServer() (server.Server, error) {
+	return chat.NewChatServer(chat.Options{
+		OperatorPassword:   *chatOperPasswordFlag,
+		MaxLineLength:      *chatMaxLineFlag,
+		MessageRate:        *chatRateFlag,
+		MessageBurst:       *chatBurstFlag,
+		WebSocketAddr:      *chatWebSocketFlag,
+		IRCAddr:            *chatIRCFlag,
+		Room:               *chatRoomFlag,
+		TranscriptDir:      *chatTranscriptFlag,
+		TranscriptMaxBytes: *chatTranscriptSizeFlag,
+	})
+}
+
+func newVCSServer() (server.Server, error) {
+	storage := vcs.NewMemoryStorage()
+	if *vcsDataFlag != "" {
+		var err error
+		if storage, err = vcs.NewDiskStorage(*vcsDataFlag); err != nil {
+			return nil, err
+		}
+	}
+	return vcs.NewVCSServer(storage)
+}
+
+func newPestServer() (server.Server, error) {
+	return pest.NewPestServer(pest.Options{AuthorityAddr: *pestAuthorityFlag})
+}
+
+// CommandFunc runs a command with the arguments following its name
+type CommandFunc func(args []string) error
+
+var commands = map[string]CommandFunc{
+	"chat search": chatSearch,
+	"db dump":     dbDump,
+	"db restore":  dbRestore,
+}
+
+// parseTime accepts a RFC3339 time or a duration to go back from now
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func chatSearch(args []string) error {
+	flags := flag.NewFlagSet("chat search", flag.ContinueOnError)
+	dir := flags.String("dir", *chatTranscriptFlag, "Directory of the chat transcript")
+	user := flags.String("user", "", "Only show records of this username")
+	since := flags.String("since", "", "Only show records from this time (RFC3339 or a duration ago, ex: 2h)")
+	until := flags.String("until", "", "Only show records before this time (RFC3339 or a duration ago, ex: 30m)")
+	text := flags.String("text", "", "Only show messages containing this text")
+	asJSON := flags.Bool("json", false, "Print the matching records as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *dir == "" {
+		return errors.New("no transcript directory, use -dir")
+	}
+
+	query := chat.TranscriptQuery{User: *user, Text: *text}
+	var err error
+	if query.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if query.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	return chat.SearchTranscripts(*dir, query, func(record chat.TranscriptRecord) bool {
+		if *asJSON {
+			encoder.Encode(record)
+			return true
+		}
+		stamp := record.Time.Local().Format(time.DateTime)
+		switch record.Event {
+		case chat.TRANSCRIPT_JOIN:
+			fmt.Printf("%s %s * %s has entered the room\n", stamp, record.Room, record.User)
+		case chat.TRANSCRIPT_LEAVE:
+			fmt.Printf("%s %s * %s has left the room\n", stamp, record.Room, record.User)
+		default:
+			fmt.Printf("%s %s [%s] %s\n", stamp, record.Room, record.User, record.Text)
+		}
+		return true
+	})
+}
+
+// dbDumpFlags are the flags shared by db dump and db restore, description is
+// shown in their help
+func dbDumpFlags(name string, description string) (flags *flag.FlagSet, addr *string, dir *string, format *string, file *string) {
+	flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n%s\n", name, description)
+		flags.PrintDefaults()
+	}
+	addr = flags.String("addr", "127.0.0.1:8000", "Address of the running db server")
+	dir = flags.String("dir", "", "Use the db persistence files of this directory instead of a running server")
+	format = flags.String("format", db.DUMP_JSON, "Dump format: json or csv")
+	file = flags.String("file", "", "Dump file, empty for the standard output or input")
+	return
+}
+
+func dbDump(args []string) error {
+	flags, addr, dir, format, file := dbDumpFlags("db dump", "Writes the keys, values and expiries of a db server")
+	prefix := flags.String("prefix", "", "Only dump the keys starting with this prefix")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	out := os.Stdout
+	if *file != "" {
+		var err error
+		if out, err = os.Create(*file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w, err := db.NewDumpWriter(out, *format)
+	if err != nil {
+		return err
+	}
+
+	var dumped int
+	if *dir != "" {
+		dumped, err = db.DumpDataDir(*dir, *prefix, w)
+	} else {
+		var client *db.Client
+		if client, err = db.Dial(*addr); err != nil {
+			return err
+		}
+		defer client.Close()
+		dumped, err = client.Dump(*prefix, w)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d keys\n", dumped)
+	return nil
+}
+
+func dbRestore(args []string) error {
+	flags, addr, dir, format, file := dbDumpFlags("db restore", "Writes the keys, values and expiries of a dump to a db server, keys already expired are skipped")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	in := os.Stdin
+	if *file != "" {
+		var err error
+		if in, err = os.Open(*file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	r, err := db.NewDumpReader(in, *format)
+	if err != nil {
+		return err
+	}
+
+	var restored int
+	if *dir != "" {
+		restored, err = db.RestoreDataDir(*dir, r)
+	} else {
+		var client *db.Client
+		if client, err = db.Dial(*addr); err != nil {
+			return err
+		}
+		defer client.Close()
+		restored, err = client.Restore(r)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d keys\n", restored)
+	return nil
+}
+
+// logMetrics logs metrics every interval
+func logMetrics(metrics *server.Metrics, interval time.Duration) {
+	for range time.Tick(interval) {
+		log.Info().Object("metrics", metrics).Msg("connection metrics")
+	}
 }
 
 func serversList() string {
-	return strings.Join(slices.Sorted(maps.Keys(servers)), ", ")
+	names := slices.Collect(maps.Keys(servers))
+	names = slices.AppendSeq(names, maps.Keys(commands))
+	slices.Sort(names)
+	return strings.Join(names, ", ")
 }
 
 func main() {
+	if args := flag.Args(); len(args) >= 2 {
+		if command, ok := commands[args[0]+" "+args[1]]; ok {
+			if err := command(args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", args[0]+" "+args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Open log file
 	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
@@ -81,6 +356,12 @@ func main() {
 		return
 	}
 
+	if tcpServer, ok := s.(*server.TCPServer); ok && *metricsFlag > 0 {
+		metrics := &server.Metrics{}
+		tcpServer.Use(metrics.Middleware)
+		go logMetrics(metrics, *metricsFlag)
+	}
+
 	doneCh := make(chan struct{})
 
 	sigCh := make(chan os.Signal, 1)
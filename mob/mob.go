@@ -1,7 +1,6 @@
 package mob
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"io"
@@ -22,22 +21,34 @@ const (
 	FROM_PROXY
 )
 
+const DEFAULT_PROXY_ADDR = "chat.protohackers.com:16963"
+
 type MobServer struct {
 	server       *server.TCPServer
 	proxyAddress string
 }
 
 func NewMobServer(proxyAddress ...string) (s server.Server, err error) {
+	return NewMobServerOn("", proxyAddress...)
+}
+
+// NewMobServerOn is NewMobServer listening on bindAddr, ":8000" when it is
+// empty
+func NewMobServerOn(bindAddr string, proxyAddress ...string) (s server.Server, err error) {
 	mob := &MobServer{}
 	if len(proxyAddress) == 0 {
-		mob.proxyAddress = "chat.protohackers.com:16963"
+		mob.proxyAddress = DEFAULT_PROXY_ADDR
 	} else {
 		mob.proxyAddress = proxyAddress[0]
 	}
-	mob.server, err = server.NewTCPServer(mob.HandleClient)
+	mob.server, err = server.NewTCPServer(mob.HandleClient, bindAddr)
 	return mob, err
 }
 
+func (self *MobServer) Addr() net.Addr {
+	return self.server.Addr()
+}
+
 func (self *MobServer) Start() {
 	go self.server.Start()
 }
@@ -70,9 +81,11 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 	ctx, ctx_cancel := context.WithCancel(context.Background())
 	defer ctx_cancel()
 
+	proxyLines := server.NewLineConn(bogusServer)
+	clientLines := server.NewLineConn(c)
+
 	// Proxy communication handler
 	go func() {
-		proxyReader := bufio.NewReader(bogusServer)
 		for {
 			select {
 			case <-ctx.Done():
@@ -81,7 +94,7 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 			default:
 			}
 
-			text, err := proxyReader.ReadString('\n')
+			text, err := proxyLines.ReadString()
 			if err != nil {
 				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 					proxyLog.Error().Err(err).Msg("could not read from proxy server")
@@ -91,7 +104,6 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 				ctx_cancel()
 				return
 			}
-			text = strings.TrimSpace(text)
 
 			proxyLog.Debug().Str("msg", text).Msg("received a new message from the proxy")
 
@@ -104,7 +116,6 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 
 	// Client communication handler
 	go func() {
-		clientReader := bufio.NewReader(c)
 		for {
 			select {
 			case <-ctx.Done():
@@ -113,7 +124,7 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 			default:
 			}
 
-			text, err := clientReader.ReadString('\n')
+			text, err := clientLines.ReadString()
 			if err != nil {
 				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 					c.Logger.Error().Err(err).Msg("could not read from client")
@@ -123,7 +134,6 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 				ctx_cancel()
 				return
 			}
-			text = strings.TrimSpace(text)
 
 			c.Logger.Debug().Str("msg", text).Msg("received a new message from the client")
 
@@ -139,8 +149,6 @@ func (self *MobServer) HandleClient(c *server.TCPClient) error {
 		return err
 	}
 
-	proxyWriter := bufio.NewWriter(bogusServer)
-	clientWriter := bufio.NewWriter(c)
 loop:
 	for {
 		select {
@@ -158,23 +166,17 @@ loop:
 			}
 			msg.value = strings.Join(words, " ")
 
-			var writer *bufio.Writer
+			var lines *server.LineConn
 			switch msg.source {
 			case FROM_CLIENT:
-				writer = proxyWriter
+				lines = proxyLines
 			case FROM_PROXY:
-				writer = clientWriter
+				lines = clientLines
 			}
 
-			_, err = writer.WriteString(msg.value)
-			if err != nil {
-				return err
-			}
-			_, err = writer.WriteRune('\n')
-			if err != nil {
+			if err = lines.SendLine(msg.value); err != nil {
 				return err
 			}
-			err = writer.Flush()
 		}
 	}
 
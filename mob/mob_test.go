@@ -1,81 +1,51 @@
 package mob_test
 
 import (
-	"bufio"
-	"net"
-	"strings"
 	"testing"
-	"time"
 
-	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/wizzymore/tcp-go/mob"
+	"github.com/wizzymore/tcp-go/servertest"
 )
 
 func TestServer(t *testing.T) {
+	t.Parallel()
+
 	// Initialize protohackers mock server
-	server, err := net.Listen("tcp", ":16963")
-	require.NoError(t, err, "Could not create bogus server")
-	defer server.Close()
+	upstream := servertest.Listen(t)
 
 	// Initialize our proxy server
-	proxyServer, err := mob.NewMobServer("127.0.0.1:16963")
+	proxyServer, err := mob.NewMobServerOn(servertest.ADDR, upstream.Addr().String())
 	require.NoError(t, err, "Could not create mob server")
-	go proxyServer.Start()
-	defer proxyServer.Stop()
-
-	// Connect client_con to proxy
-	client_con, err := net.Dial("tcp", ":8000")
-	require.NoError(t, err, "Could not connect to mob server")
-	defer client_con.Close()
+	addr := servertest.Start(t, proxyServer)
 
-	// Accept the connection from the proxy on behalf of the client
-	server_conn, err := server.Accept()
-	require.NoError(t, err, "Could not accept proxy connection on bogus")
+	// Connect the client to the proxy and accept the connection of the proxy
+	// on behalf of the client
+	client := servertest.NewLineClient(t, servertest.Dial(t, "tcp", addr))
+	chat := servertest.NewLineClient(t, servertest.Accept(t, upstream))
 
 	t.Run("forwards server messages to client", func(t *testing.T) {
-		// Send welcome message, the proxy should pass this to our client
-		welcomeMessage := "Welcome to budgetchat! What shall I call you?\n"
-
-		server_writer := bufio.NewWriter(server_conn)
-		server_writer.WriteString(welcomeMessage)
-		server_writer.Flush()
-
-		client_reader := bufio.NewReader(client_con)
-		result, err := client_reader.ReadString('\n')
-		require.NoError(t, err, "Could not read from server")
-
-		assert.Equal(t, result, welcomeMessage, "Did not receive welcome message")
+		chat.Send("Welcome to budgetchat! What shall I call you?")
+		client.Expect("Welcome to budgetchat! What shall I call you?")
 	})
 
 	t.Run("receives messages from client", func(t *testing.T) {
-		// Test that all wallet ids gets replaced with the bogus value 7YWHMfk9JZe0LM0g1ZauHuiSxhI
-		client_con.SetWriteDeadline(time.Now().Add(time.Millisecond * 200))
-		client_writer := bufio.NewWriter(client_con)
-		client_writer.WriteString("Alice\n")
-		client_writer.Flush()
-
-		server_conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
-		server_reader := bufio.NewReader(server_conn)
-		result, err := server_reader.ReadString('\n')
-		require.NoError(t, err, "Could not read message on server")
-
-		assert.Equal(t, result, "Alice\n")
+		client.Send("Alice")
+		chat.Expect("Alice")
 	})
 
 	t.Run("modifies wallet id with bogus id", func(t *testing.T) {
 		// Test that all wallet ids gets replaced with the bogus value 7YWHMfk9JZe0LM0g1ZauHuiSxhI
-		client_con.SetWriteDeadline(time.Now().Add(time.Millisecond * 200))
-		client_writer := bufio.NewWriter(client_con)
-		client_writer.WriteString("Hi alice, please send payment to 7F1u3wSD5RbOHQmupo9nx4TnhQ\n")
-		client_writer.Flush()
+		client.Send("Hi alice, please send payment to 7F1u3wSD5RbOHQmupo9nx4TnhQ")
+		chat.Expect("Hi alice, please send payment to " + mob.BOGUS)
 
-		server_conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
-		server_reader := bufio.NewReader(server_conn)
-		result, err := server_reader.ReadString('\n')
-		require.NoError(t, err, "Could not read message on bogus")
+		chat.Send("7F1u3wSD5RbOHQmupo9nx4TnhQ 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX")
+		client.Expect(mob.BOGUS + " " + mob.BOGUS)
+	})
 
-		assert.Equal(t, result, "Hi alice, please send payment to 7YWHMfk9JZe0LM0g1ZauHuiSxhI\n", "Did not replace token with BOGUS token")
-		assert.True(t, !strings.Contains(result, "7F1u3wSD5RbOHQmupo9nx4TnhQ"), "Should not contain original wallet id")
+	t.Run("does not forward partial lines", func(t *testing.T) {
+		client.Conn.Write([]byte("partial"))
+		client.Conn.Close()
+		chat.ExpectClosed()
 	})
 }
@@ -0,0 +1,108 @@
+//go:generate go run ../genpackets/genpackets.go -file messages.go -lengths u32
+
+package pest
+
+import "io"
+
+type Message interface {
+	Marshal() (b []byte, err error)
+	Unmarshal(r io.Reader) (err error)
+	Opcode() byte
+}
+
+const (
+	PROTOCOL         = "pestcontrol"
+	PROTOCOL_VERSION = 1
+)
+
+// Policy actions
+const (
+	ACTION_CULL     uint8 = 0x90
+	ACTION_CONSERVE uint8 = 0xa0
+)
+
+type HelloMessage struct {
+	Protocol string
+	Version  uint32
+}
+
+func (self *HelloMessage) Opcode() byte {
+	return 0x50
+}
+
+type ErrorMessage struct {
+	Message string
+}
+
+func (self *ErrorMessage) Opcode() byte {
+	return 0x51
+}
+
+type OKMessage struct {
+}
+
+func (self *OKMessage) Opcode() byte {
+	return 0x52
+}
+
+type DialAuthorityMessage struct {
+	Site uint32
+}
+
+func (self *DialAuthorityMessage) Opcode() byte {
+	return 0x53
+}
+
+type TargetPopulation struct {
+	Species string
+	Min     uint32
+	Max     uint32
+}
+
+type TargetPopulationsMessage struct {
+	Site        uint32
+	Populations []TargetPopulation
+}
+
+func (self *TargetPopulationsMessage) Opcode() byte {
+	return 0x54
+}
+
+type CreatePolicyMessage struct {
+	Species string
+	Action  uint8
+}
+
+func (self *CreatePolicyMessage) Opcode() byte {
+	return 0x55
+}
+
+type DeletePolicyMessage struct {
+	Policy uint32
+}
+
+func (self *DeletePolicyMessage) Opcode() byte {
+	return 0x56
+}
+
+type PolicyResultMessage struct {
+	Policy uint32
+}
+
+func (self *PolicyResultMessage) Opcode() byte {
+	return 0x57
+}
+
+type ObservedPopulation struct {
+	Species string
+	Count   uint32
+}
+
+type SiteVisitMessage struct {
+	Site        uint32
+	Populations []ObservedPopulation
+}
+
+func (self *SiteVisitMessage) Opcode() byte {
+	return 0x58
+}
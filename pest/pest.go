@@ -0,0 +1,274 @@
+package pest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+const DEFAULT_AUTHORITY_ADDR = "pestcontrol.protohackers.com:20547"
+
+type Options struct {
+	// Addr is the address to listen on, defaults to ":8000"
+	Addr string
+	// AuthorityAddr is the authority server giving the target populations
+	// of the sites and keeping their policies
+	AuthorityAddr string
+}
+
+// PestServer reads site visits and keeps a policy on the authority for
+// every species whose observed population is out of its target range
+type PestServer struct {
+	server  *server.TCPServer
+	options Options
+
+	lock  sync.Mutex
+	sites map[uint32]*site
+}
+
+type policy struct {
+	id     uint32
+	action uint8
+}
+
+// site holds the authority link of a site, its lock serializes the visits
+// of the site
+type site struct {
+	id     uint32
+	logger zerolog.Logger
+
+	lock    sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	targets []TargetPopulation
+	// policies are the ones created on the authority, they outlive the
+	// links to it
+	policies map[string]policy
+}
+
+// ErrAuthority is an error message sent by the authority, the link to it is
+// still usable
+var ErrAuthority = errors.New("authority error")
+
+func NewPestServer(options Options) (s *PestServer, err error) {
+	if options.AuthorityAddr == "" {
+		options.AuthorityAddr = DEFAULT_AUTHORITY_ADDR
+	}
+	s = &PestServer{options: options, sites: make(map[uint32]*site)}
+	s.server, err = server.NewTCPServer(s.HandleClient, options.Addr)
+	return
+}
+
+func (self *PestServer) Start() {
+	self.server.Start()
+}
+
+func (self *PestServer) Stop() error {
+	err := self.server.Stop()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, site := range self.sites {
+		site.lock.Lock()
+		site.close()
+		site.lock.Unlock()
+	}
+	return err
+}
+
+func (self *PestServer) Addr() string {
+	return self.server.Listener.Addr().String()
+}
+
+func validHello(m Message) bool {
+	hello, ok := m.(*HelloMessage)
+	return ok && hello.Protocol == PROTOCOL && hello.Version == PROTOCOL_VERSION
+}
+
+// fail sends err to the client before it is disconnected
+func fail(w io.Writer, err error) error {
+	WriteMessage(w, &ErrorMessage{err.Error()})
+	return err
+}
+
+func (self *PestServer) HandleClient(c *server.TCPClient) error {
+	if err := WriteMessage(c, &HelloMessage{PROTOCOL, PROTOCOL_VERSION}); err != nil {
+		return err
+	}
+	r := bufio.NewReader(c)
+	m, err := ReadMessage(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fail(c, err)
+	}
+	if !validHello(m) {
+		return fail(c, errors.New("expected a hello message"))
+	}
+
+	for {
+		m, err := ReadMessage(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fail(c, err)
+		}
+		visit, ok := m.(*SiteVisitMessage)
+		if !ok {
+			return fail(c, fmt.Errorf("unexpected %T", m))
+		}
+
+		observed := make(map[string]uint32, len(visit.Populations))
+		for _, population := range visit.Populations {
+			if count, seen := observed[population.Species]; seen && count != population.Count {
+				return fail(c, fmt.Errorf("conflicting counts for %s", population.Species))
+			}
+			observed[population.Species] = population.Count
+		}
+		c.Logger.Debug().Uint32("site", visit.Site).Any("populations", observed).Msg("Received site visit")
+
+		if err := self.site(visit.Site).visit(self.options.AuthorityAddr, observed); err != nil {
+			c.Logger.Warn().Err(err).Uint32("site", visit.Site).Msg("Could not update the site policies")
+		}
+	}
+}
+
+func (self *PestServer) site(id uint32) *site {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s, ok := self.sites[id]
+	if !ok {
+		s = &site{id: id, logger: log.With().Uint32("site", id).Logger()}
+		self.sites[id] = s
+	}
+	return s
+}
+
+// visit updates the policies of the site for the observed populations,
+// species missing from the visit count as 0. A broken authority link is
+// dialed again once.
+func (s *site) visit(authorityAddr string, observed map[string]uint32) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for range 2 {
+		if s.conn == nil {
+			if err = s.dial(authorityAddr); err != nil {
+				s.close()
+				return err
+			}
+		}
+		if err = s.update(observed); err == nil {
+			return nil
+		}
+		s.close()
+		s.logger.Warn().Err(err).Msg("Lost the authority link")
+	}
+	return err
+}
+
+// update creates and deletes policies until they match observed. Policies
+// are only recorded once the authority answered, so a failed update is
+// picked up again by the next one.
+func (s *site) update(observed map[string]uint32) error {
+	for _, target := range s.targets {
+		count := observed[target.Species]
+		var action uint8
+		switch {
+		case count < target.Min:
+			action = ACTION_CONSERVE
+		case count > target.Max:
+			action = ACTION_CULL
+		}
+
+		current, ok := s.policies[target.Species]
+		if ok && current.action == action {
+			continue
+		}
+		if ok {
+			_, err := request[*OKMessage](s, &DeletePolicyMessage{current.id})
+			if err != nil && !errors.Is(err, ErrAuthority) {
+				return err
+			}
+			// An authority error means the policy is already gone
+			delete(s.policies, target.Species)
+			s.logger.Debug().Err(err).Str("species", target.Species).Uint32("policy", current.id).Msg("Deleted policy")
+		}
+		if action != 0 {
+			result, err := request[*PolicyResultMessage](s, &CreatePolicyMessage{target.Species, action})
+			if err != nil {
+				return err
+			}
+			s.policies[target.Species] = policy{result.Policy, action}
+			s.logger.Debug().Str("species", target.Species).Uint32("policy", result.Policy).Hex("action", []byte{action}).Msg("Created policy")
+		}
+	}
+	return nil
+}
+
+// dial connects to the authority of the site and reads its targets
+func (s *site) dial(authorityAddr string) (err error) {
+	if s.conn, err = net.DialTimeout("tcp", authorityAddr, time.Second*10); err != nil {
+		return err
+	}
+	s.reader = bufio.NewReader(s.conn)
+	if s.policies == nil {
+		s.policies = make(map[string]policy)
+	}
+	if err := WriteMessage(s.conn, &HelloMessage{PROTOCOL, PROTOCOL_VERSION}); err != nil {
+		return err
+	}
+	m, err := ReadMessage(s.reader)
+	if err != nil {
+		return err
+	}
+	if !validHello(m) {
+		return errors.New("authority did not say hello")
+	}
+
+	targets, err := request[*TargetPopulationsMessage](s, &DialAuthorityMessage{s.id})
+	if err != nil {
+		return err
+	}
+	if targets.Site != s.id {
+		return fmt.Errorf("authority sent the targets of site %d", targets.Site)
+	}
+	s.targets = targets.Populations
+	s.logger.Info().Int("targets", len(s.targets)).Msg("Connected to the site authority")
+	return nil
+}
+
+// request sends m to the authority and reads its reply of type T
+func request[T Message](s *site, m Message) (reply T, err error) {
+	s.conn.SetDeadline(time.Now().Add(time.Second * 10))
+	if err = WriteMessage(s.conn, m); err != nil {
+		return
+	}
+	response, err := ReadMessage(s.reader)
+	if err != nil {
+		return
+	}
+	if e, ok := response.(*ErrorMessage); ok {
+		return reply, fmt.Errorf("%w: %s", ErrAuthority, e.Message)
+	}
+	reply, ok := response.(T)
+	if !ok {
+		return reply, fmt.Errorf("authority sent %T instead of %T", response, reply)
+	}
+	return reply, nil
+}
+
+func (s *site) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
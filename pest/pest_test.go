@@ -0,0 +1,280 @@
+package pest_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/pest"
+)
+
+// fakeAuthority serves the targets of its sites and records their policies
+type fakeAuthority struct {
+	listener net.Listener
+	targets  map[uint32][]pest.TargetPopulation
+
+	lock     sync.Mutex
+	conns    []net.Conn
+	dials    int
+	nextId   uint32
+	policies map[uint32]map[uint32]pest.CreatePolicyMessage
+}
+
+func startAuthority(t *testing.T, targets map[uint32][]pest.TargetPopulation) *fakeAuthority {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "Could not start the fake authority")
+	t.Cleanup(func() { listener.Close() })
+	a := &fakeAuthority{listener: listener, targets: targets, policies: make(map[uint32]map[uint32]pest.CreatePolicyMessage)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			a.lock.Lock()
+			a.conns = append(a.conns, conn)
+			a.lock.Unlock()
+			go a.serve(conn)
+		}
+	}()
+	return a
+}
+
+func (a *fakeAuthority) serve(conn net.Conn) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	pest.WriteMessage(conn, &pest.HelloMessage{Protocol: pest.PROTOCOL, Version: pest.PROTOCOL_VERSION})
+	if _, err := pest.ReadMessage(r); err != nil {
+		return err
+	}
+	m, err := pest.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	site := m.(*pest.DialAuthorityMessage).Site
+	a.lock.Lock()
+	a.dials++
+	// Policies outlive the connections of their site
+	if a.policies[site] == nil {
+		a.policies[site] = make(map[uint32]pest.CreatePolicyMessage)
+	}
+	a.lock.Unlock()
+	pest.WriteMessage(conn, &pest.TargetPopulationsMessage{Site: site, Populations: a.targets[site]})
+
+	for {
+		m, err := pest.ReadMessage(r)
+		if err != nil {
+			return err
+		}
+		a.lock.Lock()
+		switch m := m.(type) {
+		case *pest.CreatePolicyMessage:
+			a.nextId++
+			a.policies[site][a.nextId] = *m
+			pest.WriteMessage(conn, &pest.PolicyResultMessage{Policy: a.nextId})
+		case *pest.DeletePolicyMessage:
+			if _, ok := a.policies[site][m.Policy]; ok {
+				delete(a.policies[site], m.Policy)
+				pest.WriteMessage(conn, &pest.OKMessage{})
+			} else {
+				pest.WriteMessage(conn, &pest.ErrorMessage{Message: "no such policy"})
+			}
+		}
+		a.lock.Unlock()
+	}
+}
+
+// drop closes the connections of the sites
+func (a *fakeAuthority) drop() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, conn := range a.conns {
+		conn.Close()
+	}
+	a.conns = nil
+}
+
+// actions returns the policy action of every species of site
+func (a *fakeAuthority) actions(site uint32) map[string]uint8 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	actions := map[string]uint8{}
+	for _, policy := range a.policies[site] {
+		actions[policy.Species] = policy.Action
+	}
+	return actions
+}
+
+type pestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialPest(t *testing.T, s *pest.PestServer, hello bool) *pestClient {
+	conn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err, "Could not connect to pest server")
+	t.Cleanup(func() { conn.Close() })
+	c := &pestClient{conn, bufio.NewReader(conn)}
+	assert.Equal(t, &pest.HelloMessage{Protocol: pest.PROTOCOL, Version: pest.PROTOCOL_VERSION}, c.read(t))
+	if hello {
+		c.send(t, &pest.HelloMessage{Protocol: pest.PROTOCOL, Version: pest.PROTOCOL_VERSION})
+	}
+	return c
+}
+
+func (c *pestClient) send(t *testing.T, m pest.Message) {
+	require.NoError(t, pest.WriteMessage(c.conn, m), "Could not write to pest server")
+}
+
+func (c *pestClient) read(t *testing.T) pest.Message {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	m, err := pest.ReadMessage(c.reader)
+	require.NoError(t, err, "Could not read from pest server")
+	return m
+}
+
+// expectError reads an error message followed by the end of the connection
+func (c *pestClient) expectError(t *testing.T) {
+	assert.IsType(t, &pest.ErrorMessage{}, c.read(t))
+	_, err := pest.ReadMessage(c.reader)
+	assert.True(t, errors.Is(err, io.EOF), "Connection should be closed, got %v", err)
+}
+
+func TestMessages(t *testing.T) {
+	t.Run("encodes messages", func(t *testing.T) {
+		data, err := pest.EncodeMessage(&pest.HelloMessage{Protocol: "pestcontrol", Version: 1})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{
+			0x50, 0x00, 0x00, 0x00, 0x19, 0x00, 0x00, 0x00, 0x0b, 0x70, 0x65, 0x73, 0x74, 0x63,
+			0x6f, 0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x00, 0x00, 0x00, 0x01, 0xce,
+		}, data)
+
+		data, err = pest.EncodeMessage(&pest.SiteVisitMessage{Site: 12345, Populations: []pest.ObservedPopulation{{Species: "dog", Count: 1}, {Species: "rat", Count: 5}}})
+		require.NoError(t, err)
+		assert.Equal(t, []byte{
+			0x58, 0x00, 0x00, 0x00, 0x24, 0x00, 0x00, 0x30, 0x39, 0x00, 0x00, 0x00, 0x02,
+			0x00, 0x00, 0x00, 0x03, 0x64, 0x6f, 0x67, 0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x03, 0x72, 0x61, 0x74, 0x00, 0x00, 0x00, 0x05, 0x8c,
+		}, data)
+	})
+
+	t.Run("decodes messages", func(t *testing.T) {
+		m := &pest.TargetPopulationsMessage{Site: 7, Populations: []pest.TargetPopulation{{Species: "dog", Min: 1, Max: 3}}}
+		data, err := pest.EncodeMessage(m)
+		require.NoError(t, err)
+		decoded, err := pest.ReadMessage(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, m, decoded)
+	})
+
+	t.Run("rejects invalid messages", func(t *testing.T) {
+		valid, err := pest.EncodeMessage(&pest.DialAuthorityMessage{Site: 7})
+		require.NoError(t, err)
+
+		checksum := append([]byte{}, valid...)
+		checksum[len(checksum)-1]++
+		_, err = pest.ReadMessage(bytes.NewReader(checksum))
+		assert.ErrorIs(t, err, pest.ErrChecksum)
+
+		for _, data := range [][]byte{
+			{0x60, 0x00, 0x00, 0x00, 0x06, 0x9a},
+			{0x52, 0x00, 0x00, 0x00, 0x07, 0x00, 0xa7},
+			{0x53, 0x00, 0x00, 0x00, 0x07, 0x00, 0xa6},
+			{0x52, 0xff, 0xff, 0xff, 0xff, 0xb2},
+			valid[:len(valid)-1],
+		} {
+			_, err := pest.ReadMessage(bytes.NewReader(data))
+			assert.Error(t, err, "Message %x should be rejected", data)
+		}
+	})
+}
+
+func TestPestControl(t *testing.T) {
+	authority := startAuthority(t, map[uint32][]pest.TargetPopulation{
+		12345: {
+			{Species: "dog", Min: 1, Max: 3},
+			{Species: "rat", Min: 0, Max: 10},
+			{Species: "cat", Min: 2, Max: 2},
+		},
+	})
+	s, err := pest.NewPestServer(pest.Options{Addr: "127.0.0.1:0", AuthorityAddr: authority.listener.Addr().String()})
+	require.NoError(t, err, "Could not create pest server")
+	go s.Start()
+	defer s.Stop()
+
+	t.Run("creates policies for populations out of range", func(t *testing.T) {
+		c := dialPest(t, s, true)
+		c.send(t, &pest.SiteVisitMessage{Site: 12345, Populations: []pest.ObservedPopulation{
+			{Species: "dog", Count: 5},
+			{Species: "rat", Count: 3},
+			{Species: "fox", Count: 7},
+			{Species: "dog", Count: 5},
+		}})
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(map[string]uint8{"dog": pest.ACTION_CULL, "cat": pest.ACTION_CONSERVE}, authority.actions(12345))
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("replaces policies", func(t *testing.T) {
+		c := dialPest(t, s, true)
+		c.send(t, &pest.SiteVisitMessage{Site: 12345, Populations: []pest.ObservedPopulation{
+			{Species: "dog", Count: 2},
+			{Species: "rat", Count: 20},
+			{Species: "cat", Count: 2},
+		}})
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(map[string]uint8{"rat": pest.ACTION_CULL}, authority.actions(12345))
+		}, time.Second, time.Millisecond*10)
+
+		authority.lock.Lock()
+		assert.Equal(t, 1, authority.dials, "Authority connection should be kept for the site")
+		authority.lock.Unlock()
+	})
+
+	t.Run("keeps policies across authority connections", func(t *testing.T) {
+		authority.drop()
+		c := dialPest(t, s, true)
+		c.send(t, &pest.SiteVisitMessage{Site: 12345, Populations: []pest.ObservedPopulation{
+			{Species: "dog", Count: 5},
+			{Species: "rat", Count: 3},
+			{Species: "cat", Count: 2},
+		}})
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(map[string]uint8{"dog": pest.ACTION_CULL}, authority.actions(12345))
+		}, time.Second, time.Millisecond*10)
+
+		authority.lock.Lock()
+		assert.Equal(t, 2, authority.dials, "Site should dial the authority again")
+		assert.Len(t, authority.policies[12345], 1, "Policies of the previous connection should be deleted")
+		authority.lock.Unlock()
+	})
+
+	t.Run("disconnects clients without hello", func(t *testing.T) {
+		c := dialPest(t, s, false)
+		c.send(t, &pest.SiteVisitMessage{Site: 12345})
+		c.expectError(t)
+	})
+
+	t.Run("disconnects clients with conflicting counts", func(t *testing.T) {
+		c := dialPest(t, s, true)
+		c.send(t, &pest.SiteVisitMessage{Site: 12345, Populations: []pest.ObservedPopulation{
+			{Species: "dog", Count: 2},
+			{Species: "dog", Count: 3},
+		}})
+		c.expectError(t)
+	})
+
+	t.Run("disconnects clients sending invalid messages", func(t *testing.T) {
+		c := dialPest(t, s, true)
+		_, err := c.conn.Write([]byte{0x52, 0x00, 0x00, 0x00, 0x06, 0x00})
+		require.NoError(t, err)
+		c.expectError(t)
+	})
+}
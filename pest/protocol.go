@@ -0,0 +1,110 @@
+package pest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A message on the wire is its opcode, its total length as a u32, its
+// fields and a checksum byte making the sum of every byte 0 modulo 256
+const MESSAGE_OVERHEAD = 1 + 4 + 1
+
+// MAX_MESSAGE_SIZE is the largest message accepted
+const MAX_MESSAGE_SIZE = 1 << 20
+
+var ErrChecksum = errors.New("invalid checksum")
+
+func newMessage(opcode byte) Message {
+	switch opcode {
+	case (*HelloMessage).Opcode(nil):
+		return new(HelloMessage)
+	case (*ErrorMessage).Opcode(nil):
+		return new(ErrorMessage)
+	case (*OKMessage).Opcode(nil):
+		return new(OKMessage)
+	case (*DialAuthorityMessage).Opcode(nil):
+		return new(DialAuthorityMessage)
+	case (*TargetPopulationsMessage).Opcode(nil):
+		return new(TargetPopulationsMessage)
+	case (*CreatePolicyMessage).Opcode(nil):
+		return new(CreatePolicyMessage)
+	case (*DeletePolicyMessage).Opcode(nil):
+		return new(DeletePolicyMessage)
+	case (*PolicyResultMessage).Opcode(nil):
+		return new(PolicyResultMessage)
+	case (*SiteVisitMessage).Opcode(nil):
+		return new(SiteVisitMessage)
+	}
+	return nil
+}
+
+// EncodeMessage frames a message with its length and checksum
+func EncodeMessage(m Message) ([]byte, error) {
+	body, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, len(body)+MESSAGE_OVERHEAD-1)
+	data = append(data, body[0])
+	data = binary.BigEndian.AppendUint32(data, uint32(len(body)+MESSAGE_OVERHEAD-1))
+	data = append(data, body[1:]...)
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return append(data, -sum), nil
+}
+
+func WriteMessage(w io.Writer, m Message) error {
+	data, err := EncodeMessage(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads a whole message and checks its checksum and that its
+// fields fill its length exactly
+func ReadMessage(r io.Reader) (Message, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < MESSAGE_OVERHEAD || length > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	data := make([]byte, length)
+	copy(data, header[:])
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, ErrChecksum
+	}
+
+	m := newMessage(header[0])
+	if m == nil {
+		return nil, fmt.Errorf("unknown message type 0x%02x", header[0])
+	}
+	fields := bytes.NewReader(data[len(header) : len(data)-1])
+	if err := m.Unmarshal(fields); err != nil {
+		return nil, fmt.Errorf("invalid %T: %w", m, err)
+	}
+	if fields.Len() > 0 {
+		return nil, fmt.Errorf("invalid %T: %d unused bytes", m, fields.Len())
+	}
+	return m, nil
+}
@@ -1,12 +1,9 @@
 package primetime
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 
+	"github.com/wizzymore/tcp-go/jsonlines"
 	"github.com/wizzymore/tcp-go/server"
 )
 
@@ -20,19 +17,9 @@ type step_one_response struct {
 	Prime  bool   `json:"prime"`
 }
 
-func handle_step_one(w io.Writer, request []byte) error {
-	var requestData step_one_request
-	if err := json.Unmarshal(request, &requestData); err != nil {
-		return errors.Join(err, errors.New("could not parse JSON request"))
-	}
-	if requestData.Method != "isPrime" {
-		if requestData.Method != "" {
-			return fmt.Errorf("unsupported method: %s", requestData.Method)
-		}
-		return errors.New("method was not provided")
-	}
+func handle_step_one(c *jsonlines.Conn, requestData *step_one_request) (any, error) {
 	if requestData.Number == nil {
-		return errors.New("provided number was nil")
+		return nil, errors.New("provided number was nil")
 	}
 	var responseData step_one_response
 	responseData.Method = "isPrime"
@@ -41,12 +28,7 @@ func handle_step_one(w io.Writer, request []byte) error {
 	} else {
 		responseData.Prime = false
 	}
-	data, err := json.Marshal(responseData)
-	if err != nil {
-		return errors.Join(err, fmt.Errorf("could not marshal responseData: %v", responseData))
-	}
-	w.Write(data)
-	return nil
+	return &responseData, nil
 }
 
 func isPrime(n int) bool {
@@ -61,43 +43,12 @@ func isPrime(n int) bool {
 	return true
 }
 
-func Handler(c *server.TCPClient) error {
-	reader := bufio.NewReader(c)
-	writer := newWriter(c)
-	for {
-		out, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		c.Logger.Info().Msgf("got new data %s", out)
-
-		if err := handle_step_one(writer, out); err != nil {
-			c.Write([]byte("bye, bye\n"))
-			return err
-		}
-	}
-
-	return nil
-}
-
-type NewLineWriter struct {
-	w io.Writer
+func newMux() *jsonlines.Mux {
+	mux := jsonlines.NewMux(jsonlines.Options{DisconnectMalformed: true})
+	jsonlines.Handle(mux, "isPrime", handle_step_one)
+	return mux
 }
 
-func (self NewLineWriter) Write(p []byte) (n int, err error) {
-	n, err = self.w.Write(p)
-	if err != nil {
-		return
-	}
-	var n2 int
-	n2, err = self.w.Write([]byte{'\n'})
-	n = n + n2
-	return
-}
-
-func newWriter(w io.Writer) io.Writer {
-	return &NewLineWriter{w}
-}
+// Handler answers isPrime requests, a malformed request is answered with an
+// error and ends the connection
+var Handler server.TCPHandle = newMux().Serve
@@ -11,6 +11,11 @@ type CountingReader struct {
 	BytesRead int
 }
 
+// NewCountingReader returns a CountingReader reading from r.
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{reader: r}
+}
+
 // Read reads data into the provided byte slice.
 // It returns the number of bytes read and any error encountered.
 func (cr *CountingReader) Read(b []byte) (int, error) {
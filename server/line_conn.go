@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const DEFAULT_MAX_LINE_LENGTH = 1 << 20
+
+// ErrLineTooLong is returned for lines longer than MaxLineLength, the
+// connection can not be read any further
+var ErrLineTooLong = errors.New("line too long")
+
+// ErrUnterminatedLine is returned when the connection ends in the middle of a
+// line, it is an io.EOF so handlers see the client as gone
+var ErrUnterminatedLine = fmt.Errorf("line not terminated: %w", io.EOF)
+
+type LineOptions struct {
+	// MaxLineLength is the longest line, without its terminator, that can be
+	// read, defaults to DEFAULT_MAX_LINE_LENGTH
+	MaxLineLength int
+	// Delimiter ends the lines read and written, defaults to '\n'
+	Delimiter byte
+	// KeepCR keeps the carriage return of the lines read ending with "\r" and
+	// the delimiter, which is trimmed by default
+	KeepCR bool
+	// CRLF writes a carriage return before the delimiter of every line
+	CRLF bool
+}
+
+// LineConn reads and writes the lines of a line based protocol. Lines read
+// are returned without their terminator and lines written are buffered
+// until Flush. Writes are safe from several goroutines, reads are not.
+type LineConn struct {
+	options LineOptions
+	reader  *bufio.Reader
+	line    []byte
+
+	lock   sync.Mutex
+	writer *bufio.Writer
+}
+
+func NewLineConn(conn io.ReadWriter, options ...LineOptions) *LineConn {
+	l := &LineConn{}
+	if len(options) > 0 {
+		l.options = options[0]
+	}
+	if l.options.MaxLineLength <= 0 {
+		l.options.MaxLineLength = DEFAULT_MAX_LINE_LENGTH
+	}
+	if l.options.Delimiter == 0 {
+		l.options.Delimiter = '\n'
+	}
+	// Room for the longest allowed line and its terminator, long lines are
+	// only buffered as they come
+	l.reader = bufio.NewReaderSize(conn, min(l.options.MaxLineLength+2, 4096))
+	l.writer = bufio.NewWriter(conn)
+	return l
+}
+
+// ReadLine reads the next line without its terminator. The line is only
+// valid until the next read.
+func (l *LineConn) ReadLine() ([]byte, error) {
+	l.line = l.line[:0]
+	for {
+		chunk, err := l.reader.ReadSlice(l.options.Delimiter)
+		l.line = append(l.line, chunk...)
+		// Longer than the line and a carriage return without a delimiter
+		if err != nil && len(l.line) > l.options.MaxLineLength+1 {
+			return nil, ErrLineTooLong
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && len(l.line) > 0 {
+			return nil, ErrUnterminatedLine
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	line := l.line[:len(l.line)-1]
+	if !l.options.KeepCR && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	if len(line) > l.options.MaxLineLength {
+		return nil, ErrLineTooLong
+	}
+	return line, nil
+}
+
+// ReadString reads the next line without its terminator
+func (l *LineConn) ReadString() (string, error) {
+	line, err := l.ReadLine()
+	return string(line), err
+}
+
+// Read reads the bytes following the lines read, for protocols sending raw
+// data after a line
+func (l *LineConn) Read(p []byte) (int, error) {
+	return l.reader.Read(p)
+}
+
+// WriteLine buffers line and its terminator, line must not contain the
+// delimiter
+func (l *LineConn) WriteLine(line string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writeLine(line)
+}
+
+func (l *LineConn) writeLine(line string) error {
+	l.writer.WriteString(line)
+	if l.options.CRLF {
+		l.writer.WriteByte('\r')
+	}
+	return l.writer.WriteByte(l.options.Delimiter)
+}
+
+// Flush writes the buffered lines to the connection
+func (l *LineConn) Flush() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writer.Flush()
+}
+
+// SendLine writes line and everything buffered before it to the connection
+func (l *LineConn) SendLine(line string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.writeLine(line); err != nil {
+		return err
+	}
+	return l.writer.Flush()
+}
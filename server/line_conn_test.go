@@ -0,0 +1,96 @@
+package server_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+type lineBuffers struct {
+	io.Reader
+	io.Writer
+}
+
+func newLineConn(input string, options server.LineOptions) (*server.LineConn, *bytes.Buffer) {
+	output := &bytes.Buffer{}
+	return server.NewLineConn(lineBuffers{strings.NewReader(input), output}, options), output
+}
+
+func readLines(lines *server.LineConn) ([]string, error) {
+	read := []string{}
+	for {
+		line, err := lines.ReadString()
+		if err != nil {
+			return read, err
+		}
+		read = append(read, line)
+	}
+}
+
+func TestLineConn(t *testing.T) {
+	t.Run("reads lines without their terminator", func(t *testing.T) {
+		lines, _ := newLineConn("one\ntwo\r\n\r\nthree\r\r\n", server.LineOptions{})
+		read, err := readLines(lines)
+		assert.ErrorIs(t, err, io.EOF)
+		assert.NotErrorIs(t, err, server.ErrUnterminatedLine)
+		assert.Equal(t, []string{"one", "two", "", "three\r"}, read)
+	})
+
+	t.Run("keeps carriage returns", func(t *testing.T) {
+		lines, _ := newLineConn("one\r\ntwo\n", server.LineOptions{KeepCR: true})
+		read, _ := readLines(lines)
+		assert.Equal(t, []string{"one\r", "two"}, read)
+	})
+
+	t.Run("reads custom delimiters", func(t *testing.T) {
+		lines, _ := newLineConn("one;two\n;", server.LineOptions{Delimiter: ';'})
+		read, _ := readLines(lines)
+		assert.Equal(t, []string{"one", "two\n"}, read)
+	})
+
+	t.Run("fails on lines not terminated", func(t *testing.T) {
+		lines, _ := newLineConn("one\ntwo", server.LineOptions{})
+		read, err := readLines(lines)
+		assert.ErrorIs(t, err, server.ErrUnterminatedLine)
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, []string{"one"}, read)
+	})
+
+	t.Run("fails on lines too long", func(t *testing.T) {
+		for _, max := range []int{10, 10_000} {
+			long := strings.Repeat("a", max)
+			for _, input := range []string{long + "a\n", long + "a\r\n", long + "aa"} {
+				lines, _ := newLineConn(long+"\r\n"+long+"\n"+input, server.LineOptions{MaxLineLength: max})
+				read, err := readLines(lines)
+				assert.ErrorIs(t, err, server.ErrLineTooLong)
+				assert.Equal(t, []string{long, long}, read)
+			}
+		}
+
+		lines, _ := newLineConn(strings.Repeat("a", 100)+"\r\n", server.LineOptions{MaxLineLength: 100, KeepCR: true})
+		_, err := lines.ReadLine()
+		assert.ErrorIs(t, err, server.ErrLineTooLong)
+	})
+
+	t.Run("buffers lines written until flushed", func(t *testing.T) {
+		lines, output := newLineConn("", server.LineOptions{})
+		require.NoError(t, lines.WriteLine("one"))
+		require.NoError(t, lines.WriteLine("two"))
+		assert.Empty(t, output.String())
+		require.NoError(t, lines.Flush())
+		assert.Equal(t, "one\ntwo\n", output.String())
+		require.NoError(t, lines.SendLine("three"))
+		assert.Equal(t, "one\ntwo\nthree\n", output.String())
+	})
+
+	t.Run("writes CRLF terminators", func(t *testing.T) {
+		lines, output := newLineConn("", server.LineOptions{CRLF: true})
+		require.NoError(t, lines.SendLine("one"))
+		assert.Equal(t, "one\r\n", output.String())
+	})
+}
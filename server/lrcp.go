@@ -0,0 +1,555 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The Line Reversal Control Protocol gives reliable ordered byte streams over
+// UDP. Every message is a datagram shorter than LRCP_MAX_MESSAGE bytes:
+//
+//	/connect/SESSION/
+//	/data/SESSION/POS/DATA/  with "/" and "\" escaped by a "\" in DATA
+//	/ack/SESSION/LENGTH/
+//	/close/SESSION/
+//
+// Numbers are below LRCP_MAX_NUMBER, invalid messages are ignored. A session
+// belongs to the peer that connected it, the same SESSION sent by another
+// peer is another session.
+const (
+	LRCP_CONNECT = "connect"
+	LRCP_DATA    = "data"
+	LRCP_ACK     = "ack"
+	LRCP_CLOSE   = "close"
+)
+
+const LRCP_MAX_MESSAGE = 1000
+const LRCP_MAX_NUMBER = 2_147_483_648
+
+const DEFAULT_LRCP_RETRANSMIT_TIMEOUT = time.Second * 3
+const DEFAULT_LRCP_EXPIRY_TIMEOUT = time.Minute
+
+var errLRCPExpired = errors.New("lrcp session expired")
+
+type LRCPOptions struct {
+	// Addr is the address to listen on, defaults to ":8000"
+	Addr string
+	// RetransmitTimeout is how long sent data waits for an ack before it is
+	// sent again
+	RetransmitTimeout time.Duration
+	// ExpiryTimeout is how long a session may go without a message from the
+	// peer, or sent data may stay unacknowledged, before the session is
+	// closed
+	ExpiryTimeout time.Duration
+}
+
+// LRCPServer runs a TCPHandle for every LRCP session, the session being
+// the connection of the TCPClient
+type LRCPServer struct {
+	udp              *UDPServer
+	handleConnection TCPHandle
+	options          LRCPOptions
+
+	lock     sync.Mutex
+	sessions map[lrcpSessionKey]*LRCPConn
+}
+
+// lrcpSessionKey identifies a session, ids are only unique for a peer so
+// another peer can not take over a session by guessing its id
+type lrcpSessionKey struct {
+	peer netip.AddrPort
+	id   uint
+}
+
+func NewLRCPServer(handler TCPHandle, options LRCPOptions) (s *LRCPServer, err error) {
+	if options.RetransmitTimeout <= 0 {
+		options.RetransmitTimeout = DEFAULT_LRCP_RETRANSMIT_TIMEOUT
+	}
+	if options.ExpiryTimeout <= 0 {
+		options.ExpiryTimeout = DEFAULT_LRCP_EXPIRY_TIMEOUT
+	}
+	s = &LRCPServer{
+		handleConnection: Recover(handler),
+		options:          options,
+		sessions:         make(map[lrcpSessionKey]*LRCPConn),
+	}
+	s.udp, err = NewUDPServer(s.handleClient, UDPOptions{Addrs: []string{options.Addr}, Timeout: options.ExpiryTimeout})
+	return
+}
+
+func (s *LRCPServer) Addr() net.Addr {
+	return s.udp.Addr()
+}
+
+func (s *LRCPServer) Start() {
+	s.udp.Start()
+}
+
+func (s *LRCPServer) Stop() error {
+	err := s.udp.Stop()
+	s.lock.Lock()
+	sessions := make([]*LRCPConn, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.lock.Unlock()
+	for _, session := range sessions {
+		session.terminate(net.ErrClosed)
+	}
+	return err
+}
+
+// handleClient routes the messages of a peer to their sessions, a peer may
+// hold several sessions
+func (s *LRCPServer) handleClient(c *UDPClient) error {
+	for msg := range c.Msgs {
+		m, ok := parseLRCP(msg)
+		if !ok {
+			c.Logger.Debug().Msg("ignored invalid lrcp message")
+			continue
+		}
+
+		key := lrcpSessionKey{c.key.addr, m.session}
+		s.lock.Lock()
+		session, open := s.sessions[key]
+		if !open && m.kind == LRCP_CONNECT {
+			session = s.open(key, c)
+			open = true
+		}
+		s.lock.Unlock()
+
+		if !open {
+			c.Write(lrcpMessage(LRCP_CLOSE, m.session))
+			continue
+		}
+		session.receive(c, m)
+	}
+
+	// The peer was silent for ExpiryTimeout, so were its sessions still
+	// talking through c
+	s.lock.Lock()
+	sessions := []*LRCPConn{}
+	for key, session := range s.sessions {
+		if key.peer == c.key.addr {
+			sessions = append(sessions, session)
+		}
+	}
+	s.lock.Unlock()
+	for _, session := range sessions {
+		session.expire(c)
+	}
+	return nil
+}
+
+// open must be called with the server lock held
+func (s *LRCPServer) open(key lrcpSessionKey, c *UDPClient) *LRCPConn {
+	session := &LRCPConn{server: s, key: key, id: key.id, client: c, lastReceived: time.Now()}
+	session.readable = sync.NewCond(&session.lock)
+	session.idle = time.AfterFunc(s.options.ExpiryTimeout, session.checkIdle)
+	s.sessions[key] = session
+
+	go func() {
+		tc := &TCPClient{session, key.id, log.With().Uint("session", key.id).Logger()}
+		defer tc.Close()
+		tc.Logger.Info().Stringer("remote_addr", c.RemoteAddr()).Msg("session opened")
+		err := s.handleConnection(tc)
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+			tc.Logger.Err(err).Msg("session did not handle ok")
+		} else {
+			tc.Logger.Info().Msg("session done")
+		}
+	}()
+	return session
+}
+
+func (s *LRCPServer) remove(session *LRCPConn) {
+	s.lock.Lock()
+	if s.sessions[session.key] == session {
+		delete(s.sessions, session.key)
+	}
+	s.lock.Unlock()
+}
+
+type lrcpPacket struct {
+	kind    string
+	session uint
+	// pos is the position of a data message, or the length of an ack
+	pos  int
+	data []byte
+}
+
+// parseLRCP splits a message on its unescaped slashes and validates it
+func parseLRCP(msg []byte) (m lrcpPacket, ok bool) {
+	if len(msg) < 2 || len(msg) >= LRCP_MAX_MESSAGE || msg[0] != '/' || msg[len(msg)-1] != '/' {
+		return
+	}
+	fields := [][]byte{}
+	start := 1
+	for i := 1; i < len(msg)-1; i++ {
+		switch msg[i] {
+		case '\\':
+			i++
+			if i == len(msg)-1 {
+				return
+			}
+		case '/':
+			fields = append(fields, msg[start:i])
+			start = i + 1
+		}
+	}
+	fields = append(fields, msg[start:len(msg)-1])
+
+	expected := map[string]int{LRCP_CONNECT: 2, LRCP_DATA: 4, LRCP_ACK: 3, LRCP_CLOSE: 2}
+	m.kind = string(fields[0])
+	if n, known := expected[m.kind]; !known || n != len(fields) {
+		return
+	}
+	session, valid := parseLRCPNumber(fields[1])
+	if !valid {
+		return
+	}
+	m.session = uint(session)
+	if len(fields) > 2 {
+		if m.pos, valid = parseLRCPNumber(fields[2]); !valid {
+			return
+		}
+	}
+	if m.kind == LRCP_DATA {
+		if m.data, valid = unescapeLRCP(fields[3]); !valid {
+			return
+		}
+	}
+	return m, true
+}
+
+func parseLRCPNumber(field []byte) (int, bool) {
+	if len(field) == 0 || len(field) > 10 {
+		return 0, false
+	}
+	for _, b := range field {
+		if b < '0' || b > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(string(field))
+	return n, err == nil && n < LRCP_MAX_NUMBER
+}
+
+func unescapeLRCP(field []byte) ([]byte, bool) {
+	data := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' {
+			i++
+			if field[i] != '\\' && field[i] != '/' {
+				return nil, false
+			}
+		}
+		data = append(data, field[i])
+	}
+	return data, true
+}
+
+func escapedLRCPSize(b byte) int {
+	if b == '\\' || b == '/' {
+		return 2
+	}
+	return 1
+}
+
+func lrcpMessage(kind string, session uint, numbers ...int) []byte {
+	msg := fmt.Appendf(nil, "/%s/%d/", kind, session)
+	for _, n := range numbers {
+		msg = fmt.Appendf(msg, "%d/", n)
+	}
+	return msg
+}
+
+// LRCPConn is an LRCP session seen as a net.Conn. Writes never block, the
+// data is kept until the peer acknowledges it.
+type LRCPConn struct {
+	server *LRCPServer
+	key    lrcpSessionKey
+	id     uint
+
+	lock     sync.Mutex
+	readable *sync.Cond
+	// client is the UDPClient of the peer that sent the last message of the
+	// session, the peer is always the same but its client may expire
+	client *UDPClient
+	// received is the data not read yet, in is the length received
+	received []byte
+	in       int
+	// unacked is the data sent after acked, out is the length sent
+	unacked []byte
+	acked   int
+	out     int
+	// progress is when the peer last acknowledged new data
+	progress time.Time
+	// lastReceived is when the peer last sent a message of the session, idle
+	// closes the session after ExpiryTimeout of silence
+	lastReceived time.Time
+	idle         *time.Timer
+	retransmit   *time.Timer
+	readDeadline time.Time
+	deadline     *time.Timer
+	peerClosed   bool
+	closing      bool
+	err          error
+}
+
+// receive handles a message of the session sent by c
+func (s *LRCPConn) receive(c *UDPClient, m lrcpPacket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		c.Write(lrcpMessage(LRCP_CLOSE, s.id))
+		return
+	}
+	s.client = c
+	s.lastReceived = time.Now()
+
+	switch m.kind {
+	case LRCP_CONNECT:
+		c.Write(lrcpMessage(LRCP_ACK, s.id, 0))
+	case LRCP_DATA:
+		if m.pos == s.in {
+			s.received = append(s.received, m.data...)
+			s.in += len(m.data)
+			s.readable.Broadcast()
+		}
+		c.Write(lrcpMessage(LRCP_ACK, s.id, s.in))
+	case LRCP_ACK:
+		if m.pos <= s.acked {
+			return
+		}
+		if m.pos > s.out {
+			c.Logger.Debug().Uint("session", s.id).Msg("peer acknowledged data never sent")
+			s.closeLocked(errors.New("lrcp peer acknowledged data never sent"))
+			return
+		}
+		s.unacked = s.unacked[m.pos-s.acked:]
+		s.acked = m.pos
+		s.progress = time.Now()
+		if s.acked < s.out {
+			s.send(s.acked)
+			s.retransmit.Reset(s.server.options.RetransmitTimeout)
+		} else if s.closing {
+			s.closeLocked(net.ErrClosed)
+		}
+	case LRCP_CLOSE:
+		s.peerClosed = true
+		s.closeLocked(io.EOF)
+	}
+}
+
+// send writes the data from position pos as data messages
+func (s *LRCPConn) send(pos int) {
+	data := s.unacked[pos-s.acked:]
+	for len(data) > 0 {
+		header := fmt.Appendf(nil, "/%s/%d/%d/", LRCP_DATA, s.id, pos)
+		size := len(header) + 1
+		n := 0
+		for n < len(data) && size+escapedLRCPSize(data[n]) < LRCP_MAX_MESSAGE {
+			size += escapedLRCPSize(data[n])
+			n++
+		}
+
+		msg := make([]byte, 0, size)
+		msg = append(msg, header...)
+		for _, b := range data[:n] {
+			if escapedLRCPSize(b) == 2 {
+				msg = append(msg, '\\')
+			}
+			msg = append(msg, b)
+		}
+		msg = append(msg, '/')
+		s.client.Write(msg)
+
+		data = data[n:]
+		pos += n
+	}
+}
+
+// resend runs on the retransmission timer, sending the unacknowledged data
+// again until the peer acknowledges it or the session expires
+func (s *LRCPConn) resend() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil || s.acked == s.out {
+		return
+	}
+	if time.Since(s.progress) >= s.server.options.ExpiryTimeout {
+		s.client.Logger.Debug().Uint("session", s.id).Msg("lrcp session expired")
+		s.closeLocked(errLRCPExpired)
+		return
+	}
+	s.send(s.acked)
+	s.retransmit.Reset(s.server.options.RetransmitTimeout)
+}
+
+// checkIdle runs on the idle timer, closing the session once the peer was
+// silent for ExpiryTimeout
+func (s *LRCPConn) checkIdle() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return
+	}
+	if silent := time.Since(s.lastReceived); silent < s.server.options.ExpiryTimeout {
+		s.idle.Reset(s.server.options.ExpiryTimeout - silent)
+		return
+	}
+	s.client.Logger.Debug().Uint("session", s.id).Msg("lrcp session went silent")
+	s.closeLocked(errLRCPExpired)
+}
+
+// expire closes the session if its peer last talked through c, which
+// expired
+func (s *LRCPConn) expire(c *UDPClient) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client == c {
+		s.closeLocked(errLRCPExpired)
+	}
+}
+
+// closeLocked ends the session with err and tells the peer about it
+func (s *LRCPConn) closeLocked(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.client.Write(lrcpMessage(LRCP_CLOSE, s.id))
+	s.idle.Stop()
+	if s.retransmit != nil {
+		s.retransmit.Stop()
+	}
+	s.readable.Broadcast()
+	s.server.remove(s)
+}
+
+// terminate ends the session without telling the peer, the server stopped
+func (s *LRCPConn) terminate(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err == nil {
+		s.err = err
+		s.idle.Stop()
+		if s.retransmit != nil {
+			s.retransmit.Stop()
+		}
+		s.readable.Broadcast()
+	}
+}
+
+// Read returns the received data, io.EOF once the peer closed the session
+// and the data was read
+func (s *LRCPConn) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.received) == 0 {
+		if s.err != nil {
+			if s.peerClosed {
+				return 0, io.EOF
+			}
+			return 0, s.err
+		}
+		if !s.readDeadline.IsZero() && !time.Now().Before(s.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.readable.Wait()
+	}
+	n := copy(b, s.received)
+	s.received = s.received[n:]
+	return n, nil
+}
+
+func (s *LRCPConn) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil || s.closing {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	pos := s.out
+	s.unacked = append(s.unacked, b...)
+	s.out += len(b)
+	s.send(pos)
+
+	// The timers run while data waits for an ack
+	if pos == s.acked {
+		s.progress = time.Now()
+		if s.retransmit == nil {
+			s.retransmit = time.AfterFunc(s.server.options.RetransmitTimeout, s.resend)
+		} else {
+			s.retransmit.Reset(s.server.options.RetransmitTimeout)
+		}
+	}
+	return len(b), nil
+}
+
+// Close closes the session once the peer acknowledged all the written data
+func (s *LRCPConn) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return nil
+	}
+	s.closing = true
+	if s.acked == s.out {
+		s.closeLocked(net.ErrClosed)
+	}
+	return nil
+}
+
+func (s *LRCPConn) LocalAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client.LocalAddr()
+}
+
+func (s *LRCPConn) RemoteAddr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client.RemoteAddr()
+}
+
+func (s *LRCPConn) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *LRCPConn) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDeadline = t
+	if s.deadline != nil {
+		s.deadline.Stop()
+	}
+	if !t.IsZero() {
+		s.deadline = time.AfterFunc(time.Until(t), func() {
+			s.lock.Lock()
+			s.readable.Broadcast()
+			s.lock.Unlock()
+		})
+	}
+	s.readable.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline does nothing as writes never block
+func (s *LRCPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var _ net.Conn = (*LRCPConn)(nil)
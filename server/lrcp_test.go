@@ -0,0 +1,226 @@
+package server_test
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/linereversal"
+	"github.com/wizzymore/tcp-go/server"
+	"github.com/wizzymore/tcp-go/smoke_test"
+)
+
+func startLRCP(t *testing.T, handler server.TCPHandle) net.Conn {
+	s, err := server.NewLRCPServer(handler, server.LRCPOptions{
+		Addr:              "127.0.0.1:0",
+		RetransmitTimeout: time.Millisecond * 100,
+		ExpiryTimeout:     time.Millisecond * 500,
+	})
+	require.NoError(t, err, "Could not create lrcp server")
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	require.NoError(t, err, "Could not connect to lrcp server")
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func lrcpSend(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err, "Could not write to lrcp server")
+}
+
+func lrcpReceive(t *testing.T, conn net.Conn) string {
+	buf := make([]byte, server.LRCP_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	n, err := conn.Read(buf)
+	require.NoError(t, err, "Could not read from lrcp server")
+	return string(buf[:n])
+}
+
+func lrcpExpect(t *testing.T, conn net.Conn, msgs ...string) {
+	for _, msg := range msgs {
+		assert.Equal(t, msg, lrcpReceive(t, conn))
+	}
+}
+
+func TestLRCP(t *testing.T) {
+	conn := startLRCP(t, smoke_test.Handler)
+
+	t.Run("runs a tcp handler over a session", func(t *testing.T) {
+		lrcpSend(t, conn, "/connect/1/")
+		lrcpExpect(t, conn, "/ack/1/0/")
+		lrcpSend(t, conn, "/connect/1/")
+		lrcpExpect(t, conn, "/ack/1/0/")
+		lrcpSend(t, conn, "/data/1/0/hello/")
+		lrcpExpect(t, conn, "/ack/1/5/", "/data/1/0/hello/")
+		lrcpSend(t, conn, "/ack/1/5/")
+	})
+
+	t.Run("escapes data", func(t *testing.T) {
+		lrcpSend(t, conn, `/data/1/5/a\/b\\c/`)
+		lrcpExpect(t, conn, "/ack/1/10/", `/data/1/5/a\/b\\c/`)
+		lrcpSend(t, conn, "/ack/1/10/")
+	})
+
+	t.Run("acknowledges what it has for out of order data", func(t *testing.T) {
+		lrcpSend(t, conn, "/data/1/20/late/")
+		lrcpExpect(t, conn, "/ack/1/10/")
+		lrcpSend(t, conn, "/data/1/0/hello/")
+		lrcpExpect(t, conn, "/ack/1/10/")
+	})
+
+	t.Run("ignores invalid messages", func(t *testing.T) {
+		for _, msg := range []string{
+			"/data/1/10/a/b/",
+			`/data/1/10/a\b/`,
+			"/data/1/10/ab",
+			"/ack/1/",
+			"/ack/1/x/",
+			"/ack/1/2147483648/",
+			"/connect/-1/",
+			"/hello/1/",
+			"/data/1/10/" + strings.Repeat("a", server.LRCP_MAX_MESSAGE) + "/",
+		} {
+			lrcpSend(t, conn, msg)
+		}
+		lrcpSend(t, conn, "/connect/1/")
+		lrcpExpect(t, conn, "/ack/1/0/")
+	})
+
+	t.Run("retransmits until acknowledged", func(t *testing.T) {
+		lrcpSend(t, conn, "/data/1/10/retry/")
+		lrcpExpect(t, conn, "/ack/1/15/", "/data/1/10/retry/", "/data/1/10/retry/")
+		lrcpSend(t, conn, "/ack/1/12/")
+		msg := lrcpReceive(t, conn)
+		for msg == "/data/1/10/retry/" {
+			msg = lrcpReceive(t, conn)
+		}
+		assert.Equal(t, "/data/1/12/try/", msg)
+		lrcpSend(t, conn, "/ack/1/15/")
+	})
+
+	t.Run("closes sessions", func(t *testing.T) {
+		lrcpSend(t, conn, "/close/1/")
+		lrcpExpect(t, conn, "/close/1/")
+		lrcpSend(t, conn, "/data/1/15/more/")
+		lrcpExpect(t, conn, "/close/1/")
+		lrcpSend(t, conn, "/ack/2/0/")
+		lrcpExpect(t, conn, "/close/2/")
+	})
+
+	t.Run("closes a session acknowledging unsent data", func(t *testing.T) {
+		lrcpSend(t, conn, "/connect/3/")
+		lrcpExpect(t, conn, "/ack/3/0/")
+		lrcpSend(t, conn, "/ack/3/10/")
+		lrcpExpect(t, conn, "/close/3/")
+	})
+
+	t.Run("expires sessions without acks", func(t *testing.T) {
+		lrcpSend(t, conn, "/connect/4/")
+		lrcpExpect(t, conn, "/ack/4/0/")
+		lrcpSend(t, conn, "/data/4/0/x/")
+		lrcpExpect(t, conn, "/ack/4/1/")
+		for {
+			msg := lrcpReceive(t, conn)
+			if msg != "/data/4/0/x/" {
+				assert.Equal(t, "/close/4/", msg)
+				break
+			}
+		}
+	})
+
+	t.Run("keeps sessions to their peer", func(t *testing.T) {
+		other, err := net.Dial("udp", conn.RemoteAddr().String())
+		require.NoError(t, err, "Could not connect to lrcp server")
+		defer other.Close()
+
+		lrcpSend(t, conn, "/connect/5/")
+		lrcpExpect(t, conn, "/ack/5/0/")
+		lrcpSend(t, other, "/data/5/0/evil/")
+		lrcpExpect(t, other, "/close/5/")
+		lrcpSend(t, other, "/close/5/")
+		lrcpExpect(t, other, "/close/5/")
+
+		lrcpSend(t, conn, "/data/5/0/hi/")
+		lrcpExpect(t, conn, "/ack/5/2/", "/data/5/0/hi/")
+		lrcpSend(t, conn, "/ack/5/2/")
+
+		// The same id is another session for another peer
+		lrcpSend(t, other, "/connect/5/")
+		lrcpExpect(t, other, "/ack/5/0/")
+		lrcpSend(t, other, "/data/5/0/yo/")
+		lrcpExpect(t, other, "/ack/5/2/", "/data/5/0/yo/")
+		lrcpSend(t, other, "/ack/5/2/")
+	})
+}
+
+func TestLRCPSilentSessions(t *testing.T) {
+	done := make(chan struct{})
+	conn := startLRCP(t, func(c *server.TCPClient) error {
+		defer close(done)
+		_, err := io.ReadAll(c)
+		return err
+	})
+
+	lrcpSend(t, conn, "/connect/1/")
+	lrcpExpect(t, conn, "/ack/1/0/")
+	// Nothing is left to acknowledge, the session still expires
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buf := make([]byte, server.LRCP_MAX_MESSAGE)
+	n, err := conn.Read(buf)
+	require.NoError(t, err, "Session should have been closed")
+	assert.Equal(t, "/close/1/", string(buf[:n]))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Handler of the silent session should be done")
+	}
+	lrcpSend(t, conn, "/data/1/0/late/")
+	lrcpExpect(t, conn, "/close/1/")
+}
+
+func TestLineReversal(t *testing.T) {
+	conn := startLRCP(t, linereversal.Handler)
+
+	lrcpSend(t, conn, "/connect/7/")
+	lrcpExpect(t, conn, "/ack/7/0/")
+	lrcpSend(t, conn, "/data/7/0/hello\n/")
+	lrcpExpect(t, conn, "/ack/7/6/", "/data/7/0/olleh\n/")
+	lrcpSend(t, conn, "/ack/7/6/")
+	lrcpSend(t, conn, "/data/7/6/Hello, world!\nno newl/")
+	lrcpExpect(t, conn, "/ack/7/27/", "/data/7/6/!dlrow ,olleH\n/")
+	lrcpSend(t, conn, "/ack/7/20/")
+	lrcpSend(t, conn, "/data/7/27/ine\n/")
+	lrcpExpect(t, conn, "/ack/7/31/", "/data/7/20/enilwen on\n/")
+	lrcpSend(t, conn, "/ack/7/31/")
+
+	t.Run("splits long writes", func(t *testing.T) {
+		chunk := strings.Repeat("/", 400)
+		for i := range 3 {
+			pos := strconv.Itoa(31 + i*len(chunk))
+			lrcpSend(t, conn, "/data/7/"+pos+"/"+strings.ReplaceAll(chunk, "/", `\/`)+"/")
+			lrcpExpect(t, conn, "/ack/7/"+strconv.Itoa(31+(i+1)*len(chunk))+"/")
+		}
+		lrcpSend(t, conn, "/data/7/1231/\n/")
+		lrcpExpect(t, conn, "/ack/7/1232/")
+
+		reversed := ""
+		for len(reversed) < 3*len(chunk)+1 {
+			msg := lrcpReceive(t, conn)
+			assert.Less(t, len(msg), server.LRCP_MAX_MESSAGE)
+			prefix := "/data/7/" + strconv.Itoa(31+len(reversed)) + "/"
+			require.True(t, strings.HasPrefix(msg, prefix), "Unexpected message %s", msg)
+			reversed += strings.ReplaceAll(strings.TrimSuffix(msg[len(prefix):], "/"), `\/`, "/")
+		}
+		assert.Equal(t, strings.Repeat(chunk, 3)+"\n", reversed)
+		lrcpSend(t, conn, "/ack/7/1232/")
+	})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrPanic is returned for a handler that panicked
+var ErrPanic = errors.New("handler panicked")
+
+// Middleware runs around a TCPHandle, it may wrap the client or its Conn
+// before calling the next handle
+type Middleware func(TCPHandle) TCPHandle
+
+// Chain wraps handler in middlewares, the first one being the outermost
+func Chain(handler TCPHandle, middlewares ...Middleware) TCPHandle {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// clientGone tells apart the errors of a client going away from handler
+// failures
+func clientGone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+// Recover turns a panic of the handler into an ErrPanic, only the client is
+// lost. Panics in goroutines started by the handler are not recovered.
+func Recover(next TCPHandle) TCPHandle {
+	return func(c *TCPClient) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				c.Logger.Error().Interface("panic", r).Str("stack", string(debug.Stack())).Msg("handler panicked")
+				err = fmt.Errorf("%w: %v", ErrPanic, r)
+			}
+		}()
+		return next(c)
+	}
+}
+
+// CountingConn counts the bytes read from a Conn, the count is safe to read
+// while other goroutines read the Conn
+type CountingConn struct {
+	net.Conn
+	bytesRead atomic.Int64
+}
+
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+// BytesRead is the number of bytes read so far
+func (c *CountingConn) BytesRead() int64 {
+	return c.bytesRead.Load()
+}
+
+// CountBytes reads the Conn of the client through a CountingConn and logs the
+// bytes read once the handler is done
+func CountBytes(next TCPHandle) TCPHandle {
+	return func(c *TCPClient) error {
+		conn := NewCountingConn(c.Conn)
+		c.Conn = conn
+		err := next(c)
+		c.Logger.Debug().Int64("bytes_read", conn.BytesRead()).Msg("connection bytes read")
+		return err
+	}
+}
+
+// Metrics counts the connections of the handlers it wraps, it is safe to read
+// while they run
+type Metrics struct {
+	// Active is the number of connections being handled
+	Active atomic.Int64
+	// Total is the number of connections handled, active ones included
+	Total atomic.Int64
+	// Failed is the number of connections whose handler failed, clients
+	// going away are not failures
+	Failed atomic.Int64
+	// BytesRead is the number of bytes read from the connections that are
+	// done
+	BytesRead atomic.Int64
+	// Duration is the time, in nanoseconds, spent handling the connections
+	// that are done
+	Duration atomic.Int64
+}
+
+// Middleware updates the counters, it reads the Conn of the client through
+// a CountingConn
+func (m *Metrics) Middleware(next TCPHandle) TCPHandle {
+	return func(c *TCPClient) error {
+		m.Active.Add(1)
+		m.Total.Add(1)
+		start := time.Now()
+		conn := NewCountingConn(c.Conn)
+		c.Conn = conn
+		// Stays set when the handler panics
+		failed := true
+		defer func() {
+			m.Active.Add(-1)
+			m.Duration.Add(int64(time.Since(start)))
+			m.BytesRead.Add(conn.BytesRead())
+			if failed {
+				m.Failed.Add(1)
+			}
+		}()
+
+		err := next(c)
+		failed = err != nil && !clientGone(err)
+		return err
+	}
+}
+
+// MarshalZerologObject logs the counters
+func (m *Metrics) MarshalZerologObject(e *zerolog.Event) {
+	e.Int64("active", m.Active.Load()).
+		Int64("total", m.Total.Load()).
+		Int64("failed", m.Failed.Load()).
+		Int64("bytes_read", m.BytesRead.Load()).
+		Dur("duration", time.Duration(m.Duration.Load()))
+}
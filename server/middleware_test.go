@@ -0,0 +1,133 @@
+package server_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+func startTCP(t *testing.T, handler server.TCPHandle, middlewares ...server.Middleware) *server.TCPServer {
+	s, err := server.NewTCPServer(handler, "127.0.0.1:0")
+	require.NoError(t, err, "Could not create tcp server")
+	s.Use(middlewares...)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// exchange sends msg, closes the writing side and reads everything back
+func exchange(t *testing.T, s *server.TCPServer, msg string) string {
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err, "Could not connect to tcp server")
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg))
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestChain(t *testing.T) {
+	calls := []string{}
+	trace := func(name string) server.Middleware {
+		return func(next server.TCPHandle) server.TCPHandle {
+			return func(c *server.TCPClient) error {
+				calls = append(calls, name+" in")
+				err := next(c)
+				calls = append(calls, name+" out")
+				return err
+			}
+		}
+	}
+	handler := server.Chain(func(c *server.TCPClient) error {
+		calls = append(calls, "handler")
+		return nil
+	}, trace("first"), trace("second"))
+
+	require.NoError(t, handler(&server.TCPClient{Logger: zerolog.Nop()}))
+	assert.Equal(t, []string{"first in", "second in", "handler", "second out", "first out"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	t.Run("turns panics into errors", func(t *testing.T) {
+		err := server.Recover(func(c *server.TCPClient) error {
+			panic("boom")
+		})(&server.TCPClient{Logger: zerolog.Nop()})
+		assert.ErrorIs(t, err, server.ErrPanic)
+		assert.ErrorContains(t, err, "boom")
+	})
+
+	t.Run("keeps the server running", func(t *testing.T) {
+		s := startTCP(t, func(c *server.TCPClient) error {
+			buf := make([]byte, 4)
+			n, _ := io.ReadFull(c, buf)
+			if string(buf[:n]) == "boom" {
+				panic("boom")
+			}
+			c.Write(buf[:n])
+			return nil
+		})
+		assert.Empty(t, exchange(t, s, "boom"))
+		assert.Equal(t, "ping", exchange(t, s, "ping"))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &server.Metrics{}
+	s := startTCP(t, func(c *server.TCPClient) error {
+		data, err := io.ReadAll(c)
+		if err != nil {
+			return err
+		}
+		switch string(data) {
+		case "fail":
+			return errors.New("failed")
+		case "panic":
+			panic("panicked")
+		}
+		c.Write(data)
+		return io.EOF
+	}, metrics.Middleware)
+
+	assert.Equal(t, "hello", exchange(t, s, "hello"))
+	assert.Equal(t, "hi", exchange(t, s, "hi"))
+	assert.Empty(t, exchange(t, s, "fail"))
+	assert.Empty(t, exchange(t, s, "panic"))
+
+	assert.Eventually(t, func() bool {
+		return metrics.Active.Load() == 0 && metrics.Total.Load() == 4
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, int64(2), metrics.Failed.Load())
+	assert.Equal(t, int64(len("hellohifailpanic")), metrics.BytesRead.Load())
+	assert.Positive(t, metrics.Duration.Load())
+}
+
+func TestCountingConn(t *testing.T) {
+	client, peer := net.Pipe()
+	defer client.Close()
+	conn := server.NewCountingConn(peer)
+	defer conn.Close()
+
+	// A goroutine of the handler keeps reading while the count is read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(io.Discard, conn)
+	}()
+	for range 10 {
+		client.Write([]byte("hello"))
+		conn.BytesRead()
+	}
+	client.Close()
+	<-done
+	assert.Equal(t, int64(50), conn.BytesRead())
+}
@@ -15,6 +15,7 @@ type TCPHandle func(*TCPClient) error
 type TCPServer struct {
 	Listener         net.Listener
 	handleConnection TCPHandle
+	middlewares      []Middleware
 }
 
 type TCPClient struct {
@@ -23,16 +24,32 @@ type TCPClient struct {
 	Logger zerolog.Logger
 }
 
-func NewTCPServer(handler TCPHandle) (s *TCPServer, err error) {
+func NewTCPServer(handler TCPHandle, bindAddr ...string) (s *TCPServer, err error) {
 	s = &TCPServer{}
-	s.Listener, err = net.Listen("tcp", ":8000")
+	addr := ":8000"
+	if len(bindAddr) > 0 && bindAddr[0] != "" {
+		addr = bindAddr[0]
+	}
+	s.Listener, err = net.Listen("tcp", addr)
 	s.handleConnection = handler
 	return
 }
 
+func (s *TCPServer) Addr() net.Addr {
+	return s.Listener.Addr()
+}
+
+// Use wraps the handler in middlewares, see Chain. It must be called before
+// Start. Handlers are always wrapped in Recover first so a panic only loses
+// its client.
+func (s *TCPServer) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
 func (s *TCPServer) Start() {
 	addr := s.Listener.Addr()
 	log.Info().Msgf("server started on %s", addr.String())
+	handle := Chain(s.handleConnection, append([]Middleware{Recover}, s.middlewares...)...)
 	var nextId uint = 1
 	for {
 		conn, err := s.Listener.Accept()
@@ -50,7 +67,7 @@ func (s *TCPServer) Start() {
 			c := &TCPClient{conn, id, log.With().Uint("peer", id).Logger()}
 			defer c.Close()
 			c.Logger.Info().Msg("connected")
-			err := s.handleConnection(c)
+			err := handle(c)
 			if err != nil && !errors.Is(err, net.ErrClosed) {
 				if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
 					c.Logger.Info().Msg("client closed the connection")
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"container/heap"
 	"errors"
 	"net"
-	"os"
+	"net/netip"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -16,27 +18,69 @@ const MAX_DATAGRAM_SIZE = 65_507
 
 type UDPHandler func(c *UDPClient) error
 
+type OverflowPolicy int
+
+const (
+	// UDP_DROP_NEWEST drops the datagrams arriving while the queue is full
+	UDP_DROP_NEWEST OverflowPolicy = iota
+	// UDP_DROP_OLDEST drops the oldest queued datagram to make room
+	UDP_DROP_OLDEST
+)
+
+const DEFAULT_UDP_QUEUE_SIZE = 64
+
+type UDPOptions struct {
+	// Addrs are the addresses to listen on, defaults to ":8000". IPv4 and
+	// IPv6 addresses only get their own family, so "0.0.0.0:8000" and
+	// "[::]:8000" can be listened on together.
+	Addrs []string
+	// Timeout is how long a client lasts without sending anything
+	Timeout time.Duration
+	// QueueSize is the number of datagrams queued for a client before its
+	// Overflow policy applies, defaults to DEFAULT_UDP_QUEUE_SIZE
+	QueueSize int
+	Overflow  OverflowPolicy
+}
+
 type UDPServer struct {
-	Socket           net.PacketConn
+	Sockets          []*net.UDPConn
 	handleConnection UDPHandler
-	timeout          time.Duration
+	options          UDPOptions
+
+	lock    sync.Mutex
+	clients map[clientKey]*UDPClient
+	expiry  clientHeap
+	// wake tells the expiry loop a client was added to an empty heap
+	wake chan struct{}
+}
+
+// clientKey tells apart the same peer talking to several sockets
+type clientKey struct {
+	socket int
+	addr   netip.AddrPort
 }
 
 type UDPClient struct {
+	// Msgs is closed once the client timed out or the server stopped
 	Msgs   chan []byte
 	Logger zerolog.Logger
 
-	conn         net.PacketConn
+	key          clientKey
+	conn         *net.UDPConn
 	addr         net.Addr
 	lastActivity time.Time
+	// index is the position of the client in the expiry heap
+	index   int
+	dropped int
 }
 
+// Write sends a datagram to the client from the socket it talks to
 func (self *UDPClient) Write(p []byte) (err error) {
 	if len(p) > MAX_DATAGRAM_SIZE {
 		return errors.New("UDP message too large")
 	}
 	self.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
-	n, err := self.conn.WriteTo(p, self.addr)
+	n, err := self.conn.WriteToUDPAddrPort(p, self.key.addr)
 	if err != nil {
 		return err
 	}
@@ -46,84 +90,268 @@ func (self *UDPClient) Write(p []byte) (err error) {
 	return nil
 }
 
+// RemoteAddr is the address of the client, IPv4 clients of an IPv6 socket
+// get their IPv4 address
+func (self *UDPClient) RemoteAddr() net.Addr {
+	return self.addr
+}
+
+// LocalAddr is the address of the socket the client talks to
+func (self *UDPClient) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
 func NewBaseUDPServer(handler UDPHandler, timeout time.Duration, bindAddr ...string) (s *UDPServer, err error) {
-	s = &UDPServer{}
-	addr := ":8000"
-	if len(bindAddr) > 0 {
-		addr = bindAddr[0]
+	return NewUDPServer(handler, UDPOptions{Addrs: bindAddr, Timeout: timeout})
+}
+
+func NewUDPServer(handler UDPHandler, options UDPOptions) (s *UDPServer, err error) {
+	s = &UDPServer{
+		handleConnection: handler,
+		clients:          make(map[clientKey]*UDPClient),
+		wake:             make(chan struct{}, 1),
 	}
-	if s.Socket, err = net.ListenPacket("udp", addr); err != nil {
-		return
+	options.Addrs = slices.DeleteFunc(slices.Clone(options.Addrs), func(addr string) bool { return addr == "" })
+	if len(options.Addrs) == 0 {
+		options.Addrs = []string{":8000"}
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DEFAULT_UDP_QUEUE_SIZE
+	}
+	s.options = options
+
+	for _, addr := range options.Addrs {
+		socket, err := net.ListenPacket(udpNetwork(addr), addr)
+		if err != nil {
+			s.Stop()
+			return s, err
+		}
+		s.Sockets = append(s.Sockets, socket.(*net.UDPConn))
 	}
-	s.timeout = timeout
-	s.handleConnection = handler
 	return
 }
 
+// udpNetwork keeps the sockets of IP literals to their family, others are
+// dual stack
+func udpNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+	ip, err := netip.ParseAddr(host)
+	switch {
+	case err != nil:
+		return "udp"
+	case ip.Is4():
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// Addr is the address of the first socket
+func (self *UDPServer) Addr() net.Addr {
+	return self.Sockets[0].LocalAddr()
+}
+
+func (self *UDPServer) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(self.Sockets))
+	for i, socket := range self.Sockets {
+		addrs[i] = socket.LocalAddr()
+	}
+	return addrs
+}
+
+// Start reads the datagrams of every socket and queues them for their
+// client, it never waits on a handler so a slow client does not hold the
+// others back
 func (self *UDPServer) Start() {
-	addr := self.Socket.LocalAddr()
-	log.Info().Msgf("server started on %s", addr.String())
+	var wg sync.WaitGroup
+	for i, socket := range self.Sockets {
+		log.Info().Msgf("server started on %s", socket.LocalAddr().String())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self.read(i, socket)
+		}()
+	}
+
+	stop := make(chan struct{})
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		self.expireLoop(stop)
+	}()
+
+	wg.Wait()
+	close(stop)
+	<-expired
 
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range self.clients {
+		close(c.Msgs)
+	}
+	clear(self.clients)
+	self.expiry = nil
+}
+
+func (self *UDPServer) read(socket int, conn *net.UDPConn) {
 	buf := make([]byte, MAX_DATAGRAM_PACKET)
-	clients := make(map[string]*UDPClient)
 	for {
-		deadline := time.Time{}
-		deadline_addr := ""
-
-		for addr, c := range clients {
-			t := c.lastActivity.Add(self.timeout)
-			if deadline_addr == "" || t.Compare(deadline) == -1 {
-				deadline = t
-				deadline_addr = addr
-			}
-		}
-
-		self.Socket.SetReadDeadline(deadline)
-		n, addr, err := self.Socket.ReadFrom(buf)
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			if errors.Is(err, os.ErrDeadlineExceeded) {
-				clients[deadline_addr].Logger.Debug().Msg("client timeout reached")
-				close(clients[deadline_addr].Msgs)
-				delete(clients, deadline_addr)
-				continue
-			}
 			log.Fatal().Err(err).Msg("could not read from UDP socket")
 		}
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		self.receive(clientKey{socket, addr}, slices.Clone(buf[:n]))
+	}
+}
 
-		connection_id := addr.String()
-		c, has := clients[connection_id]
-		if !has {
-			c = &UDPClient{
-				Msgs:         make(chan []byte),
-				Logger:       log.With().Str("addr", connection_id).Logger(),
-				conn:         self.Socket,
-				addr:         addr,
-				lastActivity: time.Now(),
+func (self *UDPServer) receive(key clientKey, message []byte) {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	c, has := self.clients[key]
+	if !has {
+		connection_id := key.addr.String()
+		c = &UDPClient{
+			Msgs:         make(chan []byte, self.options.QueueSize),
+			Logger:       log.With().Str("addr", connection_id).Logger(),
+			key:          key,
+			conn:         self.Sockets[key.socket],
+			addr:         net.UDPAddrFromAddrPort(key.addr),
+			lastActivity: now,
+		}
+		self.clients[key] = c
+		heap.Push(&self.expiry, c)
+		if self.expiry.Len() == 1 {
+			select {
+			case self.wake <- struct{}{}:
+			default:
 			}
-			clients[connection_id] = c
-			go func(c *UDPClient) {
-				c.Logger.Info().Msg("client connected")
-				err := self.handleConnection(c)
-				if err != nil {
-					c.Logger.Err(err).Msg("client did not handle ok")
-				} else {
-					c.Logger.Info().Msg("client done - timed out")
-				}
-			}(c)
 		}
+		go func(c *UDPClient) {
+			c.Logger.Info().Stringer("local_addr", c.LocalAddr()).Msg("client connected")
+			err := self.handleConnection(c)
+			if err != nil {
+				c.Logger.Err(err).Msg("client did not handle ok")
+			} else {
+				c.Logger.Info().Msg("client done - timed out")
+			}
+		}(c)
+	} else {
+		c.lastActivity = now
+		heap.Fix(&self.expiry, c.index)
+	}
+
+	c.Logger.Debug().Str("last_activity", c.lastActivity.Format("15:04:05")).Msgf("client sent %d bytes", len(message))
+	self.enqueue(c, message)
+}
+
+// expireLoop closes the clients once they time out, until stop is closed
+func (self *UDPServer) expireLoop(stop chan struct{}) {
+	timer := time.NewTimer(self.options.Timeout)
+	for {
+		self.lock.Lock()
+		self.expire(time.Now())
+		next := time.Time{}
+		if self.expiry.Len() > 0 {
+			next = self.expiry[0].lastActivity.Add(self.options.Timeout)
+		}
+		self.lock.Unlock()
 
-		c.lastActivity = time.Now()
-		c.Logger.Debug().Str("last_activity", c.lastActivity.Format("15:04:05")).Msgf("client sent %d bytes", n)
-		c.Msgs <- slices.Clone(buf[:n])
+		var fired <-chan time.Time
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+			fired = timer.C
+		}
+		select {
+		case <-fired:
+		case <-self.wake:
+		case <-stop:
+			timer.Stop()
+			return
+		}
 	}
 }
 
+func (self *UDPServer) enqueue(c *UDPClient, message []byte) {
+	for {
+		select {
+		case c.Msgs <- message:
+			return
+		default:
+		}
+
+		c.dropped++
+		if self.options.Overflow == UDP_DROP_NEWEST {
+			c.Logger.Debug().Int("dropped", c.dropped).Msg("client queue is full, dropped datagram")
+			return
+		}
+		select {
+		case <-c.Msgs:
+			c.Logger.Debug().Int("dropped", c.dropped).Msg("client queue is full, dropped oldest datagram")
+		default:
+		}
+	}
+}
+
+// expire closes the clients that did not send anything for the timeout, it
+// must be called with the lock held
+func (self *UDPServer) expire(now time.Time) {
+	for self.expiry.Len() > 0 {
+		c := self.expiry[0]
+		if now.Before(c.lastActivity.Add(self.options.Timeout)) {
+			return
+		}
+		heap.Pop(&self.expiry)
+		c.Logger.Debug().Msg("client timeout reached")
+		close(c.Msgs)
+		delete(self.clients, c.key)
+	}
+}
+
+// clientHeap orders the clients by last activity, so the next one to time
+// out is first
+type clientHeap []*UDPClient
+
+func (h clientHeap) Len() int {
+	return len(h)
+}
+
+func (h clientHeap) Less(i, j int) bool {
+	return h[i].lastActivity.Before(h[j].lastActivity)
+}
+
+func (h clientHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *clientHeap) Push(x any) {
+	c := x.(*UDPClient)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *clientHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
+
 func (s *UDPServer) Stop() error {
-	if err := s.Socket.Close(); err != nil {
-		return err
+	errs := []error{}
+	for _, socket := range s.Sockets {
+		errs = append(errs, socket.Close())
 	}
-	return nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,250 @@
+package server_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+func startUDP(t testing.TB, handler server.UDPHandler, options server.UDPOptions) *server.UDPServer {
+	options.Addrs = []string{"127.0.0.1:0"}
+	s, err := server.NewUDPServer(handler, options)
+	require.NoError(t, err, "Could not create udp server")
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func echo(c *server.UDPClient) error {
+	for msg := range c.Msgs {
+		c.Write(msg)
+	}
+	return nil
+}
+
+func dialUDP(t testing.TB, s *server.UDPServer) net.Conn {
+	conn, err := net.Dial("udp", s.Addr().String())
+	require.NoError(t, err, "Could not connect to udp server")
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func roundTrip(t testing.TB, conn net.Conn, msg string) string {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err, "Could not write to udp server")
+	buf := make([]byte, server.MAX_DATAGRAM_PACKET)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	n, err := conn.Read(buf)
+	require.NoError(t, err, "Could not read from udp server")
+	return string(buf[:n])
+}
+
+func TestUDPDispatch(t *testing.T) {
+	release := make(chan struct{})
+	var slowAddr atomic.Value
+	received := make(chan string, 16)
+	s := startUDP(t, func(c *server.UDPClient) error {
+		if c.RemoteAddr().String() == slowAddr.Load() {
+			<-release
+			for msg := range c.Msgs {
+				received <- string(msg)
+			}
+			return nil
+		}
+		return echo(c)
+	}, server.UDPOptions{Timeout: time.Second, QueueSize: 2, Overflow: server.UDP_DROP_OLDEST})
+
+	slow := dialUDP(t, s)
+	slowAddr.Store(slow.LocalAddr().String())
+	fast := dialUDP(t, s)
+
+	t.Run("slow client does not block the others", func(t *testing.T) {
+		for i := range 5 {
+			_, err := slow.Write([]byte(fmt.Sprint(i)))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "ping", roundTrip(t, fast, "ping"))
+	})
+
+	t.Run("drops the oldest datagrams when the queue is full", func(t *testing.T) {
+		close(release)
+		assert.Equal(t, "3", <-received)
+		assert.Equal(t, "4", <-received)
+		assert.Empty(t, received)
+	})
+}
+
+func TestUDPExpiry(t *testing.T) {
+	done := make(chan string, 4)
+	s := startUDP(t, func(c *server.UDPClient) error {
+		err := echo(c)
+		done <- c.RemoteAddr().String()
+		return err
+	}, server.UDPOptions{Timeout: time.Millisecond * 200})
+
+	idle := dialUDP(t, s)
+	active := dialUDP(t, s)
+	assert.Equal(t, "a", roundTrip(t, idle, "a"))
+	assert.Equal(t, "a", roundTrip(t, active, "a"))
+
+	for range 4 {
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, "b", roundTrip(t, active, "b"))
+	}
+	select {
+	case addr := <-done:
+		assert.Equal(t, idle.LocalAddr().String(), addr, "Only the idle client should have timed out")
+	default:
+		assert.Fail(t, "Idle client should have timed out")
+	}
+
+	select {
+	case addr := <-done:
+		assert.Equal(t, active.LocalAddr().String(), addr)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Active client should time out once it stops sending")
+	}
+}
+
+func TestUDPSockets(t *testing.T) {
+	// Only 127.0.0.1 is on the loopback of every system, the sockets get
+	// their own ports
+	addrs := []string{"127.0.0.1:0", "127.0.0.1:0"}
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		conn.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+	s, err := server.NewUDPServer(func(c *server.UDPClient) error {
+		for range c.Msgs {
+			c.Write([]byte(c.LocalAddr().String()))
+		}
+		return nil
+	}, server.UDPOptions{Addrs: addrs, Timeout: time.Second})
+	require.NoError(t, err, "Could not create udp server")
+	go s.Start()
+	defer s.Stop()
+	require.Len(t, s.Addrs(), len(addrs))
+
+	t.Run("replies from the socket a datagram arrived on", func(t *testing.T) {
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer client.Close()
+
+		buf := make([]byte, 64)
+		for _, addr := range s.Addrs()[:2] {
+			for range 2 {
+				_, err := client.WriteTo([]byte("ping"), addr)
+				require.NoError(t, err)
+				client.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+				n, from, err := client.ReadFrom(buf)
+				require.NoError(t, err)
+				assert.Equal(t, addr.String(), from.String())
+				assert.Equal(t, addr.String(), string(buf[:n]))
+			}
+		}
+	})
+
+	t.Run("serves IPv6 clients", func(t *testing.T) {
+		if len(addrs) < 3 {
+			t.Skip("IPv6 loopback is not available")
+		}
+		addr := s.Addrs()[2].String()
+		conn, err := net.Dial("udp6", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, addr, roundTrip(t, conn, "ping"))
+	})
+
+	t.Run("stops every socket", func(t *testing.T) {
+		require.NoError(t, s.Stop())
+		for _, socket := range s.Sockets {
+			_, _, err := socket.ReadFrom(make([]byte, 1))
+			assert.ErrorIs(t, err, net.ErrClosed)
+		}
+	})
+}
+
+// BenchmarkUDPPeers runs b.N echo round trips spread over many peers at once,
+// optionally with one peer whose handler never reads its queue
+func BenchmarkUDPPeers(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	for _, peers := range []int{100, 1000, 5000} {
+		for _, stuck := range []bool{false, true} {
+			b.Run(fmt.Sprintf("peers=%d/stuck=%v", peers, stuck), func(b *testing.B) {
+				benchmarkUDPPeers(b, peers, stuck)
+			})
+		}
+	}
+}
+
+func benchmarkUDPPeers(b *testing.B, peers int, stuck bool) {
+	block := make(chan struct{})
+	defer close(block)
+	var stuckAddr atomic.Value
+	s := startUDP(b, func(c *server.UDPClient) error {
+		if c.RemoteAddr().String() == stuckAddr.Load() {
+			<-block
+		}
+		return echo(c)
+	}, server.UDPOptions{Timeout: time.Minute})
+
+	conns := make([]net.Conn, peers)
+	for i := range conns {
+		conns[i] = dialUDP(b, s)
+	}
+	if stuck {
+		stuckAddr.Store(conns[0].LocalAddr().String())
+		go func() {
+			for {
+				if _, err := conns[0].Write([]byte("stuck")); err != nil {
+					return
+				}
+				time.Sleep(time.Microsecond * 100)
+			}
+		}()
+		conns = conns[1:]
+	}
+
+	var lost atomic.Int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for i, conn := range conns {
+		trips := b.N / len(conns)
+		if i < b.N%len(conns) {
+			trips++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			for range trips {
+				for {
+					conn.Write([]byte("ping"))
+					conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+					_, err := conn.Read(buf)
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						lost.Add(1)
+						continue
+					}
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(lost.Load()), "lost")
+}
@@ -0,0 +1,250 @@
+package servertest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// Client is a connection failing its test when it does not get what it
+// expects within Timeout
+type Client struct {
+	T       testing.TB
+	Conn    net.Conn
+	Timeout time.Duration
+	reader  *bufio.Reader
+}
+
+func newClient(t testing.TB, conn net.Conn) Client {
+	return Client{t, conn, TIMEOUT, bufio.NewReader(conn)}
+}
+
+func (c *Client) write(data []byte) {
+	c.T.Helper()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := c.Conn.Write(data)
+	require.NoError(c.T, err, "Could not write to the server")
+}
+
+// read runs f with a deadline of Timeout
+func (c *Client) read(f func(r *bufio.Reader) error) {
+	c.T.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	require.NoError(c.T, f(c.reader), "Could not read from the server")
+}
+
+// ExpectClosed fails unless the server closes the connection without
+// sending anything more
+func (c *Client) ExpectClosed() {
+	c.T.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	data, err := c.reader.ReadByte()
+	if err == nil {
+		assert.Fail(c.T, "Connection should be closed", "received %q", data)
+		return
+	}
+	assert.True(c.T, errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed), "Connection should be closed, got %v", err)
+}
+
+// ExpectNothing fails if the server sends anything for d
+func (c *Client) ExpectNothing(d time.Duration) {
+	c.T.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	_, err := c.reader.Peek(1)
+	assert.ErrorIs(c.T, err, os.ErrDeadlineExceeded, "Server should not send anything")
+}
+
+// LineClient speaks a line based protocol
+type LineClient struct {
+	Client
+}
+
+func NewLineClient(t testing.TB, conn net.Conn) *LineClient {
+	return &LineClient{newClient(t, conn)}
+}
+
+// Send writes every line with a newline
+func (c *LineClient) Send(lines ...string) {
+	c.T.Helper()
+	c.write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// Read reads the next line without its terminator
+func (c *LineClient) Read() (line string) {
+	c.T.Helper()
+	c.read(func(r *bufio.Reader) (err error) {
+		line, err = r.ReadString('\n')
+		return
+	})
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Expect reads a line for every line expected
+func (c *LineClient) Expect(lines ...string) {
+	c.T.Helper()
+	for _, line := range lines {
+		assert.Equal(c.T, line, c.Read())
+	}
+}
+
+// JSONClient sends and receives one JSON value per line
+type JSONClient struct {
+	LineClient
+}
+
+func NewJSONClient(t testing.TB, conn net.Conn) *JSONClient {
+	return &JSONClient{LineClient{newClient(t, conn)}}
+}
+
+// SendJSON writes every value on its own line
+func (c *JSONClient) SendJSON(values ...any) {
+	c.T.Helper()
+	for _, v := range values {
+		data, err := json.Marshal(v)
+		require.NoError(c.T, err)
+		c.Send(string(data))
+	}
+}
+
+// ReadJSON decodes the next line into v
+func (c *JSONClient) ReadJSON(v any) {
+	c.T.Helper()
+	require.NoError(c.T, json.Unmarshal([]byte(c.Read()), v), "Server sent invalid JSON")
+}
+
+// Expect reads a line for every JSON document expected, the documents are
+// compared regardless of formatting and field order
+func (c *JSONClient) Expect(documents ...string) {
+	c.T.Helper()
+	for _, document := range documents {
+		assert.JSONEq(c.T, document, c.Read())
+	}
+}
+
+// Marshaler is a packet of a binary protocol
+type Marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// BinaryClient speaks a binary protocol, numbers are big endian
+type BinaryClient struct {
+	Client
+}
+
+func NewBinaryClient(t testing.TB, conn net.Conn) *BinaryClient {
+	return &BinaryClient{newClient(t, conn)}
+}
+
+func (c *BinaryClient) Send(data ...byte) {
+	c.T.Helper()
+	c.write(data)
+}
+
+// SendPacket writes every packet
+func (c *BinaryClient) SendPacket(packets ...Marshaler) {
+	c.T.Helper()
+	for _, p := range packets {
+		data, err := p.Marshal()
+		require.NoError(c.T, err, "Could not marshal %T", p)
+		c.write(data)
+	}
+}
+
+// ReadN reads the next n bytes
+func (c *BinaryClient) ReadN(n int) []byte {
+	c.T.Helper()
+	data := make([]byte, n)
+	c.read(func(r *bufio.Reader) error {
+		_, err := io.ReadFull(r, data)
+		return err
+	})
+	return data
+}
+
+// Decode runs decode on the connection, for packets read by their own code
+func (c *BinaryClient) Decode(decode func(r io.Reader) error) {
+	c.T.Helper()
+	c.read(func(r *bufio.Reader) error {
+		return decode(r)
+	})
+}
+
+// ReadB reads v, a fixed size value, see binary.Read
+func (c *BinaryClient) ReadB(v any) {
+	c.T.Helper()
+	c.Decode(func(r io.Reader) error {
+		return binary.Read(r, binary.BigEndian, v)
+	})
+}
+
+func (c *BinaryClient) Expect(data ...byte) {
+	c.T.Helper()
+	assert.Equal(c.T, data, c.ReadN(len(data)))
+}
+
+// ExpectPacket reads the bytes of every packet expected
+func (c *BinaryClient) ExpectPacket(packets ...Marshaler) {
+	c.T.Helper()
+	for _, p := range packets {
+		data, err := p.Marshal()
+		require.NoError(c.T, err, "Could not marshal %T", p)
+		assert.Equal(c.T, data, c.ReadN(len(data)), "Expected %T", p)
+	}
+}
+
+// UDPClient sends and receives datagrams
+type UDPClient struct {
+	T       testing.TB
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+func DialUDP(t testing.TB, addr string) *UDPClient {
+	return &UDPClient{t, Dial(t, "udp", addr), TIMEOUT}
+}
+
+// Send writes every message as its own datagram
+func (c *UDPClient) Send(messages ...string) {
+	c.T.Helper()
+	for _, message := range messages {
+		_, err := c.Conn.Write([]byte(message))
+		require.NoError(c.T, err, "Could not write to the server")
+	}
+}
+
+// Read reads the next datagram
+func (c *UDPClient) Read() string {
+	c.T.Helper()
+	buf := make([]byte, server.MAX_DATAGRAM_PACKET)
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	n, err := c.Conn.Read(buf)
+	require.NoError(c.T, err, "Could not read from the server")
+	return string(buf[:n])
+}
+
+// Expect reads a datagram for every message expected
+func (c *UDPClient) Expect(messages ...string) {
+	c.T.Helper()
+	for _, message := range messages {
+		assert.Equal(c.T, message, c.Read())
+	}
+}
+
+// ExpectNothing fails if the server sends anything for d
+func (c *UDPClient) ExpectNothing(d time.Duration) {
+	c.T.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	n, err := c.Conn.Read(make([]byte, server.MAX_DATAGRAM_PACKET))
+	assert.ErrorIs(c.T, err, os.ErrDeadlineExceeded, "Server should not send anything, got %d bytes", n)
+}
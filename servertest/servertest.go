@@ -0,0 +1,139 @@
+// Package servertest runs servers inside tests, on ephemeral ports or over
+// in memory connections, and talks to them through typed clients.
+package servertest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// ADDR is the address to create servers on, the system picks a free port so
+// tests can run in parallel
+const ADDR = "127.0.0.1:0"
+
+// TIMEOUT is how long clients wait for what they expect
+const TIMEOUT = time.Second
+
+// Start runs s until the end of the test and returns its address. s must have
+// been created on ADDR and have an Addr method.
+func Start(t testing.TB, s server.Server) string {
+	t.Helper()
+	var addr string
+	switch s := s.(type) {
+	case interface{ Addr() net.Addr }:
+		addr = s.Addr().String()
+	case interface{ Addr() string }:
+		addr = s.Addr()
+	default:
+		require.FailNow(t, fmt.Sprintf("%T has no Addr method", s))
+	}
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	return addr
+}
+
+// Pipe runs s over an in memory connection until the end of the test and
+// returns the end of the client. Only TCP servers can be piped, their
+// listener is swapped for one handing out the connection, so s may have been
+// created on any address. UDP servers read datagrams from their own sockets
+// and have to be started on ADDR instead, see Start. Writes block until the
+// other end reads, so the client must read what the server writes before
+// writing more.
+func Pipe(t testing.TB, s server.Server) net.Conn {
+	t.Helper()
+	tcp, ok := s.(*server.TCPServer)
+	if !ok {
+		require.FailNow(t, fmt.Sprintf("%T can not be piped, only TCP servers can", s))
+	}
+	if tcp.Listener != nil {
+		tcp.Listener.Close()
+	}
+	listener := &pipeListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	tcp.Listener = listener
+
+	client, conn := net.Pipe()
+	listener.conns <- conn
+	go s.Start()
+	t.Cleanup(func() {
+		client.Close()
+		s.Stop()
+	})
+	return client
+}
+
+// pipeListener hands out the connections queued in conns
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// Dial connects to addr until the end of the test
+func Dial(t testing.TB, network string, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err, "Could not connect to %s", addr)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Listen accepts connections on an ephemeral port until the end of the test,
+// to stand in for the upstream servers of proxies
+func Listen(t testing.TB) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", ADDR)
+	require.NoError(t, err, "Could not listen")
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// Accept waits for the next connection of listener
+func Accept(t testing.TB, listener net.Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+		close(accepted)
+	}()
+	select {
+	case conn, ok := <-accepted:
+		require.True(t, ok, "Could not accept a connection")
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(TIMEOUT):
+		require.FailNow(t, "No connection to accept")
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package servertest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/primetime"
+	"github.com/wizzymore/tcp-go/server"
+	"github.com/wizzymore/tcp-go/servertest"
+	"github.com/wizzymore/tcp-go/smoke_test"
+)
+
+// tcpServer creates a server for handler, to be piped
+func tcpServer(t *testing.T, handler server.TCPHandle) server.Server {
+	s, err := server.NewTCPServer(handler, servertest.ADDR)
+	require.NoError(t, err, "Could not create tcp server")
+	return s
+}
+
+func TestPipe(t *testing.T) {
+	t.Parallel()
+
+	t.Run("runs line protocols", func(t *testing.T) {
+		client := servertest.NewLineClient(t, servertest.Pipe(t, tcpServer(t, smoke_test.Handler)))
+		client.Send("hello")
+		client.Expect("hello")
+		client.Send("one", "two")
+		client.Expect("one", "two")
+	})
+
+	t.Run("runs binary protocols", func(t *testing.T) {
+		client := servertest.NewBinaryClient(t, servertest.Pipe(t, tcpServer(t, smoke_test.Handler)))
+		client.Send(0x01, 0x02, 0x03, 0x04)
+		client.Expect(0x01, 0x02)
+		var n uint16
+		client.ReadB(&n)
+		require.Equal(t, uint16(0x0304), n)
+		client.ExpectNothing(time.Millisecond * 50)
+	})
+
+	t.Run("runs json protocols", func(t *testing.T) {
+		client := servertest.NewJSONClient(t, servertest.Pipe(t, tcpServer(t, primetime.Handler)))
+		client.SendJSON(map[string]any{"method": "isPrime", "number": 7})
+		client.Expect(`{"prime":true,"method":"isPrime"}`)
+		client.Send(`{"method":"isPrime","number":"7"}`)
+		var response map[string]any
+		client.ReadJSON(&response)
+		require.Contains(t, response, "error")
+		client.ExpectClosed()
+	})
+
+	t.Run("runs middlewares", func(t *testing.T) {
+		s, err := server.NewTCPServer(func(c *server.TCPClient) error {
+			panic("boom")
+		}, servertest.ADDR)
+		require.NoError(t, err, "Could not create tcp server")
+		metrics := &server.Metrics{}
+		s.Use(metrics.Middleware)
+		client := servertest.NewLineClient(t, servertest.Pipe(t, s))
+		client.ExpectClosed()
+		require.Equal(t, int64(1), metrics.Failed.Load())
+	})
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+
+	s, err := server.NewUDPServer(func(c *server.UDPClient) error {
+		for msg := range c.Msgs {
+			if string(msg) != "quiet" {
+				c.Write(msg)
+			}
+		}
+		return nil
+	}, server.UDPOptions{Addrs: []string{servertest.ADDR}, Timeout: time.Second})
+	require.NoError(t, err, "Could not create udp server")
+	client := servertest.DialUDP(t, servertest.Start(t, s))
+
+	client.Send("ping", "quiet", "pong")
+	client.Expect("ping", "pong")
+	client.ExpectNothing(time.Millisecond * 50)
+}
@@ -11,23 +11,23 @@ import (
 )
 
 func (p *IAmCameraPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Road)
+	err = binary.Write(buff, binary.BigEndian, p.Road)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Mile)
+	err = binary.Write(buff, binary.BigEndian, p.Mile)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Limit)
+	err = binary.Write(buff, binary.BigEndian, p.Limit)
 	if err != nil {
 		return
 	}
@@ -37,7 +37,6 @@ func (p *IAmCameraPacket) Marshal() (b []byte, err error) {
 }
 
 func (p *IAmCameraPacket) Unmarshal(r io.Reader) (err error) {
-
 	err = reader.ReadB(r, &p.Road)
 	if err != nil {
 		return
@@ -57,7 +56,7 @@ func (p *IAmCameraPacket) Unmarshal(r io.Reader) (err error) {
 }
 
 func (p *IAmDispatcherPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
@@ -67,7 +66,7 @@ func (p *IAmDispatcherPacket) Marshal() (b []byte, err error) {
 	if err != nil {
 		return
 	}
-	err = binary.Write(&buff, binary.BigEndian, p.Roads)
+	err = binary.Write(buff, binary.BigEndian, p.Roads)
 	if err != nil {
 		return
 	}
@@ -77,26 +76,28 @@ func (p *IAmDispatcherPacket) Marshal() (b []byte, err error) {
 }
 
 func (p *IAmDispatcherPacket) Unmarshal(r io.Reader) (err error) {
-
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length uint8
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
-		buf := make([]uint16, length)
-		err = reader.ReadB(r, buf)
-		if err != nil {
-			return
+		p.Roads = []uint16{}
+		for range length {
+			var elem uint16
+			err = reader.ReadB(r, &elem)
+			if err != nil {
+				return
+			}
+			p.Roads = append(p.Roads, elem)
 		}
-		p.Roads = buf
 	}
 
 	return
 }
 
 func (p *ErrorPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
@@ -106,32 +107,28 @@ func (p *ErrorPacket) Marshal() (b []byte, err error) {
 	if err != nil {
 		return
 	}
-	n, err := buff.WriteString(p.Message)
-	if err != nil {
-		return
-	}
-	if n != len(p.Message) {
-		err = io.ErrUnexpectedEOF
-		return
-	}
+	buff.WriteString(p.Message)
 
 	b = buff.Bytes()
 	return
 }
 
 func (p *ErrorPacket) Unmarshal(r io.Reader) (err error) {
-
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length uint8
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
 		var buf []byte
-		buf, err = reader.ReadN(r, int(length))
+		buf, err = io.ReadAll(io.LimitReader(r, int64(length)))
 		if err != nil {
 			return
 		}
+		if len(buf) != int(length) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
 		p.Message = string(buf)
 	}
 
@@ -139,7 +136,7 @@ func (p *ErrorPacket) Unmarshal(r io.Reader) (err error) {
 }
 
 func (p *PlatePacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
@@ -149,16 +146,9 @@ func (p *PlatePacket) Marshal() (b []byte, err error) {
 	if err != nil {
 		return
 	}
-	n, err := buff.WriteString(p.Plate)
-	if err != nil {
-		return
-	}
-	if n != len(p.Plate) {
-		err = io.ErrUnexpectedEOF
-		return
-	}
+	buff.WriteString(p.Plate)
 
-	err = binary.Write(&buff, binary.BigEndian, p.Timestamp)
+	err = binary.Write(buff, binary.BigEndian, p.Timestamp)
 	if err != nil {
 		return
 	}
@@ -168,18 +158,21 @@ func (p *PlatePacket) Marshal() (b []byte, err error) {
 }
 
 func (p *PlatePacket) Unmarshal(r io.Reader) (err error) {
-
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length uint8
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
 		var buf []byte
-		buf, err = reader.ReadN(r, int(length))
+		buf, err = io.ReadAll(io.LimitReader(r, int64(length)))
 		if err != nil {
 			return
 		}
+		if len(buf) != int(length) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
 		p.Plate = string(buf)
 	}
 
@@ -192,7 +185,7 @@ func (p *PlatePacket) Unmarshal(r io.Reader) (err error) {
 }
 
 func (p *TicketPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
@@ -202,41 +195,34 @@ func (p *TicketPacket) Marshal() (b []byte, err error) {
 	if err != nil {
 		return
 	}
-	n, err := buff.WriteString(p.Plate)
-	if err != nil {
-		return
-	}
-	if n != len(p.Plate) {
-		err = io.ErrUnexpectedEOF
-		return
-	}
+	buff.WriteString(p.Plate)
 
-	err = binary.Write(&buff, binary.BigEndian, p.Road)
+	err = binary.Write(buff, binary.BigEndian, p.Road)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Mile1)
+	err = binary.Write(buff, binary.BigEndian, p.Mile1)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Timestamp1)
+	err = binary.Write(buff, binary.BigEndian, p.Timestamp1)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Mile2)
+	err = binary.Write(buff, binary.BigEndian, p.Mile2)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Timestamp2)
+	err = binary.Write(buff, binary.BigEndian, p.Timestamp2)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Speed)
+	err = binary.Write(buff, binary.BigEndian, p.Speed)
 	if err != nil {
 		return
 	}
@@ -246,18 +232,21 @@ func (p *TicketPacket) Marshal() (b []byte, err error) {
 }
 
 func (p *TicketPacket) Unmarshal(r io.Reader) (err error) {
-
 	{
-		var length byte
-		length, err = reader.ReadByte(r)
+		var length uint8
+		err = reader.ReadB(r, &length)
 		if err != nil {
 			return
 		}
 		var buf []byte
-		buf, err = reader.ReadN(r, int(length))
+		buf, err = io.ReadAll(io.LimitReader(r, int64(length)))
 		if err != nil {
 			return
 		}
+		if len(buf) != int(length) {
+			err = io.ErrUnexpectedEOF
+			return
+		}
 		p.Plate = string(buf)
 	}
 
@@ -295,13 +284,13 @@ func (p *TicketPacket) Unmarshal(r io.Reader) (err error) {
 }
 
 func (p *WantHeartbeatPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buff, binary.BigEndian, p.Interval)
+	err = binary.Write(buff, binary.BigEndian, p.Interval)
 	if err != nil {
 		return
 	}
@@ -311,7 +300,6 @@ func (p *WantHeartbeatPacket) Marshal() (b []byte, err error) {
 }
 
 func (p *WantHeartbeatPacket) Unmarshal(r io.Reader) (err error) {
-
 	err = reader.ReadB(r, &p.Interval)
 	if err != nil {
 		return
@@ -321,7 +309,7 @@ func (p *WantHeartbeatPacket) Unmarshal(r io.Reader) (err error) {
 }
 
 func (p *HeartbeatPacket) Marshal() (b []byte, err error) {
-	buff := bytes.Buffer{}
+	buff := &bytes.Buffer{}
 	err = buff.WriteByte(p.Opcode())
 	if err != nil {
 		return
@@ -332,6 +320,5 @@ func (p *HeartbeatPacket) Marshal() (b []byte, err error) {
 }
 
 func (p *HeartbeatPacket) Unmarshal(r io.Reader) (err error) {
-
 	return
 }
@@ -33,8 +33,14 @@ type TrafficServer struct {
 }
 
 func NewTrafficServer() (s server.Server, err error) {
+	return NewTrafficServerOn("")
+}
+
+// NewTrafficServerOn is NewTrafficServer listening on bindAddr, ":8000" when
+// it is empty
+func NewTrafficServerOn(bindAddr string) (s server.Server, err error) {
 	ts := &TrafficServer{}
-	ts.server, err = server.NewTCPServer(ts.HandleClient)
+	ts.server, err = server.NewTCPServer(ts.HandleClient, bindAddr)
 	ts.messages = make(chan message, 32)
 	ctx, close := context.WithCancel(context.Background())
 	ts.ctx = ctx
@@ -42,6 +48,10 @@ func NewTrafficServer() (s server.Server, err error) {
 	return ts, err
 }
 
+func (self *TrafficServer) Addr() net.Addr {
+	return self.server.Addr()
+}
+
 func (self *TrafficServer) Start() {
 	self.wg.Add(1)
 	go self.handlingServer()
@@ -116,16 +126,8 @@ func (self *TrafficServer) HandleClient(client *server.TCPClient) (err error) {
 			}
 		default:
 			client.Logger.Warn().Hex("opcode", []byte{opcode}).Msg("received invalid opcode")
-			errorPacket := ErrorPacket{"received invalid opcode"}
-			var data []byte
-			data, err = errorPacket.Marshal()
-			if err != nil {
-				return errors.Join(err, errors.New("could not marshal error packet"))
-			}
-			_, err = client.Write(data)
-			if err != nil {
-				return
-			}
+			sendError(client, "received invalid opcode")
+			return errors.New("received invalid opcode")
 		}
 
 		self.messages <- message{
@@ -189,30 +191,22 @@ func (self *TrafficServer) handlingServer() {
 					go handleHeartbeath(message.client, p.Interval, ctx, &self.wg)
 				case *IAmCameraPacket:
 					if _, ok := cameras[message.client.Id]; ok {
-						errorPacket := ErrorPacket{"you already are a camera"}
-						data, _ := errorPacket.Marshal()
-						_, _ = message.client.Write(data)
+						sendError(message.client, "you already are a camera")
 						break
 					}
 					if _, ok := dispatchers[message.client.Id]; ok {
-						errorPacket := ErrorPacket{"you already are a dispatcher"}
-						data, _ := errorPacket.Marshal()
-						_, _ = message.client.Write(data)
+						sendError(message.client, "you already are a dispatcher")
 						break
 					}
 					log.Info().Any("packet", p).Uint("peer", message.client.Id).Msg("a new camera connected")
 					cameras[message.client.Id] = p
 				case *IAmDispatcherPacket:
 					if _, ok := dispatchers[message.client.Id]; ok {
-						errorPacket := ErrorPacket{"you already are a dispatcher"}
-						data, _ := errorPacket.Marshal()
-						_, _ = message.client.Write(data)
+						sendError(message.client, "you already are a dispatcher")
 						break
 					}
 					if _, ok := cameras[message.client.Id]; ok {
-						errorPacket := ErrorPacket{"you already are a camera"}
-						data, _ := errorPacket.Marshal()
-						_, _ = message.client.Write(data)
+						sendError(message.client, "you already are a camera")
 						break
 					}
 					log.Info().Any("packet", p).Uint("peer", message.client.Id).Msg("a new dispatcher connected")
@@ -240,9 +234,7 @@ func (self *TrafficServer) handlingServer() {
 				case *PlatePacket:
 					camera, ok := cameras[message.client.Id]
 					if !ok {
-						errorPacket := ErrorPacket{"you must be a camera to send plates"}
-						data, _ := errorPacket.Marshal()
-						_, _ = message.client.Write(data)
+						sendError(message.client, "you must be a camera to send plates")
 						break
 					}
 
@@ -423,6 +415,15 @@ func (self *TrafficServer) handlingServer() {
 	}
 }
 
+// sendError sends an error to client and disconnects it, as the protocol
+// requires
+func sendError(client *server.TCPClient, message string) {
+	errorPacket := ErrorPacket{message}
+	data, _ := errorPacket.Marshal()
+	_, _ = client.Write(data)
+	client.Close()
+}
+
 func sendTicket(client *server.TCPClient, ticket *TicketPacket, day int) error {
 	data, err := ticket.Marshal()
 	if err != nil {
@@ -0,0 +1,63 @@
+package traffic_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/servertest"
+	"github.com/wizzymore/tcp-go/traffic"
+)
+
+func startTraffic(t *testing.T) string {
+	s, err := traffic.NewTrafficServerOn(servertest.ADDR)
+	require.NoError(t, err, "Could not create traffic server")
+	return servertest.Start(t, s)
+}
+
+func dialTraffic(t *testing.T, addr string) *servertest.BinaryClient {
+	return servertest.NewBinaryClient(t, servertest.Dial(t, "tcp", addr))
+}
+
+func TestTraffic(t *testing.T) {
+	t.Parallel()
+	addr := startTraffic(t)
+
+	t.Run("tickets speeding cars", func(t *testing.T) {
+		camera1 := dialTraffic(t, addr)
+		camera1.SendPacket(&traffic.IAmCameraPacket{Road: 123, Mile: 8, Limit: 60}, &traffic.PlatePacket{Plate: "UN1X", Timestamp: 0})
+		camera2 := dialTraffic(t, addr)
+		camera2.SendPacket(&traffic.IAmCameraPacket{Road: 123, Mile: 9, Limit: 60}, &traffic.PlatePacket{Plate: "UN1X", Timestamp: 45})
+
+		dispatcher := dialTraffic(t, addr)
+		dispatcher.SendPacket(&traffic.IAmDispatcherPacket{Roads: []uint16{123}})
+		dispatcher.ExpectPacket(&traffic.TicketPacket{
+			Plate:      "UN1X",
+			Road:       123,
+			Mile1:      8,
+			Timestamp1: 0,
+			Mile2:      9,
+			Timestamp2: 45,
+			Speed:      8000,
+		})
+	})
+
+	t.Run("sends heartbeats", func(t *testing.T) {
+		client := dialTraffic(t, addr)
+		client.SendPacket(&traffic.WantHeartbeatPacket{Interval: 1})
+		client.ExpectPacket(&traffic.HeartbeatPacket{}, &traffic.HeartbeatPacket{})
+	})
+
+	t.Run("rejects clients identifying twice", func(t *testing.T) {
+		client := dialTraffic(t, addr)
+		client.SendPacket(&traffic.IAmCameraPacket{Road: 1, Mile: 1, Limit: 1}, &traffic.IAmCameraPacket{Road: 1, Mile: 1, Limit: 1})
+		client.ExpectPacket(&traffic.ErrorPacket{Message: "you already are a camera"})
+		client.ExpectClosed()
+	})
+
+	t.Run("disconnects clients sending invalid opcodes", func(t *testing.T) {
+		client := dialTraffic(t, addr)
+		client.Send(0xff)
+		client.ExpectPacket(&traffic.ErrorPacket{Message: "received invalid opcode"})
+		client.ExpectClosed()
+	})
+}
@@ -0,0 +1,152 @@
+package vcs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every name segment is prefixed so a name can be a file and a directory at
+// once: "/a/b" is stored in "d_a/f_b/" with a file per revision.
+const (
+	DISK_DIR_PREFIX  = "d_"
+	DISK_FILE_PREFIX = "f_"
+)
+
+type diskStorage struct {
+	root string
+	// lock serializes the writes, revisions are written once so reads only
+	// race with a revision being added
+	lock sync.Mutex
+}
+
+func NewDiskStorage(root string) (Storage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &diskStorage{root: root}, nil
+}
+
+func (s *diskStorage) dirPath(dir string) string {
+	path := s.root
+	for segment := range strings.SplitSeq(strings.Trim(dir, "/"), "/") {
+		if segment != "" {
+			path = filepath.Join(path, DISK_DIR_PREFIX+segment)
+		}
+	}
+	return path
+}
+
+func (s *diskStorage) filePath(name string) string {
+	dir, file := path.Split(name)
+	return filepath.Join(s.dirPath(dir), DISK_FILE_PREFIX+file)
+}
+
+// revisions counts the revisions of the file at path
+func revisions(path string) (int, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *diskStorage) Put(name string, data []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := s.filePath(name)
+	latest, err := revisions(path)
+	if err != nil {
+		return 0, err
+	}
+	if latest > 0 {
+		current, err := os.ReadFile(filepath.Join(path, strconv.Itoa(latest)))
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(current, data) {
+			return latest, nil
+		}
+	}
+
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(path, ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(path, strconv.Itoa(latest+1))); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return latest + 1, nil
+}
+
+func (s *diskStorage) Get(name string, revision int) ([]byte, error) {
+	path := s.filePath(name)
+	latest, err := revisions(path)
+	if err != nil {
+		return nil, err
+	}
+	if latest == 0 {
+		return nil, ErrNoSuchFile
+	}
+	if revision == 0 {
+		revision = latest
+	}
+	if revision < 1 || revision > latest {
+		return nil, ErrNoSuchRevision
+	}
+	return os.ReadFile(filepath.Join(path, strconv.Itoa(revision)))
+}
+
+func (s *diskStorage) List(dir string) ([]Entry, error) {
+	dirEntries, err := os.ReadDir(s.dirPath(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []Entry{}, nil
+		}
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, entry := range dirEntries {
+		if name, ok := strings.CutPrefix(entry.Name(), DISK_DIR_PREFIX); ok {
+			entries = append(entries, Entry{Name: name, Dir: true})
+		} else if name, ok := strings.CutPrefix(entry.Name(), DISK_FILE_PREFIX); ok {
+			latest, err := revisions(filepath.Join(s.dirPath(dir), entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if latest > 0 {
+				entries = append(entries, Entry{Name: name, Revision: latest})
+			}
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
@@ -0,0 +1,108 @@
+package vcs
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoSuchFile     = errors.New("no such file")
+	ErrNoSuchRevision = errors.New("no such revision")
+)
+
+// Entry is a file or a directory of a listing, Revision is the latest
+// revision of a file
+type Entry struct {
+	Name     string
+	Dir      bool
+	Revision int
+}
+
+// Storage keeps every revision of the files. Names are valid file names
+// and dirs valid dir names ending with "/".
+type Storage interface {
+	// Put stores a new revision of the file and returns its number, the
+	// latest revision is returned when data did not change
+	Put(name string, data []byte) (int, error)
+	// Get reads a revision of the file, the latest one for revision 0
+	Get(name string, revision int) ([]byte, error)
+	// List returns the entries of dir sorted by name
+	List(dir string) ([]Entry, error)
+}
+
+type memoryStorage struct {
+	lock  sync.RWMutex
+	files map[string][][]byte
+}
+
+func NewMemoryStorage() Storage {
+	return &memoryStorage{files: make(map[string][][]byte)}
+}
+
+func (s *memoryStorage) Put(name string, data []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	revisions := s.files[name]
+	if len(revisions) > 0 && slices.Equal(revisions[len(revisions)-1], data) {
+		return len(revisions), nil
+	}
+	s.files[name] = append(revisions, slices.Clone(data))
+	return len(s.files[name]), nil
+}
+
+func (s *memoryStorage) Get(name string, revision int) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	revisions, ok := s.files[name]
+	if !ok {
+		return nil, ErrNoSuchFile
+	}
+	if revision == 0 {
+		revision = len(revisions)
+	}
+	if revision < 1 || revision > len(revisions) {
+		return nil, ErrNoSuchRevision
+	}
+	return revisions[revision-1], nil
+}
+
+func (s *memoryStorage) List(dir string) ([]Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	entries := []Entry{}
+	dirs := map[string]bool{}
+	for name, revisions := range s.files {
+		rest, ok := strings.CutPrefix(name, dir)
+		if !ok {
+			continue
+		}
+		if sub, _, isDir := strings.Cut(rest, "/"); isDir {
+			if !dirs[sub] {
+				dirs[sub] = true
+				entries = append(entries, Entry{Name: sub, Dir: true})
+			}
+		} else {
+			entries = append(entries, Entry{Name: rest, Revision: len(revisions)})
+		}
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func sortEntries(entries []Entry) {
+	slices.SortFunc(entries, func(a Entry, b Entry) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		// A file is listed before the directory of the same name
+		if a.Dir == b.Dir {
+			return 0
+		}
+		if b.Dir {
+			return -1
+		}
+		return 1
+	})
+}
@@ -0,0 +1,227 @@
+package vcs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/wizzymore/tcp-go/server"
+)
+
+// MAX_FILE_SIZE is the largest file a client may put
+const MAX_FILE_SIZE = 16 << 20
+
+// MAX_LINE_LENGTH is the longest command line, clients sending longer ones
+// are disconnected
+const MAX_LINE_LENGTH = 4096
+
+const (
+	USAGE_HELP = "OK usage: HELP|GET|PUT|LIST"
+	USAGE_GET  = "ERR usage: GET file [revision]"
+	USAGE_PUT  = "ERR usage: PUT file length newline data"
+	USAGE_LIST = "ERR usage: LIST dir"
+)
+
+var errIllegalMethod = errors.New("illegal method")
+
+type VCSServer struct {
+	server  *server.TCPServer
+	storage Storage
+}
+
+func NewVCSServer(storage Storage, bindAddr ...string) (s *VCSServer, err error) {
+	vcs := &VCSServer{storage: storage}
+	vcs.server, err = server.NewTCPServer(vcs.HandleClient, bindAddr...)
+	return vcs, err
+}
+
+func (self *VCSServer) Start() {
+	self.server.Start()
+}
+
+func (self *VCSServer) Stop() error {
+	return self.server.Stop()
+}
+
+func (self *VCSServer) Addr() string {
+	return self.server.Listener.Addr().String()
+}
+
+// validName reports if name is an absolute path of letters, digits and
+// ".-_" without empty segments, dirs may end with a "/"
+func validName(name string, dir bool) bool {
+	if !strings.HasPrefix(name, "/") || strings.Contains(name, "//") {
+		return false
+	}
+	if !dir && strings.HasSuffix(name, "/") {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("/.-_", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isText reports if data only holds printable ASCII and whitespace
+func isText(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 || b > 0x7e) && b != '\n' && b != '\r' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *VCSServer) HandleClient(c *server.TCPClient) error {
+	r := server.NewLineConn(c, server.LineOptions{MaxLineLength: MAX_LINE_LENGTH})
+	w := bufio.NewWriter(c)
+	for {
+		w.WriteString("READY\n")
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		line, err := r.ReadString()
+		if err != nil {
+			if errors.Is(err, server.ErrLineTooLong) {
+				fmt.Fprintln(w, "ERR line too long")
+				w.Flush()
+				return err
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		fields := strings.Fields(line)
+		method := ""
+		if len(fields) > 0 {
+			method = strings.ToUpper(fields[0])
+		}
+
+		switch method {
+		case "HELP":
+			fmt.Fprintln(w, USAGE_HELP)
+		case "PUT":
+			err = self.put(r, w, fields)
+		case "GET":
+			err = self.get(w, fields)
+		case "LIST":
+			err = self.list(w, fields)
+		default:
+			fmt.Fprintf(w, "ERR illegal method: %s\n", method)
+			w.Flush()
+			return fmt.Errorf("%w `%s`", errIllegalMethod, method)
+		}
+		if err != nil {
+			w.Flush()
+			return err
+		}
+	}
+}
+
+func (self *VCSServer) put(r io.Reader, w *bufio.Writer, fields []string) error {
+	if len(fields) != 3 {
+		fmt.Fprintln(w, USAGE_PUT)
+		return nil
+	}
+	length, err := strconv.Atoi(fields[2])
+	if err != nil || length < 0 {
+		fmt.Fprintln(w, USAGE_PUT)
+		return nil
+	}
+	if length > MAX_FILE_SIZE {
+		fmt.Fprintln(w, "ERR file too large")
+		return fmt.Errorf("file of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	name := fields[1]
+	if !validName(name, false) {
+		fmt.Fprintln(w, "ERR illegal file name")
+		return nil
+	}
+	if !isText(data) {
+		fmt.Fprintln(w, "ERR text files only")
+		return nil
+	}
+	revision, err := self.storage.Put(name, data)
+	if err != nil {
+		fmt.Fprintln(w, "ERR could not store file")
+		return err
+	}
+	fmt.Fprintf(w, "OK r%d\n", revision)
+	return nil
+}
+
+func (self *VCSServer) get(w *bufio.Writer, fields []string) error {
+	if len(fields) != 2 && len(fields) != 3 {
+		fmt.Fprintln(w, USAGE_GET)
+		return nil
+	}
+	name := fields[1]
+	if !validName(name, false) {
+		fmt.Fprintln(w, "ERR illegal file name")
+		return nil
+	}
+	revision := 0
+	if len(fields) == 3 {
+		var err error
+		revision, err = strconv.Atoi(strings.TrimPrefix(fields[2], "r"))
+		if err != nil || revision < 1 {
+			fmt.Fprintln(w, "ERR no such revision")
+			return nil
+		}
+	}
+
+	data, err := self.storage.Get(name, revision)
+	if errors.Is(err, ErrNoSuchFile) || errors.Is(err, ErrNoSuchRevision) {
+		fmt.Fprintf(w, "ERR %s\n", err)
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintln(w, "ERR could not read file")
+		return err
+	}
+	fmt.Fprintf(w, "OK %d\n", len(data))
+	_, err = w.Write(data)
+	return err
+}
+
+func (self *VCSServer) list(w *bufio.Writer, fields []string) error {
+	if len(fields) != 2 {
+		fmt.Fprintln(w, USAGE_LIST)
+		return nil
+	}
+	dir := fields[1]
+	if !validName(dir, true) {
+		fmt.Fprintln(w, "ERR illegal dir name")
+		return nil
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	entries, err := self.storage.List(dir)
+	if err != nil {
+		fmt.Fprintln(w, "ERR could not list dir")
+		return err
+	}
+	fmt.Fprintf(w, "OK %d\n", len(entries))
+	for _, entry := range entries {
+		if entry.Dir {
+			fmt.Fprintf(w, "%s/ DIR\n", entry.Name)
+		} else {
+			fmt.Fprintf(w, "%s r%d\n", entry.Name, entry.Revision)
+		}
+	}
+	return nil
+}
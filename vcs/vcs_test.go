@@ -0,0 +1,119 @@
+package vcs_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wizzymore/tcp-go/vcs"
+)
+
+type vcsClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *vcsClient) readLine(t *testing.T) string {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	line, err := c.reader.ReadString('\n')
+	require.NoError(t, err, "Could not read from vcs server")
+	return strings.TrimSuffix(line, "\n")
+}
+
+// request sends raw and returns the lines answered before the next READY
+func (c *vcsClient) request(t *testing.T, raw string) []string {
+	_, err := c.conn.Write([]byte(raw))
+	require.NoError(t, err, "Could not write to vcs server")
+	lines := []string{}
+	for {
+		line := c.readLine(t)
+		if line == "READY" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func startVCS(t *testing.T, storage vcs.Storage) *vcsClient {
+	s, err := vcs.NewVCSServer(storage, "127.0.0.1:0")
+	require.NoError(t, err, "Could not create vcs server")
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	conn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err, "Could not connect to vcs server")
+	t.Cleanup(func() { conn.Close() })
+	c := &vcsClient{conn, bufio.NewReader(conn)}
+	assert.Equal(t, "READY", c.readLine(t))
+	return c
+}
+
+func TestVCS(t *testing.T) {
+	disk, err := vcs.NewDiskStorage(t.TempDir())
+	require.NoError(t, err)
+
+	for name, storage := range map[string]vcs.Storage{"memory": vcs.NewMemoryStorage(), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			c := startVCS(t, storage)
+
+			t.Run("stores revisions", func(t *testing.T) {
+				assert.Equal(t, []string{"OK r1"}, c.request(t, "PUT /a/b.txt 6\nhello\n"))
+				assert.Equal(t, []string{"OK r2"}, c.request(t, "put /a/b.txt 4\nbye\n"))
+				assert.Equal(t, []string{"OK r2"}, c.request(t, "PUT /a/b.txt 4\nbye\n"), "Same content should keep the revision")
+				assert.Equal(t, []string{"OK r1"}, c.request(t, "PUT /a/c/d 0\n"))
+				assert.Equal(t, []string{"OK r1"}, c.request(t, "PUT /a 2\na\n"))
+			})
+
+			t.Run("reads revisions", func(t *testing.T) {
+				assert.Equal(t, []string{"OK 4", "bye"}, c.request(t, "GET /a/b.txt\n"))
+				assert.Equal(t, []string{"OK 6", "hello"}, c.request(t, "GET /a/b.txt r1\n"))
+				assert.Equal(t, []string{"OK 4", "bye"}, c.request(t, "GET /a/b.txt 2\n"))
+				assert.Equal(t, []string{"ERR no such revision"}, c.request(t, "GET /a/b.txt r3\n"))
+				assert.Equal(t, []string{"ERR no such revision"}, c.request(t, "GET /a/b.txt rx\n"))
+				assert.Equal(t, []string{"ERR no such file"}, c.request(t, "GET /a/x\n"))
+			})
+
+			t.Run("lists directories", func(t *testing.T) {
+				assert.Equal(t, []string{"OK 2", "a r1", "a/ DIR"}, c.request(t, "LIST /\n"))
+				assert.Equal(t, []string{"OK 2", "b.txt r2", "c/ DIR"}, c.request(t, "LIST /a\n"))
+				assert.Equal(t, []string{"OK 2", "b.txt r2", "c/ DIR"}, c.request(t, "LIST /a/\n"))
+				assert.Equal(t, []string{"OK 0"}, c.request(t, "LIST /none/\n"))
+			})
+
+			t.Run("validates requests", func(t *testing.T) {
+				assert.Equal(t, []string{"OK usage: HELP|GET|PUT|LIST"}, c.request(t, "help\n"))
+				assert.Equal(t, []string{"ERR illegal file name"}, c.request(t, "PUT /a/ 1\na"))
+				assert.Equal(t, []string{"ERR illegal file name"}, c.request(t, "PUT a 1\na"))
+				assert.Equal(t, []string{"ERR illegal file name"}, c.request(t, "PUT /a//b 1\na"))
+				assert.Equal(t, []string{"ERR illegal file name"}, c.request(t, "GET /a*\n"))
+				assert.Equal(t, []string{"ERR text files only"}, c.request(t, "PUT /bin 2\n\x00\x01"))
+				assert.Equal(t, []string{"ERR usage: PUT file length newline data"}, c.request(t, "PUT /a\n"))
+				assert.Equal(t, []string{"ERR usage: GET file [revision]"}, c.request(t, "GET\n"))
+				assert.Equal(t, []string{"ERR usage: LIST dir"}, c.request(t, "LIST\n"))
+				assert.Equal(t, []string{"ERR illegal dir name"}, c.request(t, "LIST a\n"))
+			})
+
+			t.Run("disconnects on illegal methods", func(t *testing.T) {
+				_, err := c.conn.Write([]byte("DELETE /a\n"))
+				require.NoError(t, err)
+				assert.Equal(t, "ERR illegal method: DELETE", c.readLine(t))
+				_, err = c.reader.ReadString('\n')
+				assert.ErrorIs(t, err, io.EOF)
+			})
+
+			t.Run("disconnects on long lines", func(t *testing.T) {
+				c := startVCS(t, storage)
+				_, err := c.conn.Write([]byte("GET /" + strings.Repeat("a", vcs.MAX_LINE_LENGTH) + "\n"))
+				require.NoError(t, err)
+				assert.Equal(t, "ERR line too long", c.readLine(t))
+				_, err = c.reader.ReadString('\n')
+				assert.ErrorIs(t, err, io.EOF)
+			})
+		})
+	}
+}